@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	utils "github.com/bolt-observer/go_common/utils"
+	local_utils "github.com/bolt-observer/lightning-vault/utils"
+	sentry "github.com/getsentry/sentry-go"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+// Admin routes are only registered when ADMIN_API_KEY is set.
+
+// envName matches environments records can be moved to (secret names are split on _ when loading)
+var envName = regexp.MustCompile("^[A-Za-z0-9]+$")
+
+// MoveRequest is the payload of admin move and copy calls
+type MoveRequest struct {
+	PubKey         string  `json:"pubkey"`
+	UniqueID       string  `json:"unique_id,omitempty"`
+	TargetUniqueID string  `json:"target_unique_id,omitempty"`
+	TargetEnv      *string `json:"target_env,omitempty"`
+	Overwrite      bool    `json:"overwrite,omitempty"`
+}
+
+// MoveResult is the result of admin move and copy calls
+type MoveResult struct {
+	PubKey         string `json:"pubkey"`
+	UniqueID       string `json:"unique_id,omitempty"`
+	TargetUniqueID string `json:"target_unique_id,omitempty"`
+	TargetEnv      string `json:"target_env"`
+	Result         string `json:"result"`
+}
+
+// adminAPIKeys returns the entries of ADMIN_API_KEY
+func adminAPIKeys() []string {
+	return local_utils.SplitEntries(utils.GetEnvWithDefault("ADMIN_API_KEY", ""))
+}
+
+func configureAdmin() map[string]string {
+	entries := adminAPIKeys()
+	credentials := toDict(entries)
+	if len(credentials) == 0 {
+		return nil
+	}
+
+	checkPlaintextPasswords(entries)
+	checkIdentityEntries(entries)
+	glog.Infof("Admin routes are enabled for %d principal(s)", len(credentials))
+
+	return credentials
+}
+
+func (h *Handlers) registerAdmin(router *mux.Router, credentials map[string]string) {
+	if credentials == nil {
+		return
+	}
+
+	routes := router.PathPrefix("/admin/").Subrouter()
+	routes.Use(authMiddleware(credentials))
+
+	routes.Path("/move").HandlerFunc(h.MoveHandler).Methods(http.MethodPost)
+	routes.Path("/copy").HandlerFunc(h.CopyHandler).Methods(http.MethodPost)
+	routes.Path("/load").HandlerFunc(h.LoadSummaryHandler).Methods(http.MethodGet)
+	routes.Path("/purge").HandlerFunc(h.PurgeHandler).Methods(http.MethodPost)
+	routes.Path("/certificates").HandlerFunc(h.CertificatesHandler).Methods(http.MethodGet)
+	routes.Path("/verifications").HandlerFunc(h.VerificationsHandler).Methods(http.MethodGet)
+}
+
+// MoveHandler - re-keys a record to another uniqueId and/or environment
+func (h *Handlers) MoveHandler(w http.ResponseWriter, r *http.Request) {
+	h.relocate(w, r, true)
+}
+
+// CopyHandler - copies a record to another uniqueId and/or environment
+func (h *Handlers) CopyHandler(w http.ResponseWriter, r *http.Request) {
+	h.relocate(w, r, false)
+}
+
+// storedSecret returns the current value of secret name (tombstones count as missing), used for other environments
+func (h *Handlers) storedSecret(ctx context.Context, name string) (string, bool, error) {
+	secrets, err := h.SecretsManager.LoadSecrets(ctx, name)
+	if err != nil {
+		return "", false, err
+	}
+
+	value, ok := secrets[name]
+	if !ok || value == "{}" {
+		return "", false, nil
+	}
+
+	return value, true, nil
+}
+
+func (h *Handlers) relocate(w http.ResponseWriter, r *http.Request, move bool) {
+	var payload MoveRequest
+
+	ctx := context.Background()
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&payload)
+	if err != nil {
+		h.badRequest(w, r, CodeJSONInvalid, "json decoding failed", fmt.Sprintf("[Move] json decoding failed: %v", err))
+		return
+	}
+
+	if !utils.ValidatePubkey(payload.PubKey) {
+		h.badRequest(w, r, CodePubkeyInvalid, "pubkey validation failed", fmt.Sprintf("[Move] pubkey validation failed: %v", payload.PubKey))
+		return
+	}
+	if !utils.AlphaNumeric.MatchString(payload.UniqueID) || !utils.AlphaNumeric.MatchString(payload.TargetUniqueID) {
+		h.badRequest(w, r, CodeUniqueIDInvalid, "uniqueId is invalid", fmt.Sprintf("[Move] uniqueId is invalid - %v %v", payload.UniqueID, payload.TargetUniqueID))
+		return
+	}
+
+	targetEnv := environment
+	if payload.TargetEnv != nil {
+		targetEnv = *payload.TargetEnv
+	}
+	sameEnv := targetEnv == environment
+	if !sameEnv && !envName.MatchString(targetEnv) {
+		h.badRequest(w, r, CodeBadRequest, "target environment is invalid", fmt.Sprintf("[Move] target environment is invalid - %v", targetEnv))
+		return
+	}
+
+	if sameEnv && payload.UniqueID == payload.TargetUniqueID {
+		h.badRequest(w, r, CodeBadRequest, "source and target are the same", "[Move] source and target are the same")
+		return
+	}
+
+	operation, result := "Copy", ResultCopied
+	if move {
+		operation, result = "Move", ResultMoved
+	}
+
+	auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("%s %s (%s) to (%s) in env %q", operation, payload.PubKey, payload.UniqueID, payload.TargetUniqueID, targetEnv), r.Method)
+
+	// Serialize read-modify-write of records
+	h.RecordMutex.Lock()
+	defer h.RecordMutex.Unlock()
+
+	data, ok := h.lookup(payload.PubKey + payload.UniqueID)
+	if !ok {
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[%s] Secret %s not found", operation, payload.PubKey), r.Method)
+		notFound(w, r)
+		return
+	}
+
+	source := secretName(prefix, payload.PubKey, payload.UniqueID)
+	targetPrefix := prefix
+	if !sameEnv {
+		targetPrefix = envPrefix(targetEnv)
+	}
+	target := secretName(targetPrefix, payload.PubKey, payload.TargetUniqueID)
+
+	previous, exists := "", false
+	if sameEnv {
+		old, ok := h.lookup(payload.PubKey + payload.TargetUniqueID)
+		if ok {
+			previous, err = encodeRecord(&old)
+			if err != nil {
+				internalError(w, r)
+				return
+			}
+			exists = true
+		}
+	} else {
+		previous, exists, err = h.storedSecret(ctx, target)
+		if err != nil {
+			failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[%s] reading %s failed with error %v", operation, target, err), r.Method)
+			internalError(w, r)
+			return
+		}
+	}
+
+	if exists && !payload.Overwrite {
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[%s] Target %s already exists", operation, target), r.Method)
+		respondError(w, r, http.StatusConflict, CodeConflict, "Target already exists (set overwrite to replace it)")
+		return
+	}
+
+	if sameEnv {
+		if reqErr := h.aliasConflict(data, payload.TargetUniqueID); reqErr != nil {
+			failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[%s] %s", operation, reqErr.LogReason), r.Method)
+			respondError(w, r, http.StatusConflict, reqErr.Code, reqErr.Reason)
+			return
+		}
+	}
+
+	value, err := encodeRecord(&data)
+	if err != nil {
+		internalError(w, r)
+		return
+	}
+
+	_, _, err = h.SecretsManager.InsertOrUpdateSecret(ctx, target, value, recordMetadata(targetEnv, &data, payload.TargetUniqueID))
+	if err != nil {
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[%s] writing %s failed with error %v", operation, target, err), r.Method)
+		internalError(w, r)
+		return
+	}
+
+	if move {
+		_, err = h.SecretsManager.DeleteSecret(ctx, source)
+		if err != nil {
+			failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[%s] deleting %s failed with error %v", operation, source, err), r.Method)
+			h.rollbackTarget(ctx, target, previous, exists)
+			internalError(w, r)
+			return
+		}
+	}
+
+	if sameEnv {
+		h.toLookup(data, payload.TargetUniqueID)
+	}
+	if move {
+		h.deleteLookup(data, payload.UniqueID)
+	}
+
+	ret := MoveResult{
+		PubKey:         payload.PubKey,
+		UniqueID:       payload.UniqueID,
+		TargetUniqueID: payload.TargetUniqueID,
+		TargetEnv:      targetEnv,
+		Result:         result,
+	}
+	respondJSON(w, r, http.StatusOK, ret, ret)
+}
+
+// rollbackTarget restores the target of a failed move
+func (h *Handlers) rollbackTarget(ctx context.Context, target, previous string, existed bool) {
+	var err error
+
+	if existed {
+		// Only the value is restored, metadata written by the failed move is kept (nil keeps it)
+		_, _, err = h.SecretsManager.InsertOrUpdateSecret(ctx, target, previous, nil)
+	} else {
+		_, err = h.SecretsManager.DeleteSecret(ctx, target)
+	}
+
+	if err != nil {
+		glog.Errorf("Rolling back %s failed: %v", target, err)
+		sentry.CaptureException(err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	entities "github.com/bolt-observer/go_common/entities"
+	local_utils "github.com/bolt-observer/lightning-vault/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memorySecrets wires a TestSecretsManager to an in-memory map
+func memorySecrets(h *Handlers) map[string]string {
+	store := make(map[string]string)
+	mgr := h.SecretsManager.(*local_utils.TestSecretsManager)
+
+	mgr.InsertOrUpdateSecretFn = func(ctx context.Context, name, value string, metadata local_utils.Metadata) (string, local_utils.Change, error) {
+		_, exists := store[name]
+		store[name] = value
+		if exists {
+			return name, local_utils.Updated, nil
+		}
+		return name, local_utils.Inserted, nil
+	}
+	mgr.DeleteSecretFn = func(ctx context.Context, name string) (string, error) {
+		if _, exists := store[name]; !exists {
+			return "", fmt.Errorf("cannot invalidate secret that does not exist: %s", name)
+		}
+		store[name] = "{}"
+		return name, nil
+	}
+	mgr.LoadSecretsFn = func(ctx context.Context, prefix string) (map[string]string, error) {
+		ret := make(map[string]string)
+		for k, v := range store {
+			if strings.HasPrefix(k, prefix) {
+				ret[k] = v
+			}
+		}
+		return ret, nil
+	}
+
+	return store
+}
+
+func TestMoveAndCopy(t *testing.T) {
+	prometheusInit()
+	freshAuthThrottle(t)
+
+	pubkey := "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7"
+
+	h := MakeNewDummyHandlers()
+	store := memorySecrets(h)
+	router := v1Router(h)
+
+	data := entities.Data{PubKey: pubkey, MacaroonHex: testMacaroon, Endpoint: "127.0.0.1:10009", Tags: "alice"}
+	_, err := h.storeSecret(context.Background(), &data, "tenant1")
+	require.NoError(t, err)
+
+	w := call(router, http.MethodPost, "/v1/admin/copy", "admin", `{"pubkey": "`+pubkey+`", "unique_id": "tenant1", "target_unique_id": "tenant2"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var result MoveResult
+	decodeEnvelope(t, w, &result)
+	assert.Equal(t, ResultCopied, result.Result)
+
+	assert.Equal(t, store["_"+pubkey+"tenant1_"], store["_"+pubkey+"tenant2_"])
+	_, ok := h.lookup(pubkey + "tenant1")
+	assert.True(t, ok)
+	_, ok = h.lookup(pubkey + "tenant2")
+	assert.True(t, ok)
+
+	// Target exists
+	w = call(router, http.MethodPost, "/v1/admin/move", "admin", `{"pubkey": "`+pubkey+`", "unique_id": "tenant1", "target_unique_id": "tenant2"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = call(router, http.MethodPost, "/v1/admin/move", "admin", `{"pubkey": "`+pubkey+`", "unique_id": "tenant1", "target_unique_id": "tenant2", "overwrite": true}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "{}", store["_"+pubkey+"tenant1_"])
+	_, ok = h.lookup(pubkey + "tenant1")
+	assert.False(t, ok)
+	r := call(router, http.MethodGet, "/v1/alias/tenant1/alice", "reader", "")
+	assert.Equal(t, http.StatusNotFound, r.Code)
+	r = call(router, http.MethodGet, "/v1/alias/tenant2/alice", "reader", "")
+	assert.Equal(t, http.StatusOK, r.Code)
+
+	// Other environment only touches the store
+	w = call(router, http.MethodPost, "/v1/admin/move", "admin", `{"pubkey": "`+pubkey+`", "unique_id": "tenant2", "target_env": "staging"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	result = MoveResult{}
+	decodeEnvelope(t, w, &result)
+	assert.Equal(t, "staging", result.TargetEnv)
+	assert.Contains(t, store["stagingmacaroon_"+pubkey+"_"], testMacaroon)
+	assert.Equal(t, "{}", store["_"+pubkey+"tenant2_"])
+	_, ok = h.lookup(pubkey)
+	assert.False(t, ok)
+	_, ok = h.lookup(pubkey + "tenant2")
+	assert.False(t, ok)
+
+	w = call(router, http.MethodPost, "/v1/admin/copy", "admin", `{"pubkey": "`+pubkey+`", "unique_id": "tenant2", "target_unique_id": "tenant3"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	for _, body := range []string{
+		`{"pubkey": "` + pubkey + `", "unique_id": "tenant1", "target_unique_id": "tenant1"}`,
+		`{"pubkey": "` + pubkey + `", "unique_id": "tenant1", "target_unique_id": "not valid!"}`,
+		`{"pubkey": "` + pubkey + `", "target_env": "a/b"}`,
+		`{"pubkey": "` + pubkey + `", "target_env": "a_b"}`,
+		`{"pubkey": "` + pubkey + `", "target_env": "a-b"}`,
+		`{"pubkey": "alice", "target_unique_id": "tenant2"}`,
+		`nonsense`,
+	} {
+		w = call(router, http.MethodPost, "/v1/admin/copy", "admin", body)
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+
+	w = call(router, http.MethodPost, "/v1/admin/copy", "writer", `{}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestMoveRollback(t *testing.T) {
+	prometheusInit()
+
+	pubkey := "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7"
+
+	h := MakeNewDummyHandlers()
+	store := memorySecrets(h)
+	router := v1Router(h)
+
+	data := entities.Data{PubKey: pubkey, MacaroonHex: testMacaroon, Endpoint: "127.0.0.1:10009"}
+	_, err := h.storeSecret(context.Background(), &data, "tenant1")
+	require.NoError(t, err)
+
+	mgr := h.SecretsManager.(*local_utils.TestSecretsManager)
+	deleteFn := mgr.DeleteSecretFn
+	mgr.DeleteSecretFn = func(ctx context.Context, name string) (string, error) {
+		if strings.Contains(name, "tenant1") {
+			return "", fmt.Errorf("backend failure")
+		}
+		return deleteFn(ctx, name)
+	}
+
+	w := call(router, http.MethodPost, "/v1/admin/move", "admin", `{"pubkey": "`+pubkey+`", "unique_id": "tenant1", "target_unique_id": "tenant2"}`)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	assert.Equal(t, "{}", store["_"+pubkey+"tenant2_"])
+	assert.Contains(t, store["_"+pubkey+"tenant1_"], testMacaroon)
+	_, ok := h.lookup(pubkey + "tenant1")
+	assert.True(t, ok)
+	_, ok = h.lookup(pubkey + "tenant2")
+	assert.False(t, ok)
+}
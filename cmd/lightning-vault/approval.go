@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	entities "github.com/bolt-observer/go_common/entities"
+	utils "github.com/bolt-observer/go_common/utils"
+	local_utils "github.com/bolt-observer/lightning-vault/utils"
+	sentry "github.com/getsentry/sentry-go"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+// Operation enum
+type Operation string
+
+// Operation values
+const (
+	OperationPut    Operation = "put"
+	OperationDelete Operation = "delete"
+)
+
+// ChangeStatus enum
+type ChangeStatus string
+
+// ChangeStatus values
+const (
+	StatusPending  ChangeStatus = "pending"
+	StatusApproved ChangeStatus = "approved"
+	StatusRejected ChangeStatus = "rejected"
+	StatusExpired  ChangeStatus = "expired"
+	StatusFailed   ChangeStatus = "failed"
+)
+
+const (
+	// DefaultApprovalTTL is how long a change request waits for approval
+	DefaultApprovalTTL = 24 * time.Hour
+	// DefaultApprovalRetention is how long decided change requests are kept
+	DefaultApprovalRetention = 30 * 24 * time.Hour
+
+	// noRecord is the base version of a change request for a record that did not exist yet
+	noRecord = "none"
+)
+
+var errRecordChanged = errors.New("record changed since the change request was submitted")
+
+// ChangeRequest is a pending put or delete waiting for approval of a second write principal
+type ChangeRequest struct {
+	ID          string         `json:"id"`
+	Operation   Operation      `json:"operation"`
+	PubKey      string         `json:"pubkey"`
+	UniqueID    string         `json:"unique_id"`
+	Data        *entities.Data `json:"data,omitempty"`
+	Deletion    *DeleteOptions `json:"deletion,omitempty"`
+	BaseVersion string         `json:"base_version,omitempty"`
+	Verified    bool           `json:"verified"`
+	Submitter   string         `json:"submitter"`
+	SubmittedAt time.Time      `json:"submitted_at"`
+	ExpiresAt   time.Time      `json:"expires_at"`
+	Status      ChangeStatus   `json:"status"`
+	Approver    string         `json:"approver,omitempty"`
+	DecidedAt   *time.Time     `json:"decided_at,omitempty"`
+	Reason      string         `json:"reason,omitempty"`
+}
+
+// Redacted returns a copy of the change request that is safe to show (no macaroon/rune)
+func (c *ChangeRequest) Redacted() ChangeRequest {
+	ret := *c
+	if c.Data != nil {
+		data := *c.Data
+		if data.MacaroonHex != "" {
+			data.MacaroonHex = "<redacted>"
+		}
+		ret.Data = &data
+	}
+
+	return ret
+}
+
+// Approvals holds all change requests
+type Approvals struct {
+	Mutex    sync.Mutex
+	Requests map[string]*ChangeRequest
+}
+
+// NewApprovals - creates new Approvals
+func NewApprovals() *Approvals {
+	return &Approvals{
+		Requests: make(map[string]*ChangeRequest),
+	}
+}
+
+var (
+	approvalRequired  bool
+	approvalTTL       = DefaultApprovalTTL
+	approvalRetention = DefaultApprovalRetention
+	approvalPrefix    string
+)
+
+func configureApprovals() {
+	required, err := strconv.ParseBool(utils.GetEnvWithDefault("APPROVAL_REQUIRED", "false"))
+	if err != nil {
+		fatalError("APPROVAL_REQUIRED could not be parsed", err)
+	}
+	approvalRequired = required
+
+	ttl, err := time.ParseDuration(utils.GetEnvWithDefault("APPROVAL_TTL", DefaultApprovalTTL.String()))
+	if err != nil {
+		fatalError("APPROVAL_TTL could not be parsed", err)
+	}
+	approvalTTL = ttl
+
+	retention, err := time.ParseDuration(utils.GetEnvWithDefault("APPROVAL_RETENTION", DefaultApprovalRetention.String()))
+	if err != nil {
+		fatalError("APPROVAL_RETENTION could not be parsed", err)
+	}
+	approvalRetention = retention
+}
+
+// recordVersion returns the hash of the stored record pubkey + uniqueID (noRecord when there is none)
+func (h *Handlers) recordVersion(pubkey, uniqueID string) string {
+	data, ok := h.lookup(pubkey + uniqueID)
+	if !ok {
+		return noRecord
+	}
+
+	return dataVersion(&data)
+}
+
+// dataVersion returns the hash of record data
+func dataVersion(data *entities.Data) string {
+	value, err := encodeRecord(data)
+	if err != nil {
+		return ""
+	}
+
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:])
+}
+
+// sameIdentity returns true when both principals are the same user or role (sessions of an assumed role are the same role)
+func sameIdentity(a, b string) bool {
+	return strings.EqualFold(normalizeIdentity(a), normalizeIdentity(b))
+}
+
+// normalizeIdentity turns arn:aws:sts::account:assumed-role/role/session into arn:aws:iam::account:role/role
+func normalizeIdentity(principal string) string {
+	parts := strings.SplitN(principal, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "sts" || !strings.HasPrefix(parts[5], "assumed-role/") {
+		return principal
+	}
+
+	resource := strings.Split(parts[5], "/")
+	if len(resource) < 2 {
+		return principal
+	}
+
+	return fmt.Sprintf("arn:%s:iam::%s:role/%s", parts[1], parts[4], resource[1])
+}
+
+func (h *Handlers) changeRequestName(c *ChangeRequest) string {
+	return fmt.Sprintf("%s_%s_", approvalPrefix, c.ID)
+}
+
+func newChangeRequestID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func (h *Handlers) saveChangeRequest(ctx context.Context, c *ChangeRequest) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = h.SecretsManager.InsertOrUpdateSecret(ctx, h.changeRequestName(c), string(b), envMetadata(environment))
+	return err
+}
+
+func (h *Handlers) loadChangeRequests(ctx context.Context) {
+	h.Approvals.Mutex.Lock()
+	defer h.Approvals.Mutex.Unlock()
+
+	secrets, err := h.SecretsManager.LoadSecrets(ctx, approvalPrefix)
+	if err != nil {
+		glog.Warningf("Not all change requests could be loaded: %v", err)
+		sentry.CaptureException(err)
+	}
+
+	for k, v := range secrets {
+		if v == "{}" {
+			continue
+		}
+
+		var c ChangeRequest
+		err := json.Unmarshal([]byte(v), &c)
+		if err != nil || c.ID == "" {
+			glog.Warningf("Error unmarshalling change request %v: %v\n", k, err)
+			continue
+		}
+
+		h.Approvals.Requests[c.ID] = &c
+	}
+
+	h.expireChangeRequests(ctx)
+}
+
+// expireChangeRequests marks stale pending requests as expired and removes decided ones after approvalRetention, mutex must be held
+func (h *Handlers) expireChangeRequests(ctx context.Context) {
+	now := time.Now()
+
+	for _, c := range h.Approvals.Requests {
+		if c.Status != StatusPending && c.DecidedAt != nil && now.Sub(*c.DecidedAt) > approvalRetention {
+			h.removeChangeRequest(ctx, c)
+			continue
+		}
+
+		if c.Status != StatusPending || now.Before(c.ExpiresAt) {
+			continue
+		}
+
+		c.Status = StatusExpired
+		c.DecidedAt = &now
+		// Do not keep the secret around
+		c.Data = nil
+
+		glog.Infof("[AUDIT LOG] Change request %s (%s %s (%s) by %s) expired", c.ID, c.Operation, c.PubKey, c.UniqueID, c.Submitter)
+		if err := h.saveChangeRequest(ctx, c); err != nil {
+			glog.Warningf("Could not save expired change request %s: %v", c.ID, err)
+			sentry.CaptureException(err)
+		}
+	}
+}
+
+// removeChangeRequest deletes a decided change request from the secrets manager (when that fails it is retried later), mutex must be held
+func (h *Handlers) removeChangeRequest(ctx context.Context, c *ChangeRequest) {
+	options := DeleteOptions{Mode: DeleteModeSchedule, RecoveryDays: recoveryDays}
+	if _, ok := h.SecretsManager.(local_utils.Purger); !ok {
+		options.Mode = DeleteModeTombstone
+	}
+
+	err := h.deleteSecret(ctx, h.changeRequestName(c), options)
+	if err != nil && !errors.Is(err, local_utils.ErrSecretNotFound) {
+		glog.Warningf("Could not remove change request %s: %v", c.ID, err)
+		sentry.CaptureException(err)
+		return
+	}
+
+	glog.Infof("[AUDIT LOG] Change request %s (%s %s (%s) by %s) %s, removed after retention", c.ID, c.Operation, c.PubKey, c.UniqueID, c.Submitter, c.Status)
+	delete(h.Approvals.Requests, c.ID)
+}
+
+func (h *Handlers) submitChangeRequest(w http.ResponseWriter, r *http.Request, op Operation, data *entities.Data, uniqueID string, verified bool) {
+	c, err := h.createChangeRequest(r, op, data, uniqueID, verified)
+	if err != nil {
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Could not create change request %v", err), r.Method)
+		internalError(w, r)
+		return
+	}
+
+	result := OperationResult{PubKey: c.PubKey, UniqueID: uniqueID, Result: ResultPendingApproval, ChangeRequestID: c.ID}
+	respond(w, r, http.StatusAccepted, result, fmt.Sprintf("Change request %s submitted, awaiting approval\n", c.ID))
+}
+
+// createChangeRequest stores a new pending change request
+func (h *Handlers) createChangeRequest(r *http.Request, op Operation, data *entities.Data, uniqueID string, verified bool) (*ChangeRequest, error) {
+	ctx := context.Background()
+
+	id, err := newChangeRequestID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	c := &ChangeRequest{
+		ID:          id,
+		Operation:   op,
+		PubKey:      data.PubKey,
+		UniqueID:    uniqueID,
+		BaseVersion: h.recordVersion(data.PubKey, uniqueID),
+		Verified:    verified,
+		Submitter:   getPrincipal(r),
+		SubmittedAt: now,
+		ExpiresAt:   now.Add(approvalTTL),
+		Status:      StatusPending,
+	}
+
+	if op == OperationPut {
+		c.Data = data
+	}
+	if op == OperationDelete {
+		// Validated by DeleteHandler
+		options, _ := deleteOptions(r)
+		c.Deletion = &options
+	}
+
+	h.Approvals.Mutex.Lock()
+	defer h.Approvals.Mutex.Unlock()
+
+	err = h.saveChangeRequest(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	h.Approvals.Requests[c.ID] = c
+
+	auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Change request %s submitted: %s %s (%s) verified %v", c.ID, op, c.PubKey, uniqueID, verified), r.Method)
+
+	return c, nil
+}
+
+// ListChangeRequestsHandler - lists pending change requests
+func (h *Handlers) ListChangeRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	h.Approvals.Mutex.Lock()
+	h.expireChangeRequests(context.Background())
+
+	all := r.URL.Query().Get("all") != ""
+	result := make([]ChangeRequest, 0)
+	for _, c := range h.Approvals.Requests {
+		if all || c.Status == StatusPending {
+			result = append(result, c.Redacted())
+		}
+	}
+	h.Approvals.Mutex.Unlock()
+
+	sort.Slice(result, func(i, j int) bool { return result[i].SubmittedAt.Before(result[j].SubmittedAt) })
+
+	auditLog(r.Header.Get("Authorization"), r.RemoteAddr, "List change requests", r.Method)
+	respondJSON(w, r, http.StatusOK, result, result)
+}
+
+// GetChangeRequestHandler - shows one change request
+func (h *Handlers) GetChangeRequestHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	h.Approvals.Mutex.Lock()
+	h.expireChangeRequests(context.Background())
+
+	c, ok := h.Approvals.Requests[id]
+	if !ok {
+		h.Approvals.Mutex.Unlock()
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[Approval] Change request %s not found", id), r.Method)
+		notFound(w, r)
+		return
+	}
+	result := c.Redacted()
+	h.Approvals.Mutex.Unlock()
+
+	auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Get change request %s", id), r.Method)
+	respondJSON(w, r, http.StatusOK, result, result)
+}
+
+// ApproveHandler - approves and applies a change request
+func (h *Handlers) ApproveHandler(w http.ResponseWriter, r *http.Request) {
+	h.decide(w, r, true)
+}
+
+// RejectHandler - rejects a change request
+func (h *Handlers) RejectHandler(w http.ResponseWriter, r *http.Request) {
+	h.decide(w, r, false)
+}
+
+func (h *Handlers) decide(w http.ResponseWriter, r *http.Request, approve bool) {
+	ctx := context.Background()
+	id := mux.Vars(r)["id"]
+	principal := getPrincipal(r)
+
+	h.Approvals.Mutex.Lock()
+	defer h.Approvals.Mutex.Unlock()
+
+	h.expireChangeRequests(ctx)
+
+	c, ok := h.Approvals.Requests[id]
+	if !ok {
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[Approval] Change request %s not found", id), r.Method)
+		notFound(w, r)
+		return
+	}
+
+	if c.Status != StatusPending {
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[Approval] Change request %s is %s", id, c.Status), r.Method)
+		respondError(w, r, http.StatusConflict, CodeConflict, fmt.Sprintf("Change request is %s", c.Status))
+		return
+	}
+
+	if approve && sameIdentity(c.Submitter, principal) {
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[Approval] %s tried to approve own change request %s", principal, id), r.Method)
+		respondError(w, r, http.StatusForbidden, CodeForbidden, "Change request must be approved by a different user")
+		return
+	}
+
+	now := time.Now()
+	c.Approver = principal
+	c.DecidedAt = &now
+	c.Reason = r.URL.Query().Get("reason")
+
+	if !approve {
+		c.Status = StatusRejected
+		c.Data = nil
+
+		if err := h.saveChangeRequest(ctx, c); err != nil {
+			glog.Warningf("Could not save change request %s: %v", c.ID, err)
+			sentry.CaptureException(err)
+		}
+
+		auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Change request %s rejected: %s %s (%s) submitted by %s", c.ID, c.Operation, c.PubKey, c.UniqueID, c.Submitter), r.Method)
+		result := OperationResult{PubKey: c.PubKey, UniqueID: c.UniqueID, Result: ResultRejected, ChangeRequestID: c.ID}
+		respond(w, r, http.StatusOK, result, fmt.Sprintf("Change request %s rejected\n", c.ID))
+		return
+	}
+
+	err := h.applyChangeRequest(ctx, c)
+	if err != nil {
+		c.Status = StatusFailed
+	} else {
+		c.Status = StatusApproved
+	}
+	c.Data = nil
+
+	if err := h.saveChangeRequest(ctx, c); err != nil {
+		glog.Warningf("Could not save change request %s: %v", c.ID, err)
+		sentry.CaptureException(err)
+	}
+
+	if errors.Is(err, errRecordChanged) {
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[Approval] Change request %s not applied: %v", c.ID, err), r.Method)
+		respondError(w, r, http.StatusConflict, CodeConflict, "Record changed since the change request was submitted")
+		return
+	}
+	if err != nil {
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Applying change request %s failed with error %v", c.ID, err), r.Method)
+		internalError(w, r)
+		return
+	}
+
+	auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Change request %s approved: %s %s (%s) submitted by %s", c.ID, c.Operation, c.PubKey, c.UniqueID, c.Submitter), r.Method)
+	result := OperationResult{PubKey: c.PubKey, UniqueID: c.UniqueID, Result: ResultApproved, ChangeRequestID: c.ID}
+	respond(w, r, http.StatusOK, result, fmt.Sprintf("Change request %s approved\n", c.ID))
+}
+
+func (h *Handlers) applyChangeRequest(ctx context.Context, c *ChangeRequest) error {
+	// The version check and the write must not interleave with other writes
+	h.RecordMutex.Lock()
+	defer h.RecordMutex.Unlock()
+
+	// Requests stored before versions were recorded have none
+	if c.BaseVersion != "" && c.BaseVersion != h.recordVersion(c.PubKey, c.UniqueID) {
+		return errRecordChanged
+	}
+
+	switch c.Operation {
+	case OperationPut:
+		if c.Data == nil {
+			return fmt.Errorf("change request has no data")
+		}
+		_, err := h.storeSecret(ctx, c.Data, c.UniqueID)
+		return err
+	case OperationDelete:
+		e, ok := h.lookup(c.PubKey + c.UniqueID)
+		if !ok {
+			return fmt.Errorf("secret %s (%s) no longer exists", c.PubKey, c.UniqueID)
+		}
+		options := DeleteOptions{Mode: deleteMode, RecoveryDays: recoveryDays}
+		if c.Deletion != nil {
+			options = *c.Deletion
+		}
+		return h.removeSecret(ctx, e, c.UniqueID, options)
+	}
+
+	return fmt.Errorf("unknown operation %s", c.Operation)
+}
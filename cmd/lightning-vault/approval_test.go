@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	entities "github.com/bolt-observer/go_common/entities"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRune is a valid CLN rune (its restrictions do not matter here)
+const testRune = "tU-RLjMiDpY2U0o3W1oFowar36RFGpWloPbW9-RuZdo9MyZpZD0wMjRiOWExZmE4ZTAwNmYxZTM5MzdmNjVmNjZjNDA4ZTZkYThlMWNhNzI4ZWE0MzIyMmE3MzgxZGYxY2M0NDk2MDUmbWV0aG9kPWxpc3RwZWVycyZwbnVtPTEmcG5hbWVpZF4wMjRiOWExZmE4ZTAwNmYxZTM5M3xwYXJyMF4wMjRiOWExZmE4ZTAwNmYxZTM5MyZ0aW1lPDE2NTY5MjA1MzgmcmF0ZT0y"
+
+func submit(t *testing.T, h *Handlers, principal, body string) string {
+	r := httptest.NewRequest(http.MethodPost, "https://localhost/put", strings.NewReader(body))
+	r = withPrincipal(r, principal)
+	w := httptest.NewRecorder()
+
+	h.PutHandler(w, r)
+	require.Equal(t, http.StatusAccepted, w.Result().StatusCode)
+
+	var id string
+	_, err := fmt.Sscanf(getBody(w), "Change request %s submitted", &id)
+	require.NoError(t, err)
+
+	return id
+}
+
+func decideAs(h *Handlers, principal, id string, approve bool) int {
+	r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("https://localhost/approval/%s/approve", id), nil)
+	r = mux.SetURLVars(r, map[string]string{"id": id})
+	r = withPrincipal(r, principal)
+	w := httptest.NewRecorder()
+
+	if approve {
+		h.ApproveHandler(w, r)
+	} else {
+		h.RejectHandler(w, r)
+	}
+
+	return w.Result().StatusCode
+}
+
+func TestApprovalWorkflow(t *testing.T) {
+	prometheusInit()
+
+	approvalRequired = true
+	defer func() { approvalRequired = false }()
+
+	pubKey := "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7"
+	rune := testRune
+	body := fmt.Sprintf(`{"pubkey": "%s", "macaroon_hex": "%s", "endpoint": "127.0.0.1:9735"}`, pubKey, rune)
+
+	h := MakeNewDummyHandlers()
+	h.VerifyCall = func(w http.ResponseWriter, r *http.Request, data *entities.Data, pubkey, uniqueID string) bool {
+		return true
+	}
+
+	id := submit(t, h, "alice", body)
+
+	// Nothing is applied yet
+	expectNotRead(pubKey, "", h, t)
+
+	// Secret is not shown to approvers
+	r := httptest.NewRequest(http.MethodGet, "https://localhost/approval/", nil)
+	w := httptest.NewRecorder()
+	h.ListChangeRequestsHandler(w, r)
+	var list []ChangeRequest
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	require.Equal(t, 1, len(list))
+	assert.Equal(t, id, list[0].ID)
+	assert.Equal(t, "alice", list[0].Submitter)
+	assert.True(t, list[0].Verified)
+	assert.NotEqual(t, rune, list[0].Data.MacaroonHex)
+
+	assert.Equal(t, http.StatusForbidden, decideAs(h, "alice", id, true))
+	expectNotRead(pubKey, "", h, t)
+
+	assert.Equal(t, http.StatusOK, decideAs(h, "bob", id, true))
+	expectRead(pubKey, pubKey, "", h, t)
+	assert.Equal(t, StatusApproved, h.Approvals.Requests[id].Status)
+	assert.Equal(t, "bob", h.Approvals.Requests[id].Approver)
+	assert.Nil(t, h.Approvals.Requests[id].Data)
+
+	// Cannot decide twice
+	assert.Equal(t, http.StatusConflict, decideAs(h, "carol", id, true))
+	assert.Equal(t, http.StatusNotFound, decideAs(h, "carol", "nonexisting", true))
+
+	// Delete needs approval too
+	r = httptest.NewRequest(http.MethodDelete, "https://localhost/delete", nil)
+	r = mux.SetURLVars(r, map[string]string{"pubkey": pubKey})
+	r = withPrincipal(r, "bob")
+	w = httptest.NewRecorder()
+	h.DeleteHandler(w, r)
+	require.Equal(t, http.StatusAccepted, w.Result().StatusCode)
+
+	var deleteID string
+	_, err := fmt.Sscanf(getBody(w), "Change request %s submitted", &deleteID)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, decideAs(h, "alice", deleteID, false))
+	assert.Equal(t, StatusRejected, h.Approvals.Requests[deleteID].Status)
+	expectRead(pubKey, pubKey, "", h, t)
+
+	// Stale requests expire
+	id = submit(t, h, "alice", body)
+	h.Approvals.Requests[id].ExpiresAt = time.Now().Add(-time.Second)
+	assert.Equal(t, http.StatusConflict, decideAs(h, "bob", id, true))
+	assert.Equal(t, StatusExpired, h.Approvals.Requests[id].Status)
+	assert.Nil(t, h.Approvals.Requests[id].Data)
+}
+
+func TestApprovalRecordChanged(t *testing.T) {
+	prometheusInit()
+
+	approvalRequired = true
+	defer func() { approvalRequired = false }()
+
+	pubKey := "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7"
+	body := func(endpoint string) string {
+		return fmt.Sprintf(`{"pubkey": "%s", "macaroon_hex": "%s", "endpoint": "%s"}`, pubKey, testRune, endpoint)
+	}
+
+	h := MakeNewDummyHandlers()
+	h.VerifyCall = func(w http.ResponseWriter, r *http.Request, data *entities.Data, pubkey, uniqueID string) bool {
+		return true
+	}
+
+	first := submit(t, h, "alice", body("127.0.0.1:9735"))
+	second := submit(t, h, "alice", body("127.0.0.2:9735"))
+
+	assert.Equal(t, http.StatusOK, decideAs(h, "bob", first, true))
+	data := read(pubKey, "", h, t)
+	assert.Equal(t, "127.0.0.1:9735", data.Endpoint)
+
+	// Second request was based on the record before the first one was applied
+	assert.Equal(t, http.StatusConflict, decideAs(h, "bob", second, true))
+	assert.Equal(t, StatusFailed, h.Approvals.Requests[second].Status)
+	data = read(pubKey, "", h, t)
+	assert.Equal(t, "127.0.0.1:9735", data.Endpoint)
+}
+
+func TestApprovalRetention(t *testing.T) {
+	prometheusInit()
+
+	approvalRequired = true
+	defer func() { approvalRequired = false }()
+
+	body := fmt.Sprintf(`{"pubkey": "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7", "macaroon_hex": "%s", "endpoint": "127.0.0.1:9735"}`, testRune)
+
+	h := MakeNewDummyHandlers()
+	h.VerifyCall = func(w http.ResponseWriter, r *http.Request, data *entities.Data, pubkey, uniqueID string) bool {
+		return true
+	}
+
+	id := submit(t, h, "alice", body)
+	pending := submit(t, h, "alice", body)
+	assert.Equal(t, http.StatusOK, decideAs(h, "bob", id, false))
+
+	name := h.changeRequestName(h.Approvals.Requests[id])
+	secrets, err := h.SecretsManager.LoadSecrets(context.Background(), name)
+	require.NoError(t, err)
+	require.Contains(t, secrets, name)
+
+	decided := time.Now().Add(-approvalRetention - time.Minute)
+	h.Approvals.Requests[id].DecidedAt = &decided
+
+	h.Approvals.Mutex.Lock()
+	h.expireChangeRequests(context.Background())
+	h.Approvals.Mutex.Unlock()
+
+	assert.NotContains(t, h.Approvals.Requests, id)
+	assert.Contains(t, h.Approvals.Requests, pending)
+	secrets, err = h.SecretsManager.LoadSecrets(context.Background(), name)
+	require.NoError(t, err)
+	assert.NotContains(t, secrets, name)
+}
+
+func TestSameIdentity(t *testing.T) {
+	assert.True(t, sameIdentity("alice", "Alice"))
+	assert.False(t, sameIdentity("alice", "bob"))
+
+	assert.True(t, sameIdentity("arn:aws:sts::123456789012:assumed-role/writer/session1", "arn:aws:sts::123456789012:assumed-role/writer/session2"))
+	assert.True(t, sameIdentity("arn:aws:sts::123456789012:assumed-role/writer/session1", "arn:aws:iam::123456789012:role/writer"))
+	assert.False(t, sameIdentity("arn:aws:sts::123456789012:assumed-role/writer/session1", "arn:aws:sts::123456789012:assumed-role/approver/session1"))
+	assert.False(t, sameIdentity("arn:aws:sts::123456789012:assumed-role/writer/session1", "arn:aws:sts::210987654321:assumed-role/writer/session1"))
+	assert.False(t, sameIdentity("arn:aws:iam::123456789012:user/alice", "arn:aws:iam::123456789012:user/bob"))
+}
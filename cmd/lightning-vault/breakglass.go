@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	utils "github.com/bolt-observer/go_common/utils"
+	local_utils "github.com/bolt-observer/lightning-vault/utils"
+	sentry "github.com/getsentry/sentry-go"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+// Break-glass lets a separately configured principal retrieve the original (unconstrained) secret
+// for disaster recovery. It is disabled by default and can only be enabled with BREAK_GLASS_ENABLED
+// and BREAK_GLASS_API_KEY, the standard READ_API_KEY_* and WRITE_API_KEY roles never grant it.
+// Requests are only kept in memory, a restart drops them (and with them the delay that already passed).
+
+const (
+	// DefaultBreakGlassDelay is how long one needs to wait after requesting
+	DefaultBreakGlassDelay = 1 * time.Hour
+	// DefaultBreakGlassWindow is how long the secret can be retrieved after the delay
+	DefaultBreakGlassWindow = 1 * time.Hour
+	// MinJustificationLength is the minimal length of the justification
+	MinJustificationLength = 20
+)
+
+// BreakGlassRequest struct
+type BreakGlassRequest struct {
+	ID            string     `json:"id"`
+	Principal     string     `json:"principal"`
+	PubKey        string     `json:"pubkey"`
+	UniqueID      string     `json:"unique_id"`
+	Justification string     `json:"justification"`
+	RequestedAt   time.Time  `json:"requested_at"`
+	AvailableAt   time.Time  `json:"available_at"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	RetrievedAt   *time.Time `json:"retrieved_at,omitempty"`
+}
+
+// BreakGlassEvent is sent to the notification hook
+type BreakGlassEvent struct {
+	Event   string            `json:"event"`
+	Request BreakGlassRequest `json:"request"`
+}
+
+// BreakGlass holds break-glass configuration and requests
+type BreakGlass struct {
+	Delay  time.Duration
+	Window time.Duration
+	Notify func(event BreakGlassEvent)
+
+	Mutex    sync.Mutex
+	Requests map[string]*BreakGlassRequest
+}
+
+// NewBreakGlass - creates new BreakGlass
+func NewBreakGlass() *BreakGlass {
+	return &BreakGlass{
+		Delay:    DefaultBreakGlassDelay,
+		Window:   DefaultBreakGlassWindow,
+		Notify:   func(event BreakGlassEvent) {},
+		Requests: make(map[string]*BreakGlassRequest),
+	}
+}
+
+type breakGlassPayload struct {
+	Justification string `json:"justification"`
+}
+
+// configureBreakGlass returns break-glass credentials or nil when the feature is disabled
+func (h *Handlers) configureBreakGlass(otherKeys ...[]string) map[string]string {
+	enabled, err := strconv.ParseBool(utils.GetEnvWithDefault("BREAK_GLASS_ENABLED", "false"))
+	if err != nil {
+		fatalError("BREAK_GLASS_ENABLED could not be parsed", err)
+	}
+
+	if !enabled {
+		return nil
+	}
+
+	entries := local_utils.SplitEntries(utils.GetEnv("BREAK_GLASS_API_KEY"))
+	credentials := toDict(entries)
+	if len(credentials) == 0 {
+		fatalError("BREAK_GLASS_ENABLED is set but BREAK_GLASS_API_KEY is empty", nil)
+	}
+
+	checkPlaintextPasswords(entries)
+	checkIdentityEntries(entries)
+
+	if err := checkBreakGlassOverlap(credentials, otherKeys...); err != nil {
+		fatalError("Break-glass principals must not have any other role", err)
+	}
+
+	h.BreakGlass.Delay, err = time.ParseDuration(utils.GetEnvWithDefault("BREAK_GLASS_DELAY", DefaultBreakGlassDelay.String()))
+	if err != nil {
+		fatalError("BREAK_GLASS_DELAY could not be parsed", err)
+	}
+	h.BreakGlass.Window, err = time.ParseDuration(utils.GetEnvWithDefault("BREAK_GLASS_WINDOW", DefaultBreakGlassWindow.String()))
+	if err != nil {
+		fatalError("BREAK_GLASS_WINDOW could not be parsed", err)
+	}
+
+	hook := utils.GetEnvWithDefault("BREAK_GLASS_WEBHOOK", "")
+	h.BreakGlass.Notify = func(event BreakGlassEvent) {
+		notifyBreakGlass(hook, event)
+	}
+
+	glog.Warningf("Break-glass retrieval is ENABLED for %d principal(s)", len(credentials))
+
+	return credentials
+}
+
+// checkBreakGlassOverlap makes sure break-glass principals do not double as normal users or roles
+func checkBreakGlassOverlap(credentials map[string]string, otherKeys ...[]string) error {
+	for _, keys := range otherKeys {
+		for user, password := range toDict(keys) {
+			if _, ok := credentials[user]; ok {
+				return fmt.Errorf("break-glass user %s has another role", user)
+			}
+
+			if password != local_utils.IAMAuthFlag {
+				continue
+			}
+			for pattern, breakGlassPassword := range credentials {
+				if breakGlassPassword == local_utils.IAMAuthFlag && globsOverlap(pattern, user) {
+					return fmt.Errorf("break-glass identity %s overlaps with %s", pattern, user)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// globsOverlap returns true when some value matches both a and b (only * and ? are wildcards)
+func globsOverlap(a, b string) bool {
+	seen := make(map[[2]int]bool)
+
+	var overlap func(i, j int) bool
+	overlap = func(i, j int) bool {
+		if i == len(a) && j == len(b) {
+			return true
+		}
+
+		key := [2]int{i, j}
+		if done, ok := seen[key]; ok {
+			return done
+		}
+		seen[key] = false
+
+		ret := false
+		switch {
+		case i < len(a) && a[i] == '*':
+			// Star matches nothing or the next character of b
+			ret = overlap(i+1, j) || (j < len(b) && overlap(i, j+1))
+		case j < len(b) && b[j] == '*':
+			ret = overlap(i, j+1) || (i < len(a) && overlap(i+1, j))
+		case i < len(a) && j < len(b):
+			ret = (a[i] == '?' || b[j] == '?' || a[i] == b[j]) && overlap(i+1, j+1)
+		}
+
+		seen[key] = ret
+		return ret
+	}
+
+	return overlap(0, 0)
+}
+
+func notifyBreakGlass(hook string, event BreakGlassEvent) {
+	sentry.CaptureMessage(fmt.Sprintf("Break-glass %s: %s (%s) by %s - %s", event.Event, event.Request.PubKey, event.Request.UniqueID, event.Request.Principal, event.Request.Justification))
+
+	if hook == "" {
+		return
+	}
+
+	go func() {
+		b, err := json.Marshal(event)
+		if err != nil {
+			glog.Warningf("Break-glass notification failed: %v", err)
+			return
+		}
+
+		client := &http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Post(hook, "application/json", bytes.NewReader(b))
+		if err != nil {
+			glog.Warningf("Break-glass notification failed: %v", err)
+			sentry.CaptureException(err)
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			glog.Warningf("Break-glass notification failed with status %d", resp.StatusCode)
+		}
+	}()
+}
+
+func breakGlassLog(r *http.Request, message string) {
+	glog.Warningf("[AUDIT LOG] [BREAK GLASS] [%v] %s (%s)", getPrincipal(r), message, r.RemoteAddr)
+}
+
+// BreakGlassRequestHandler - starts the break-glass procedure for a node
+func (h *Handlers) BreakGlassRequestHandler(w http.ResponseWriter, r *http.Request) {
+	var payload breakGlassPayload
+
+	params := mux.Vars(r)
+	pubkey := params["pubkey"]
+
+	uniqueID, err := h.obtainUniqueID(w, r)
+	if err != nil {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&payload)
+	if err != nil {
+		h.badRequest(w, r, CodeJSONInvalid, "json decoding failed", fmt.Sprintf("[BreakGlass] json decoding failed: %v", err))
+		return
+	}
+
+	payload.Justification = strings.TrimSpace(payload.Justification)
+	if len(payload.Justification) < MinJustificationLength {
+		h.badRequest(w, r, CodeJustificationRequired, "justification is required", "[BreakGlass] justification too short")
+		return
+	}
+
+	data, ok := h.lookup(pubkey + uniqueID)
+	if !ok || data.PubKey != pubkey {
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[BreakGlass] Secret %s not found", pubkey), r.Method)
+		notFound(w, r)
+		return
+	}
+
+	h.pruneBreakGlass()
+
+	id, err := newChangeRequestID()
+	if err != nil {
+		internalError(w, r)
+		return
+	}
+
+	now := time.Now()
+	req := &BreakGlassRequest{
+		ID:            id,
+		Principal:     getPrincipal(r),
+		PubKey:        pubkey,
+		UniqueID:      uniqueID,
+		Justification: payload.Justification,
+		RequestedAt:   now,
+		AvailableAt:   now.Add(h.BreakGlass.Delay),
+		ExpiresAt:     now.Add(h.BreakGlass.Delay + h.BreakGlass.Window),
+	}
+
+	h.BreakGlass.Mutex.Lock()
+	h.BreakGlass.Requests[id] = req
+	h.BreakGlass.Mutex.Unlock()
+
+	metrics.BreakGlass(breakGlassLabels{Stage: "requested"}).Inc()
+	breakGlassLog(r, fmt.Sprintf("Requested raw secret %s (%s) id %s available at %v justification: %s", pubkey, uniqueID, id, req.AvailableAt, req.Justification))
+	h.BreakGlass.Notify(BreakGlassEvent{Event: "requested", Request: *req})
+
+	respondJSON(w, r, http.StatusAccepted, req, req)
+}
+
+// BreakGlassRetrieveHandler - returns the original secret once the delay has passed
+func (h *Handlers) BreakGlassRetrieveHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	principal := getPrincipal(r)
+	now := time.Now()
+
+	h.BreakGlass.Mutex.Lock()
+	defer h.BreakGlass.Mutex.Unlock()
+
+	req, ok := h.BreakGlass.Requests[id]
+	if !ok || req.Principal != principal {
+		breakGlassLog(r, fmt.Sprintf("Retrieval of unknown request %s", id))
+		notFound(w, r)
+		return
+	}
+
+	if req.RetrievedAt != nil || now.After(req.ExpiresAt) {
+		breakGlassLog(r, fmt.Sprintf("Retrieval of used or expired request %s", id))
+		delete(h.BreakGlass.Requests, id)
+		respondError(w, r, http.StatusGone, CodeGone, "Request expired")
+		return
+	}
+
+	if now.Before(req.AvailableAt) {
+		tooManyRequests(w, r, req.AvailableAt.Sub(now), "break_glass_delay")
+		return
+	}
+
+	data, ok := h.lookup(req.PubKey + req.UniqueID)
+	if !ok {
+		breakGlassLog(r, fmt.Sprintf("Secret %s (%s) of request %s no longer exists", req.PubKey, req.UniqueID, id))
+		notFound(w, r)
+		return
+	}
+
+	req.RetrievedAt = &now
+
+	metrics.BreakGlass(breakGlassLabels{Stage: "retrieved"}).Inc()
+	breakGlassLog(r, fmt.Sprintf("RETRIEVED RAW SECRET %s (%s) id %s justification: %s", req.PubKey, req.UniqueID, id, req.Justification))
+	h.BreakGlass.Notify(BreakGlassEvent{Event: "retrieved", Request: *req})
+
+	respondJSON(w, r, http.StatusOK, &data, &data)
+}
+
+func (h *Handlers) registerBreakGlass(router *mux.Router, credentials map[string]string) {
+	if credentials == nil {
+		return
+	}
+
+	routes := router.PathPrefix("/breakglass/").Subrouter()
+	routes.Use(authMiddleware(credentials))
+
+	routes.Path("/request/{pubkey}").HandlerFunc(h.BreakGlassRequestHandler).Methods(http.MethodPost)
+	routes.Path("/request/{uniqueId}/{pubkey}").HandlerFunc(h.BreakGlassRequestHandler).Methods(http.MethodPost)
+	routes.Path("/retrieve/{id}").HandlerFunc(h.BreakGlassRetrieveHandler).Methods(http.MethodPost, http.MethodGet)
+}
+
+// pruneBreakGlass removes used and expired requests
+func (h *Handlers) pruneBreakGlass() {
+	h.BreakGlass.Mutex.Lock()
+	defer h.BreakGlass.Mutex.Unlock()
+
+	now := time.Now()
+	for k, v := range h.BreakGlass.Requests {
+		if now.After(v.ExpiresAt) {
+			delete(h.BreakGlass.Requests, k)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	entities "github.com/bolt-observer/go_common/entities"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreakGlassDisabledByDefault(t *testing.T) {
+	t.Setenv("BREAK_GLASS_ENABLED", "")
+	t.Setenv("BREAK_GLASS_API_KEY", "admin|pass")
+
+	h := MakeNewDummyHandlers()
+	assert.Nil(t, h.configureBreakGlass([]string{"admin|pass"}))
+}
+
+func TestBreakGlass(t *testing.T) {
+	prometheusInit()
+
+	pubKey := "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7"
+	mac := "0201036c6e640224030a10b493608461fb6e64810053fa31ef27991201301a0c0a04696e666f120472656164000216697061646472203139322e3136382e3139322e3136380000062072ea006233da839ce6e9f4721331a12041b228d36c0fdad552680f615766d2f4"
+
+	h := MakeNewDummyHandlers()
+	h.toLookup(entities.Data{PubKey: pubKey, MacaroonHex: mac, Endpoint: "127.0.0.1:10009"}, "")
+
+	events := make([]string, 0)
+	h.BreakGlass.Notify = func(event BreakGlassEvent) {
+		events = append(events, event.Event)
+	}
+
+	request := func(justification string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("https://localhost/breakglass/request/%s", pubKey), strings.NewReader(fmt.Sprintf(`{"justification": "%s"}`, justification)))
+		r = mux.SetURLVars(r, map[string]string{"pubkey": pubKey})
+		r = withPrincipal(r, "admin")
+		w := httptest.NewRecorder()
+		h.BreakGlassRequestHandler(w, r)
+		return w
+	}
+
+	retrieve := func(principal, id string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("https://localhost/breakglass/retrieve/%s", id), nil)
+		r = mux.SetURLVars(r, map[string]string{"id": id})
+		r = withPrincipal(r, principal)
+		w := httptest.NewRecorder()
+		h.BreakGlassRetrieveHandler(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusBadRequest, request("").Result().StatusCode)
+	assert.Equal(t, http.StatusBadRequest, request("because").Result().StatusCode)
+
+	w := request("node disk died, restoring from backup INC-1234")
+	require.Equal(t, http.StatusAccepted, w.Result().StatusCode)
+
+	var req BreakGlassRequest
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&req))
+	assert.Equal(t, "admin", req.Principal)
+	assert.Equal(t, []string{"requested"}, events)
+
+	// Delay has not passed yet
+	w = retrieve("admin", req.ID)
+	assert.Equal(t, http.StatusTooManyRequests, w.Result().StatusCode)
+	assert.NotEmpty(t, w.Result().Header.Get("Retry-After"))
+
+	h.BreakGlass.Requests[req.ID].AvailableAt = time.Now().Add(-time.Second)
+
+	// Only requestor can retrieve
+	assert.Equal(t, http.StatusNotFound, retrieve("other", req.ID).Result().StatusCode)
+
+	w = retrieve("admin", req.ID)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var data entities.Data
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&data))
+	assert.Equal(t, mac, data.MacaroonHex)
+	assert.Equal(t, []string{"requested", "retrieved"}, events)
+
+	// Single use
+	assert.Equal(t, http.StatusGone, retrieve("admin", req.ID).Result().StatusCode)
+}
+
+func TestCheckBreakGlassOverlap(t *testing.T) {
+	breakGlass := toDict([]string{"admin|pass", "arn:aws:sts::123456789012:assumed-role/recovery/*|$iam"})
+
+	assert.NoError(t, checkBreakGlassOverlap(breakGlass, []string{"reader|pass", "arn:aws:sts::123456789012:assumed-role/reader/*|$iam"}))
+	assert.Error(t, checkBreakGlassOverlap(breakGlass, []string{"reader|pass"}, []string{"admin|other"}))
+	assert.Error(t, checkBreakGlassOverlap(breakGlass, []string{"arn:aws:sts::123456789012:assumed-role/*|$iam"}))
+	assert.Error(t, checkBreakGlassOverlap(breakGlass, []string{"arn:aws:sts::*:assumed-role/rec?very/session|$iam"}))
+	assert.NoError(t, checkBreakGlassOverlap(breakGlass, []string{"arn:aws:sts::210987654321:assumed-role/*|$iam"}))
+}
+
+func TestGlobsOverlap(t *testing.T) {
+	assert.True(t, globsOverlap("abc", "abc"))
+	assert.False(t, globsOverlap("abc", "abd"))
+	assert.True(t, globsOverlap("a*", "*c"))
+	assert.True(t, globsOverlap("a?c", "*b*"))
+	assert.False(t, globsOverlap("a*b", "c*"))
+	assert.True(t, globsOverlap("*", ""))
+	assert.False(t, globsOverlap("?", ""))
+	assert.True(t, globsOverlap("a*x*", "*y*b"))
+}
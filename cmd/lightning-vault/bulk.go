@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	entities "github.com/bolt-observer/go_common/entities"
+	utils "github.com/bolt-observer/go_common/utils"
+	local_utils "github.com/bolt-observer/lightning-vault/utils"
+)
+
+const (
+	// MaxBulkItems is the maximal number of records in one bulk request
+	MaxBulkItems = 1000
+	// MaxBulkBodySize is the maximal size of a bulk request body
+	MaxBulkBodySize = 32 << 20
+	// DefaultBulkWorkers is the default number of records processed concurrently
+	DefaultBulkWorkers = 8
+	// ResultFailed marks a failed item of a bulk request
+	ResultFailed = "failed"
+)
+
+// BulkPutItem is one record of a bulk put
+type BulkPutItem struct {
+	entities.Data
+	UniqueID string `json:"unique_id,omitempty"`
+}
+
+// BulkItemResult is the outcome for one record of a bulk request
+type BulkItemResult struct {
+	Index int `json:"index"`
+	OperationResult
+	Error *APIError `json:"error,omitempty"`
+}
+
+// BulkResult is the result of a bulk request
+type BulkResult struct {
+	Succeeded int              `json:"succeeded"`
+	Failed    int              `json:"failed"`
+	Items     []BulkItemResult `json:"items"`
+}
+
+// itemRecorder keeps the error response a per-item handler step writes
+type itemRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (i *itemRecorder) Header() http.Header {
+	if i.header == nil {
+		i.header = make(http.Header)
+	}
+	return i.header
+}
+
+func (i *itemRecorder) Write(b []byte) (int, error) { return i.body.Write(b) }
+
+func (i *itemRecorder) WriteHeader(statusCode int) { i.status = statusCode }
+
+// apiError returns the recorded error (or fallback when nothing usable was written)
+func (i *itemRecorder) apiError(r *http.Request, fallback APIError) *APIError {
+	if isV1(r) {
+		var response APIResponse
+		if err := json.Unmarshal(i.body.Bytes(), &response); err == nil && response.Error != nil {
+			return response.Error
+		}
+		return &fallback
+	}
+
+	if message := strings.TrimSpace(strings.TrimPrefix(i.body.String(), "Bad request - ")); message != "" {
+		fallback.Message = message
+	}
+	return &fallback
+}
+
+func bulkWorkers() int {
+	workers, err := strconv.Atoi(utils.GetEnvWithDefault("BULK_WORKERS", strconv.Itoa(DefaultBulkWorkers)))
+	if err != nil || workers < 1 {
+		return DefaultBulkWorkers
+	}
+
+	return workers
+}
+
+// decodeBulkPut reads either a JSON array or a stream of JSON objects (NDJSON)
+func decodeBulkPut(body io.Reader) ([]BulkPutItem, error) {
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	b = bytes.TrimSpace(b)
+
+	items := make([]BulkPutItem, 0)
+	decoder := json.NewDecoder(bytes.NewReader(b))
+
+	if bytes.HasPrefix(b, []byte("[")) {
+		err = decoder.Decode(&items)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for decoder.More() {
+			var item BulkPutItem
+			err = decoder.Decode(&item)
+			if err != nil {
+				return nil, fmt.Errorf("record %d: %v", len(items), err)
+			}
+			items = append(items, item)
+		}
+	}
+
+	if len(items) == 0 {
+		return nil, fmt.Errorf("no records")
+	}
+	if len(items) > MaxBulkItems {
+		return nil, fmt.Errorf("more than %d records", MaxBulkItems)
+	}
+
+	return items, nil
+}
+
+// BulkPutHandler - put many macaroons/runes at once
+func (h *Handlers) BulkPutHandler(w http.ResponseWriter, r *http.Request) {
+	items, err := decodeBulkPut(http.MaxBytesReader(w, r.Body, MaxBulkBodySize))
+	if err != nil {
+		h.badRequest(w, r, CodeJSONInvalid, "json decoding failed", fmt.Sprintf("[BulkPut] json decoding failed: %v", err))
+		return
+	}
+
+	auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Bulk put of %d records", len(items)), r.Method)
+
+	results := make([]BulkItemResult, len(items))
+
+	// The same record twice would race against itself
+	seen := make(map[string]int)
+	for i, item := range items {
+		results[i] = BulkItemResult{Index: i, OperationResult: OperationResult{PubKey: item.PubKey, UniqueID: item.UniqueID}}
+
+		key := item.PubKey + item.UniqueID
+		if first, ok := seen[key]; ok {
+			results[i].Error = &APIError{Code: CodeConflict, Message: fmt.Sprintf("duplicate of record %d", first)}
+			continue
+		}
+		seen[key] = i
+	}
+
+	work := make(chan int)
+	var wg sync.WaitGroup
+
+	for n := 0; n < bulkWorkers(); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				h.bulkPutOne(r, &items[i], &results[i])
+			}
+		}()
+	}
+
+	for i := range items {
+		if results[i].Error == nil {
+			work <- i
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	result := BulkResult{Items: results}
+	for i := range results {
+		if results[i].Error != nil {
+			results[i].Result = ResultFailed
+			result.Failed++
+		} else {
+			result.Succeeded++
+		}
+	}
+
+	status := http.StatusOK
+	if result.Failed > 0 {
+		status = http.StatusMultiStatus
+	}
+
+	respondJSON(w, r, status, result, result)
+}
+
+// bulkPutOne validates, verifies and stores one record; nothing is changed unless the record is written to the secrets manager
+func (h *Handlers) bulkPutOne(r *http.Request, item *BulkPutItem, result *BulkItemResult) {
+	data := &item.Data
+	uniqueID := item.UniqueID
+
+	if uniqueID != "" && !utils.AlphaNumeric.MatchString(uniqueID) {
+		result.Error = &APIError{Code: CodeUniqueIDInvalid, Message: "uniqueId parameter is invalid"}
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Bad request - [BulkPut] uniqueId parameter is invalid - %v", uniqueID), r.Method)
+		return
+	}
+
+	base, e := h.validatePut(r, data, uniqueID)
+	if e != nil {
+		result.Error = &APIError{Code: e.Code, Message: e.Reason}
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Bad request - [BulkPut] %s", e.LogReason), r.Method)
+		return
+	}
+
+	recorder := &itemRecorder{}
+	verified, ok := h.verifyPut(recorder, r, data, uniqueID)
+	if !ok {
+		result.Error = recorder.apiError(r, APIError{Code: CodeVerifyFailed, Message: "invalid credentials - check failed"})
+		return
+	}
+
+	if approvalRequired {
+		c, err := h.createChangeRequest(r, OperationPut, data, uniqueID, verified)
+		if err != nil {
+			failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Could not create change request %v", err), r.Method)
+			result.Error = &APIError{Code: CodeInternal, Message: "Internal error"}
+			return
+		}
+
+		result.Result = ResultPendingApproval
+		result.ChangeRequestID = c.ID
+		return
+	}
+
+	status, err := h.storeUnchanged(context.Background(), data, uniqueID, base)
+	if errors.Is(err, errRecordChanged) {
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[BulkPut] %s (%s) changed while it was verified", data.PubKey, uniqueID), r.Method)
+		result.Error = &APIError{Code: CodeConflict, Message: "Record changed while the request was processed, retry"}
+		return
+	}
+	if err != nil {
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("AWS add secret failed with error %v", err), r.Method)
+		result.Error = &APIError{Code: CodeInternal, Message: "Internal error"}
+		return
+	}
+
+	if status == local_utils.Updated {
+		auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Put (update) %v", data.PubKey), r.Method)
+		result.Result = ResultUpdated
+	} else {
+		auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Put (new) %v", data.PubKey), r.Method)
+		result.Result = ResultCreated
+	}
+}
+
+// BulkGetNode identifies one record of a bulk get (pubkey can also be an alias)
+type BulkGetNode struct {
+	PubKey   string `json:"pubkey"`
+	UniqueID string `json:"unique_id,omitempty"`
+}
+
+// BulkGetFilter selects records of a bulk get by tag and/or uniqueId
+type BulkGetFilter struct {
+	Tag      string `json:"tag,omitempty"`
+	UniqueID string `json:"unique_id,omitempty"`
+}
+
+// BulkGetRequest is the payload of a bulk get, either nodes or filter must be given
+type BulkGetRequest struct {
+	Nodes  []BulkGetNode  `json:"nodes,omitempty"`
+	Filter *BulkGetFilter `json:"filter,omitempty"`
+}
+
+// BulkGetItem is the outcome for one record of a bulk get
+type BulkGetItem struct {
+	BulkGetNode
+	Credential *GetResult `json:"credential,omitempty"`
+	Error      *APIError  `json:"error,omitempty"`
+}
+
+// BulkGetResult is the result of a bulk get
+type BulkGetResult struct {
+	Found    int           `json:"found"`
+	NotFound int           `json:"not_found"`
+	Items    []BulkGetItem `json:"items"`
+}
+
+// filterNodes returns all records matching the filter
+func (h *Handlers) filterNodes(filter *BulkGetFilter) []BulkGetNode {
+	ret := make([]BulkGetNode, 0)
+	for node := range h.allNodes() {
+		if filter.UniqueID != "" && node.UniqueID != filter.UniqueID {
+			continue
+		}
+		if filter.Tag != "" && !containsTag(splitTags(node.Data.Tags), filter.Tag) {
+			continue
+		}
+		ret = append(ret, BulkGetNode{PubKey: node.Data.PubKey, UniqueID: node.UniqueID})
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].PubKey+ret[i].UniqueID < ret[j].PubKey+ret[j].UniqueID
+	})
+
+	return ret
+}
+
+// uniqueNodes returns nodes without repetitions (keeping the first occurrence)
+func uniqueNodes(nodes []BulkGetNode) []BulkGetNode {
+	seen := make(map[BulkGetNode]bool)
+	ret := make([]BulkGetNode, 0, len(nodes))
+	for _, node := range nodes {
+		if seen[node] {
+			continue
+		}
+		seen[node] = true
+		ret = append(ret, node)
+	}
+
+	return ret
+}
+
+// BulkGetHandler - gets constrained macaroons/runes for many nodes at once
+func (h *Handlers) BulkGetHandler(w http.ResponseWriter, r *http.Request) {
+	var payload BulkGetRequest
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxBulkBodySize))
+	err := decoder.Decode(&payload)
+	if err != nil {
+		h.badRequest(w, r, CodeJSONInvalid, "json decoding failed", fmt.Sprintf("[BulkGet] json decoding failed: %v", err))
+		return
+	}
+
+	nodes := payload.Nodes
+	if payload.Filter != nil {
+		if payload.Filter.Tag == "" && payload.Filter.UniqueID == "" {
+			h.badRequest(w, r, CodeBadRequest, "empty filter", "[BulkGet] empty filter")
+			return
+		}
+		nodes = append(nodes, h.filterNodes(payload.Filter)...)
+	}
+	nodes = uniqueNodes(nodes)
+
+	if len(nodes) == 0 {
+		h.badRequest(w, r, CodeBadRequest, "no nodes requested", "[BulkGet] no nodes requested")
+		return
+	}
+	if len(nodes) > MaxBulkItems {
+		h.badRequest(w, r, CodeBadRequest, fmt.Sprintf("more than %d nodes requested", MaxBulkItems), fmt.Sprintf("[BulkGet] %d nodes requested", len(nodes)))
+		return
+	}
+
+	// Every node counts as a request for GET_RATE_LIMIT, rateLimitMiddleware already took one
+	if getLimiter.Limit > 0 && len(nodes) > getLimiter.Burst {
+		h.badRequest(w, r, CodeBadRequest, fmt.Sprintf("more than %d nodes requested", getLimiter.Burst), fmt.Sprintf("[BulkGet] %d nodes requested, burst is %d", len(nodes), getLimiter.Burst))
+		return
+	}
+	if ok, delay := getLimiter.ReserveN(getPrincipal(r), len(nodes)-1); !ok {
+		tooManyRequests(w, r, delay, "rate_limit")
+		return
+	}
+
+	duration := readDuration(r)
+	result := BulkGetResult{Items: make([]BulkGetItem, 0, len(nodes))}
+
+	for _, node := range nodes {
+		item := BulkGetItem{BulkGetNode: node}
+
+		data, ok := h.resolve(r, node.PubKey, node.UniqueID)
+		if !ok || !utils.AlphaNumeric.MatchString(node.UniqueID) {
+			failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[BulkGet] Secret %s (%s) not found", node.PubKey, node.UniqueID), r.Method)
+			item.Error = &APIError{Code: CodeNotFound, Message: "Not found"}
+			result.NotFound++
+			result.Items = append(result.Items, item)
+			continue
+		}
+
+		constrained, info := local_utils.GetConstrainedWithInfo(&data, duration)
+		info.IssuanceID = randomID()
+
+		auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Get %s (%s) valid for %v issuance %s (bulk)", data.PubKey, node.UniqueID, duration, info.IssuanceID), r.Method)
+
+		item.Credential = &GetResult{Data: constrained, CredentialInfo: info, UniqueID: node.UniqueID}
+		result.Found++
+		result.Items = append(result.Items, item)
+	}
+
+	respondJSON(w, r, http.StatusOK, result, result)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	entities "github.com/bolt-observer/go_common/entities"
+	local_utils "github.com/bolt-observer/lightning-vault/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testMacaroon    = "0201036c6e640224030a10b493608461fb6e64810053fa31ef27991201301a0c0a04696e666f120472656164000216697061646472203139322e3136382e3139322e3136380000062072ea006233da839ce6e9f4721331a12041b228d36c0fdad552680f615766d2f4"
+	testCertificate = "LS0tLS1CRUdJTiBDRVJUSUZJQ0FURS0tLS0tCk1JSUNKakNDQWN5Z0F3SUJBZ0lRUmU4QzhCcURubEF3b0VxRjdMRTVGREFLQmdncWhrak9QUVFEQWpBeE1SOHcKSFFZRFZRUUtFeFpzYm1RZ1lYVjBiMmRsYm1WeVlYUmxaQ0JqWlhKME1RNHdEQVlEVlFRREV3VmhiR2xqWlRBZQpGdzB5TXpBeE1ESXhOVE0xTXpsYUZ3MHlOREF5TWpjeE5UTTFNemxhTURFeEh6QWRCZ05WQkFvVEZteHVaQ0JoCmRYUnZaMlZ1WlhKaGRHVmtJR05sY25ReERqQU1CZ05WQkFNVEJXRnNhV05sTUZrd0V3WUhLb1pJemowQ0FRWUkKS29aSXpqMERBUWNEUWdBRXlKaHRYWk1NT0NQYzYxWmlISmVyKzdHUm9HalFzcWtNcjdvQVVjNnZsZC9JNDl2SwpHR01mRjhMcDhTSm1jNlJVOHQxN3FEZFhyUmZMbTdLSjB0eDBkcU9CeFRDQndqQU9CZ05WSFE4QkFmOEVCQU1DCkFxUXdFd1lEVlIwbEJBd3dDZ1lJS3dZQkJRVUhBd0V3RHdZRFZSMFRBUUgvQkFVd0F3RUIvekFkQmdOVkhRNEUKRmdRVU5BUW5BYVBNOStrZEpxMXdud2FtbldpY1d1SXdhd1lEVlIwUkJHUXdZb0lGWVd4cFkyV0NDV3h2WTJGcwphRzl6ZElJRllXeHBZMldDRG5CdmJHRnlMVzQyTFdGc2FXTmxnZ1IxYm1sNGdncDFibWw0Y0dGamEyVjBnZ2RpCmRXWmpiMjV1aHdSL0FBQUJoeEFBQUFBQUFBQUFBQUFBQUFBQUFBQUJod1NzR0FBQ01Bb0dDQ3FHU000OUJBTUMKQTBnQU1FVUNJUUQ2dElDMVdTWFRWNkpuSzVlN3FkdDRBVHp2Q0ZHUldPTmp2T29tUUdScXB3SWdiR1ZJWFVPbgpHamlUdTZ5MXVMT1pRS0VPTnB1MXZkYUNKejVpanNRdlVndz0KLS0tLS1FTkQgQ0VSVElGSUNBVEUtLS0tLQo="
+)
+
+func testRecord(pubkey, uniqueID string) string {
+	item := BulkPutItem{
+		Data: entities.Data{
+			PubKey:            pubkey,
+			MacaroonHex:       testMacaroon,
+			CertificateBase64: testCertificate,
+			Endpoint:          "192.168.192.168:10009",
+		},
+		UniqueID: uniqueID,
+	}
+
+	b, _ := json.Marshal(&item)
+	return string(b)
+}
+
+func TestDecodeBulkPut(t *testing.T) {
+	pubkey := "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7"
+
+	items, err := decodeBulkPut(strings.NewReader(fmt.Sprintf(" [%s, %s]\n", testRecord(pubkey, ""), testRecord(pubkey, "id1"))))
+	require.NoError(t, err)
+	assert.Len(t, items, 2)
+	assert.Equal(t, "id1", items[1].UniqueID)
+
+	items, err = decodeBulkPut(strings.NewReader(fmt.Sprintf("%s\n%s\n", testRecord(pubkey, ""), testRecord(pubkey, "id1"))))
+	require.NoError(t, err)
+	assert.Len(t, items, 2)
+	assert.Equal(t, pubkey, items[0].PubKey)
+
+	_, err = decodeBulkPut(strings.NewReader(""))
+	assert.Error(t, err)
+
+	_, err = decodeBulkPut(strings.NewReader("[]"))
+	assert.Error(t, err)
+
+	_, err = decodeBulkPut(strings.NewReader(testRecord(pubkey, "") + "\n{garbage"))
+	assert.Error(t, err)
+
+	_, err = decodeBulkPut(strings.NewReader(strings.Repeat(testRecord(pubkey, "")+"\n", MaxBulkItems+1)))
+	assert.Error(t, err)
+}
+
+func TestBulkPutHandler(t *testing.T) {
+	prometheusInit()
+
+	pubkey := "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7"
+
+	h := MakeNewDummyHandlers()
+	h.VerifyCall = func(w http.ResponseWriter, r *http.Request, data *entities.Data, pubkey, uniqueID string) bool {
+		if uniqueID == "unverified" {
+			h.badRequest(w, r, CodeVerifyFailed, "endpoint is elsewhere", "test")
+			return false
+		}
+		return true
+	}
+
+	mgr := h.SecretsManager.(*local_utils.TestSecretsManager)
+	mgr.InsertOrUpdateSecretFn = func(ctx context.Context, name, value string, metadata local_utils.Metadata) (string, local_utils.Change, error) {
+		if strings.Contains(name, "broken") {
+			return "", local_utils.Undefined, fmt.Errorf("backend failure")
+		}
+		return "", local_utils.Inserted, nil
+	}
+
+	body := strings.Join([]string{
+		testRecord(pubkey, ""),
+		testRecord(pubkey, "id1"),
+		testRecord(pubkey, ""),
+		testRecord("invalid", ""),
+		testRecord(pubkey, "broken"),
+		testRecord(pubkey, "unverified"),
+		testRecord(pubkey, "not valid!"),
+	}, "\n")
+
+	r := httptest.NewRequest(http.MethodPost, "https://localhost/put/bulk", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.BulkPutHandler(w, r)
+
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+
+	var result BulkResult
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, 2, result.Succeeded)
+	assert.Equal(t, 5, result.Failed)
+	require.Len(t, result.Items, 7)
+
+	assert.Equal(t, ResultCreated, result.Items[0].Result)
+	assert.Equal(t, ResultCreated, result.Items[1].Result)
+	assert.Equal(t, CodeConflict, result.Items[2].Error.Code)
+	assert.Equal(t, CodePubkeyInvalid, result.Items[3].Error.Code)
+	assert.Equal(t, CodeInternal, result.Items[4].Error.Code)
+	assert.Equal(t, CodeVerifyFailed, result.Items[5].Error.Code)
+	assert.Equal(t, "endpoint is elsewhere", result.Items[5].Error.Message)
+	assert.Equal(t, CodeUniqueIDInvalid, result.Items[6].Error.Code)
+	for _, item := range result.Items[2:] {
+		assert.Equal(t, ResultFailed, item.Result)
+	}
+
+	// Only records that were written to secrets manager are in the lookup table
+	_, ok := h.lookup(pubkey)
+	assert.True(t, ok)
+	_, ok = h.lookup(pubkey + "id1")
+	assert.True(t, ok)
+	_, ok = h.lookup(pubkey + "broken")
+	assert.False(t, ok)
+	_, ok = h.lookup(pubkey + "unverified")
+	assert.False(t, ok)
+
+	// JSON array in the versioned API, everything succeeds
+	w = call(v1Router(h), http.MethodPost, "/v1/put/bulk", "writer", "["+testRecord(pubkey, "id2")+"]")
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	result = BulkResult{}
+	decodeEnvelope(t, w, &result)
+	assert.Equal(t, 1, result.Succeeded)
+
+	w = call(v1Router(h), http.MethodPost, "/v1/put/bulk", "writer", "["+testRecord(pubkey, "unverified")+"]")
+
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+	result = BulkResult{}
+	decodeEnvelope(t, w, &result)
+	require.Len(t, result.Items, 1)
+	assert.Equal(t, &APIError{Code: CodeVerifyFailed, Message: "endpoint is elsewhere"}, result.Items[0].Error)
+
+	r = httptest.NewRequest(http.MethodPost, "https://localhost/put/bulk", strings.NewReader("nonsense"))
+	w = httptest.NewRecorder()
+	h.BulkPutHandler(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// More records than workers are verified too
+	records := make([]string, 0)
+	for i := 0; i <= DefaultBulkWorkers; i++ {
+		records = append(records, testRecord(pubkey, fmt.Sprintf("many%d", i)))
+	}
+	body = strings.Join(records, "\n")
+
+	r = httptest.NewRequest(http.MethodPost, "https://localhost/put/bulk", strings.NewReader(body))
+	w = httptest.NewRecorder()
+	h.BulkPutHandler(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	result = BulkResult{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, DefaultBulkWorkers+1, result.Succeeded)
+}
+
+func TestBulkGetHandler(t *testing.T) {
+	prometheusInit()
+	freshAuthThrottle(t)
+
+	pubkey := "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7"
+	other := "02aa0a3b1d4d46d7fe7ab57b07f8ac6eac11c8d1dbaaf2d6c4f51bbd0dc8ae2c6e"
+
+	h := MakeNewDummyHandlers()
+
+	for _, item := range []BulkPutItem{
+		{Data: entities.Data{PubKey: pubkey, MacaroonHex: testMacaroon, Tags: "alice,prod"}},
+		{Data: entities.Data{PubKey: pubkey, MacaroonHex: testMacaroon}, UniqueID: "secret"},
+		{Data: entities.Data{PubKey: other, MacaroonHex: testMacaroon, Tags: "prod"}, UniqueID: "id1"},
+	} {
+		h.toLookup(item.Data, item.UniqueID)
+	}
+
+	// Repeated nodes are returned once
+	body := fmt.Sprintf(`{"nodes": [{"pubkey": "%s"}, {"pubkey": "alice"}, {"pubkey": "%s", "unique_id": "secret"}, {"pubkey": "%s"}, {"pubkey": "%s"}]}`, pubkey, pubkey, other, pubkey)
+	w := call(v1Router(h), http.MethodPost, "/v1/get/bulk", "reader", body)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var result BulkGetResult
+	decodeEnvelope(t, w, &result)
+	assert.Equal(t, 3, result.Found)
+	assert.Equal(t, 1, result.NotFound)
+	require.Len(t, result.Items, 4)
+
+	require.NotNil(t, result.Items[0].Credential)
+	assert.Equal(t, pubkey, result.Items[0].Credential.PubKey)
+	assert.NotEqual(t, testMacaroon, result.Items[0].Credential.MacaroonHex)
+	assert.NotEmpty(t, result.Items[0].Credential.IssuanceID)
+	require.NotNil(t, result.Items[1].Credential)
+	assert.Equal(t, "alice", result.Items[1].PubKey)
+	assert.NotEqual(t, result.Items[0].Credential.IssuanceID, result.Items[1].Credential.IssuanceID)
+	require.NotNil(t, result.Items[2].Credential)
+	assert.Equal(t, "secret", result.Items[2].Credential.UniqueID)
+	assert.Equal(t, CodeNotFound, result.Items[3].Error.Code)
+
+	// Filter matches records and not aliases
+	w = call(v1Router(h), http.MethodPost, "/v1/get/bulk", "reader", `{"filter": {"tag": "prod"}}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	result = BulkGetResult{}
+	decodeEnvelope(t, w, &result)
+	assert.Equal(t, 2, result.Found)
+	require.Len(t, result.Items, 2)
+	assert.Equal(t, other, result.Items[0].PubKey)
+	assert.Equal(t, "id1", result.Items[0].UniqueID)
+
+	// Filter and nodes can overlap
+	w = call(v1Router(h), http.MethodPost, "/v1/get/bulk", "reader", fmt.Sprintf(`{"nodes": [{"pubkey": "%s", "unique_id": "secret"}], "filter": {"unique_id": "secret"}}`, pubkey))
+	result = BulkGetResult{}
+	decodeEnvelope(t, w, &result)
+	assert.Equal(t, 1, result.Found)
+	assert.Len(t, result.Items, 1)
+
+	for _, body := range []string{`{}`, `{"filter": {}}`, `nonsense`} {
+		w = call(v1Router(h), http.MethodPost, "/v1/get/bulk", "reader", body)
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+
+	// Writers can not read
+	w = call(v1Router(h), http.MethodPost, "/v1/get/bulk", "writer", body)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Every node counts for GET_RATE_LIMIT
+	old := getLimiter
+	getLimiter = NewPrincipalLimiter(0.001, 3)
+	t.Cleanup(func() { getLimiter = old })
+
+	three := fmt.Sprintf(`{"nodes": [{"pubkey": "%s"}, {"pubkey": "alice"}, {"pubkey": "%s", "unique_id": "secret"}]}`, pubkey, pubkey)
+	four := fmt.Sprintf(`{"nodes": [{"pubkey": "%s"}, {"pubkey": "alice"}, {"pubkey": "%s", "unique_id": "secret"}, {"pubkey": "%s"}]}`, pubkey, pubkey, other)
+
+	w = call(v1Router(h), http.MethodPost, "/v1/get/bulk", "reader", four)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = call(v1Router(h), http.MethodPost, "/v1/get/bulk", "reader", three)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, "the rejected request took a token")
+
+	getLimiter = NewPrincipalLimiter(0.001, 3)
+	w = call(v1Router(h), http.MethodPost, "/v1/get/bulk", "reader", three)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = call(v1Router(h), http.MethodGet, "/v1/get/"+pubkey, "reader", "")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	utils "github.com/bolt-observer/go_common/utils"
+	local_utils "github.com/bolt-observer/lightning-vault/utils"
+	sentry "github.com/getsentry/sentry-go"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultCertCheckInterval is how often stored certificates are checked
+const DefaultCertCheckInterval = time.Hour
+
+// DefaultCertExpiryWindow is how soon a certificate has to expire to be listed by /admin/certificates
+const DefaultCertExpiryWindow = 30 * 24 * time.Hour
+
+var (
+	certCheckInterval = DefaultCertCheckInterval
+	certExpiryWindow  = DefaultCertExpiryWindow
+	// certAlertThresholds raise a Sentry event once a certificate expires sooner (longest first, none by default)
+	certAlertThresholds []time.Duration
+)
+
+var errNoCertificate = errors.New("no certificate found")
+
+// CertificateExpiry is when the stored certificate of a record expires
+type CertificateExpiry struct {
+	PubKey      string     `json:"pubkey"`
+	UniqueID    string     `json:"unique_id,omitempty"`
+	NotAfter    *time.Time `json:"not_after,omitempty"`
+	SecondsLeft int64      `json:"seconds_left"`
+	Expired     bool       `json:"expired"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// CertificatesResult is the result of the admin certificates call
+type CertificatesResult struct {
+	Within       string              `json:"within"`
+	Certificates []CertificateExpiry `json:"certificates"`
+}
+
+// certAlert remembers the shortest threshold already alerted for a certificate
+type certAlert struct {
+	NotAfter  time.Time
+	Threshold time.Duration
+}
+
+// CertAlerts keeps track of raised certificate expiry alerts
+type CertAlerts struct {
+	Mutex sync.Mutex
+	Sent  map[string]certAlert
+	// Series are the labels of exported expiry metrics by pubkey + uniqueID
+	Series map[string]prometheus.Labels
+}
+
+// NewCertAlerts - creates new CertAlerts
+func NewCertAlerts() *CertAlerts {
+	return &CertAlerts{Sent: make(map[string]certAlert), Series: make(map[string]prometheus.Labels)}
+}
+
+func configureCertMonitoring() {
+	interval, err := time.ParseDuration(utils.GetEnvWithDefault("CERT_CHECK_INTERVAL", DefaultCertCheckInterval.String()))
+	if err != nil || interval <= 0 {
+		fatalError("CERT_CHECK_INTERVAL could not be parsed", err)
+	}
+	certCheckInterval = interval
+
+	window, err := time.ParseDuration(utils.GetEnvWithDefault("CERT_EXPIRY_WINDOW", DefaultCertExpiryWindow.String()))
+	if err != nil {
+		fatalError("CERT_EXPIRY_WINDOW could not be parsed", err)
+	}
+	certExpiryWindow = window
+
+	thresholds, err := parseThresholds(utils.GetEnvWithDefault("CERT_EXPIRY_ALERTS", ""))
+	if err != nil {
+		fatalError("CERT_EXPIRY_ALERTS could not be parsed", err)
+	}
+	certAlertThresholds = thresholds
+}
+
+// parseThresholds parses a comma separated list of durations (sorted longest first)
+func parseThresholds(value string) ([]time.Duration, error) {
+	ret := make([]time.Duration, 0)
+	for _, one := range strings.Split(value, local_utils.Delimiter) {
+		one = strings.TrimSpace(one)
+		if one == "" {
+			continue
+		}
+
+		d, err := time.ParseDuration(one)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, d)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i] > ret[j]
+	})
+
+	return ret, nil
+}
+
+// certificateNotAfter returns when the certificate (base64 of PEM or DER) expires
+func certificateNotAfter(certificateBase64 string) (time.Time, error) {
+	raw, err := utils.SafeBase64Decode(certificateBase64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	der := raw
+	if block, _ := pem.Decode(raw); block != nil {
+		der = block.Bytes
+	}
+	if len(der) == 0 {
+		return time.Time{}, errNoCertificate
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return cert.NotAfter, nil
+}
+
+// certificateExpiries returns expiries of all stored certificates relative to now (sorted by expiry, unparsable ones last)
+func (h *Handlers) certificateExpiries(now time.Time) []CertificateExpiry {
+	ret := make([]CertificateExpiry, 0)
+	for node := range h.allNodes() {
+		if node.Data.CertificateBase64 == "" {
+			continue
+		}
+
+		expiry := CertificateExpiry{PubKey: node.Data.PubKey, UniqueID: node.UniqueID}
+		notAfter, err := certificateNotAfter(node.Data.CertificateBase64)
+		if err != nil {
+			expiry.Error = fmt.Sprintf("invalid certificate: %v", err)
+		} else {
+			expiry.NotAfter = &notAfter
+			expiry.SecondsLeft = int64(notAfter.Sub(now) / time.Second)
+			expiry.Expired = !now.Before(notAfter)
+		}
+
+		ret = append(ret, expiry)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if (ret[i].NotAfter == nil) != (ret[j].NotAfter == nil) {
+			return ret[i].NotAfter != nil
+		}
+		if ret[i].SecondsLeft != ret[j].SecondsLeft {
+			return ret[i].SecondsLeft < ret[j].SecondsLeft
+		}
+		return ret[i].PubKey+ret[i].UniqueID < ret[j].PubKey+ret[j].UniqueID
+	})
+
+	return ret
+}
+
+// checkCertificates updates the expiry metric and raises alerts for certificates crossing a threshold
+func (h *Handlers) checkCertificates(now time.Time) []CertificateExpiry {
+	expiries := h.certificateExpiries(now)
+
+	h.CertAlerts.Mutex.Lock()
+	defer h.CertAlerts.Mutex.Unlock()
+
+	seen := make(map[string]struct{}, len(expiries))
+	for _, expiry := range expiries {
+		if expiry.NotAfter == nil {
+			glog.Warningf("Certificate of %s (%s) cannot be checked: %s", expiry.PubKey, expiry.UniqueID, expiry.Error)
+			continue
+		}
+
+		key := expiry.PubKey + expiry.UniqueID
+		labels := nodeLabels(expiry.PubKey, expiry.UniqueID)
+		certExpiry.With(labels).Set(float64(expiry.SecondsLeft))
+		h.CertAlerts.Series[key] = labels
+
+		seen[key] = struct{}{}
+		h.alertCertificate(key, expiry, now)
+	}
+
+	for key := range h.CertAlerts.Sent {
+		if _, ok := seen[key]; !ok {
+			delete(h.CertAlerts.Sent, key)
+		}
+	}
+
+	// Records that were deleted (or whose certificate cannot be checked anymore) disappear from the metric
+	for key, labels := range h.CertAlerts.Series {
+		if _, ok := seen[key]; !ok {
+			delete(h.CertAlerts.Series, key)
+			certExpiry.Delete(labels)
+		}
+	}
+
+	return expiries
+}
+
+// alertCertificate raises a Sentry event when the certificate crossed a threshold it was not alerted for yet (mutex must be held)
+func (h *Handlers) alertCertificate(key string, expiry CertificateExpiry, now time.Time) {
+	left := expiry.NotAfter.Sub(now)
+
+	// Shortest threshold that was crossed
+	crossed := time.Duration(-1)
+	for _, threshold := range certAlertThresholds {
+		if left <= threshold {
+			crossed = threshold
+		}
+	}
+	if crossed < 0 {
+		return
+	}
+
+	sent, ok := h.CertAlerts.Sent[key]
+	if ok && sent.NotAfter.Equal(*expiry.NotAfter) && sent.Threshold <= crossed {
+		return
+	}
+	h.CertAlerts.Sent[key] = certAlert{NotAfter: *expiry.NotAfter, Threshold: crossed}
+
+	msg := fmt.Sprintf("Certificate of %s (%s) expires at %s (in less than %v)", expiry.PubKey, expiry.UniqueID, expiry.NotAfter.Format(time.RFC3339), crossed)
+	if expiry.Expired {
+		msg = fmt.Sprintf("Certificate of %s (%s) expired at %s", expiry.PubKey, expiry.UniqueID, expiry.NotAfter.Format(time.RFC3339))
+	}
+	glog.Warning(msg)
+	sentry.CaptureMessage(msg)
+}
+
+// monitorCertificates checks stored certificates every certCheckInterval
+func (h *Handlers) monitorCertificates() {
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		h.checkCertificates(time.Now())
+		<-ticker.C
+	}
+}
+
+// CertificatesHandler - lists certificates that expire within the within parameter (default CERT_EXPIRY_WINDOW)
+func (h *Handlers) CertificatesHandler(w http.ResponseWriter, r *http.Request) {
+	within := certExpiryWindow
+	if value := r.URL.Query().Get("within"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			h.badRequest(w, r, CodeBadRequest, "within is invalid", fmt.Sprintf("[Certificates] within is invalid - %v", value))
+			return
+		}
+		within = d
+	}
+
+	auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Certificates expiring within %v", within), r.Method)
+
+	result := CertificatesResult{Within: within.String(), Certificates: make([]CertificateExpiry, 0)}
+	for _, expiry := range h.certificateExpiries(time.Now()) {
+		// Certificates that cannot be parsed are always listed
+		if expiry.NotAfter == nil || expiry.SecondsLeft <= int64(within/time.Second) {
+			result.Certificates = append(result.Certificates, expiry)
+		}
+	}
+
+	respondJSON(w, r, http.StatusOK, result, result)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	entities "github.com/bolt-observer/go_common/entities"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// selfSignedCertificate returns base64 of a PEM certificate that expires at notAfter
+func selfSignedCertificate(t *testing.T, notAfter time.Time) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"lnd autogenerated cert"}},
+		NotBefore:    notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// certExpiryMetric returns the values of the certificate expiry gauge by pubkey prefix and uniqueId
+func certExpiryMetric(t *testing.T) map[string]float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+
+	ret := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != "macaroon_certificate_expiry_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			key := ""
+			for _, label := range metric.GetLabel() {
+				key += label.GetValue() + "/"
+			}
+			ret[key] = metric.GetGauge().GetValue()
+		}
+	}
+
+	return ret
+}
+
+func TestCertificateNotAfter(t *testing.T) {
+	notAfter, err := certificateNotAfter(testCertificate)
+	require.NoError(t, err)
+	assert.Equal(t, 2024, notAfter.Year())
+
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	notAfter, err = certificateNotAfter(selfSignedCertificate(t, expires))
+	require.NoError(t, err)
+	assert.True(t, expires.Equal(notAfter))
+
+	_, err = certificateNotAfter(base64.StdEncoding.EncodeToString([]byte("junk")))
+	assert.Error(t, err)
+}
+
+func TestCheckCertificates(t *testing.T) {
+	prometheusInit()
+	freshAuthThrottle(t)
+
+	old := certAlertThresholds
+	certAlertThresholds = []time.Duration{30 * 24 * time.Hour, 7 * 24 * time.Hour, 24 * time.Hour}
+	t.Cleanup(func() { certAlertThresholds = old })
+
+	now := time.Now()
+	pubkey := "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7"
+
+	h := MakeNewDummyHandlers()
+	record := func(cert string) entities.Data {
+		return entities.Data{PubKey: pubkey, MacaroonHex: testMacaroon, CertificateBase64: cert, Endpoint: "127.0.0.1:10009"}
+	}
+	h.toLookup(record(selfSignedCertificate(t, now.Add(10*24*time.Hour))), "soon")
+	h.toLookup(record(selfSignedCertificate(t, now.Add(-time.Hour))), "expired")
+	h.toLookup(record(selfSignedCertificate(t, now.Add(100*24*time.Hour))), "later")
+	h.toLookup(record(base64.StdEncoding.EncodeToString([]byte("junk"))), "broken")
+	h.toLookup(record(""), "rune")
+
+	expiries := h.checkCertificates(now)
+	require.Len(t, expiries, 4)
+	assert.Equal(t, "expired", expiries[0].UniqueID)
+	assert.True(t, expiries[0].Expired)
+	assert.Equal(t, "soon", expiries[1].UniqueID)
+	assert.Equal(t, "broken", expiries[3].UniqueID)
+	assert.NotEmpty(t, expiries[3].Error)
+
+	metric := certExpiryMetric(t)
+	assert.Len(t, metric, 3)
+	assert.InDelta(t, (10 * 24 * time.Hour).Seconds(), metric[pubkey[:pubkeyPrefixLen]+"/soon/"], 1)
+	assert.Less(t, metric[pubkey[:pubkeyPrefixLen]+"/expired/"], float64(0))
+
+	// Every certificate is alerted once per threshold
+	assert.Equal(t, map[string]certAlert{
+		pubkey + "soon":    {NotAfter: *expiries[1].NotAfter, Threshold: 30 * 24 * time.Hour},
+		pubkey + "expired": {NotAfter: *expiries[0].NotAfter, Threshold: 24 * time.Hour},
+	}, h.CertAlerts.Sent)
+
+	h.checkCertificates(now.Add(4 * 24 * time.Hour))
+	assert.Equal(t, 7*24*time.Hour, h.CertAlerts.Sent[pubkey+"soon"].Threshold)
+
+	// Deleted records disappear from the metric and renewed certificates are alerted again
+	h.deleteLookup(record(""), "later")
+	h.toLookup(record(selfSignedCertificate(t, now.Add(20*24*time.Hour))), "expired")
+	h.checkCertificates(now)
+	assert.Len(t, certExpiryMetric(t), 2)
+	assert.Equal(t, 30*24*time.Hour, h.CertAlerts.Sent[pubkey+"expired"].Threshold)
+
+	// So do records whose certificate cannot be checked anymore
+	h.toLookup(record(base64.StdEncoding.EncodeToString([]byte("junk"))), "soon")
+	h.checkCertificates(now)
+	metric = certExpiryMetric(t)
+	assert.Len(t, metric, 1)
+	assert.NotContains(t, metric, pubkey[:pubkeyPrefixLen]+"/soon/")
+}
+
+func TestCertificatesHandler(t *testing.T) {
+	prometheusInit()
+	freshAuthThrottle(t)
+
+	now := time.Now()
+	pubkey := "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7"
+
+	h := MakeNewDummyHandlers()
+	h.toLookup(entities.Data{PubKey: pubkey, MacaroonHex: testMacaroon, CertificateBase64: selfSignedCertificate(t, now.Add(10*24*time.Hour)), Endpoint: "127.0.0.1:10009"}, "soon")
+	h.toLookup(entities.Data{PubKey: pubkey, MacaroonHex: testMacaroon, CertificateBase64: selfSignedCertificate(t, now.Add(100*24*time.Hour)), Endpoint: "127.0.0.1:10009"}, "later")
+	router := v1Router(h)
+
+	w := call(router, http.MethodGet, "/v1/admin/certificates", "admin", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var result CertificatesResult
+	decodeEnvelope(t, w, &result)
+	assert.Equal(t, DefaultCertExpiryWindow.String(), result.Within)
+	require.Len(t, result.Certificates, 1)
+	assert.Equal(t, "soon", result.Certificates[0].UniqueID)
+
+	w = call(router, http.MethodGet, "/v1/admin/certificates?within=2400h", "admin", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	decodeEnvelope(t, w, &result)
+	assert.Len(t, result.Certificates, 2)
+
+	w = call(router, http.MethodGet, "/v1/admin/certificates?within=soon", "admin", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = call(router, http.MethodGet, "/v1/admin/certificates", "writer", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
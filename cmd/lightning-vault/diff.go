@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	entities "github.com/bolt-observer/go_common/entities"
+)
+
+// Fields of a record (see entities.Data)
+const (
+	FieldMacaroon             = "macaroon_hex"
+	FieldCertificate          = "certificate_base64"
+	FieldEndpoint             = "endpoint"
+	FieldTags                 = "tags"
+	FieldAPIType              = "api_type"
+	FieldCertVerificationType = "cert_verification_type"
+)
+
+// DryRunResult is the result of a put with dry_run=true
+type DryRunResult struct {
+	OperationResult
+	DryRun   bool          `json:"dry_run"`
+	Verified bool          `json:"verified"`
+	Changes  []FieldChange `json:"changes"`
+}
+
+// FieldChange describes a changed field of a record, values of macaroon_hex are never included
+type FieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old,omitempty"`
+	New   interface{} `json:"new,omitempty"`
+}
+
+func optionalInt(i *int) interface{} {
+	if i == nil {
+		return nil
+	}
+
+	return *i
+}
+
+func sameInt(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return *a == *b
+}
+
+// diffRecords returns the changes from old to new (in entities.Data field order)
+func diffRecords(old, new entities.Data) []FieldChange {
+	ret := make([]FieldChange, 0)
+
+	if old.MacaroonHex != new.MacaroonHex {
+		ret = append(ret, FieldChange{Field: FieldMacaroon})
+	}
+	if old.CertificateBase64 != new.CertificateBase64 {
+		ret = append(ret, FieldChange{Field: FieldCertificate, Old: old.CertificateBase64, New: new.CertificateBase64})
+	}
+	if old.Endpoint != new.Endpoint {
+		ret = append(ret, FieldChange{Field: FieldEndpoint, Old: old.Endpoint, New: new.Endpoint})
+	}
+	if old.Tags != new.Tags {
+		ret = append(ret, FieldChange{Field: FieldTags, Old: old.Tags, New: new.Tags})
+	}
+	if !sameInt(old.ApiType, new.ApiType) {
+		ret = append(ret, FieldChange{Field: FieldAPIType, Old: optionalInt(old.ApiType), New: optionalInt(new.ApiType)})
+	}
+	if !sameInt(old.CertVerificationType, new.CertVerificationType) {
+		ret = append(ret, FieldChange{Field: FieldCertVerificationType, Old: optionalInt(old.CertVerificationType), New: optionalInt(new.CertVerificationType)})
+	}
+
+	return ret
+}
+
+// changedFields returns just the names of changed fields
+func changedFields(changes []FieldChange) []string {
+	ret := make([]string, 0, len(changes))
+	for _, change := range changes {
+		ret = append(ret, change.Field)
+	}
+
+	return ret
+}
+
+// dryRunPut reports what a (validated) put would change without storing anything
+func (h *Handlers) dryRunPut(w http.ResponseWriter, r *http.Request, data *entities.Data, uniqueID string, verified bool) {
+	result := DryRunResult{
+		OperationResult: OperationResult{PubKey: data.PubKey, UniqueID: uniqueID, Result: ResultCreated},
+		DryRun:          true,
+		Verified:        verified,
+	}
+
+	orig, exists := h.lookup(data.PubKey + uniqueID)
+	if exists {
+		result.Changes = diffRecords(orig, *data)
+		result.Result = ResultUpdated
+		if len(result.Changes) == 0 {
+			result.Result = ResultUnchanged
+		}
+	} else {
+		result.Changes = diffRecords(entities.Data{PubKey: data.PubKey}, *data)
+	}
+
+	auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Put (dry run) %s (%s) would be %s, changes: %s", data.PubKey, uniqueID, result.Result, strings.Join(changedFields(result.Changes), ",")), r.Method)
+
+	respondJSON(w, r, http.StatusOK, result, result)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	entities "github.com/bolt-observer/go_common/entities"
+	local_utils "github.com/bolt-observer/lightning-vault/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffRecords(t *testing.T) {
+	old := entities.Data{PubKey: "a", MacaroonHex: "00", Endpoint: "127.0.0.1:10009", ApiType: intPtr(0)}
+	new := entities.Data{PubKey: "a", MacaroonHex: "01", Endpoint: "127.0.0.1:10009", ApiType: intPtr(1), Tags: "alice"}
+
+	changes := diffRecords(old, new)
+	assert.Equal(t, []FieldChange{
+		{Field: FieldMacaroon},
+		{Field: FieldTags, Old: "", New: "alice"},
+		{Field: FieldAPIType, Old: 0, New: 1},
+	}, changes)
+	assert.Equal(t, []string{FieldMacaroon, FieldTags, FieldAPIType}, changedFields(changes))
+
+	assert.Empty(t, diffRecords(old, old))
+}
+
+func TestPutDryRun(t *testing.T) {
+	prometheusInit()
+	freshAuthThrottle(t)
+
+	pubkey := "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7"
+
+	h := MakeNewDummyHandlers()
+	verified := 0
+	h.VerifyCall = func(w http.ResponseWriter, r *http.Request, data *entities.Data, pubkey, uniqueID string) bool {
+		verified++
+		return true
+	}
+
+	written := 0
+	mgr := h.SecretsManager.(*local_utils.TestSecretsManager)
+	mgr.InsertOrUpdateSecretFn = func(ctx context.Context, name, value string, metadata local_utils.Metadata) (string, local_utils.Change, error) {
+		written++
+		return name, local_utils.Updated, nil
+	}
+
+	router := v1Router(h)
+	body := `{"pubkey": "` + pubkey + `", "macaroon_hex": "` + testMacaroon + `", "certificate_base64": "` + testCertificate + `", "endpoint": "192.168.192.168:10009", "api_type": 0, "tags": "alice"}`
+
+	w := call(router, http.MethodPost, "/v1/put/id1?dry_run=true", "writer", body)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var result DryRunResult
+	decodeEnvelope(t, w, &result)
+	assert.Equal(t, ResultCreated, result.Result)
+	assert.True(t, result.DryRun)
+	assert.True(t, result.Verified)
+	assert.Equal(t, []string{FieldMacaroon, FieldCertificate, FieldEndpoint, FieldTags, FieldAPIType}, changedFields(result.Changes))
+	assert.Nil(t, result.Changes[0].New)
+	assert.NotContains(t, w.Body.String(), testMacaroon)
+	assert.Equal(t, 1, verified)
+
+	_, ok := h.lookup(pubkey + "id1")
+	assert.False(t, ok)
+	assert.Equal(t, 0, written)
+
+	// Against an existing record
+	h.toLookup(entities.Data{PubKey: pubkey, MacaroonHex: testMacaroon, CertificateBase64: testCertificate, Endpoint: "192.168.192.168:10009", ApiType: intPtr(0)}, "id1")
+
+	w = call(router, http.MethodPost, "/v1/put/id1?dry_run=true&verify=false", "writer", body)
+	assert.Equal(t, http.StatusOK, w.Code)
+	result = DryRunResult{}
+	decodeEnvelope(t, w, &result)
+	assert.Equal(t, ResultUpdated, result.Result)
+	assert.False(t, result.Verified)
+	assert.Equal(t, []FieldChange{{Field: FieldTags, Old: "", New: "alice"}}, result.Changes)
+	assert.Equal(t, 1, verified)
+
+	data, _ := h.lookup(pubkey + "id1")
+	assert.Equal(t, "", data.Tags)
+	assert.Equal(t, 0, written)
+
+	w = call(router, http.MethodPost, "/v1/put/id1?dry_run=true&verify=false", "writer", `{"pubkey": "`+pubkey+`"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	result = DryRunResult{}
+	decodeEnvelope(t, w, &result)
+	assert.Equal(t, ResultUnchanged, result.Result)
+	assert.Empty(t, result.Changes)
+
+	// Validation still applies
+	w = call(router, http.MethodPost, "/v1/put/id1?dry_run=true", "writer", `{"pubkey": "alice"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, 0, written)
+}
@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	api "github.com/bolt-observer/agent/lightning"
@@ -23,7 +25,34 @@ import (
 // Handlers struct (all method used by HTTP handlers)
 type Handlers struct {
 	VerifyCall func(w http.ResponseWriter, r *http.Request, data *entities.Data, pubkey, uniqueID string) bool
+	// CheckCall checks the credential against the node (used by VerifyCall and background verification)
+	CheckCall  func(ctx context.Context, data *entities.Data, pubkey string) error
 	Lookup     map[string]entities.Data
+	Approvals  *Approvals
+	BreakGlass *BreakGlass
+	CertAlerts *CertAlerts
+	// Verifications is the outcome of background verification per record
+	Verifications *Verifications
+
+	// aliases maps alias + uniqueID to pubkey, guarded by LookupMutex too
+	aliases     map[aliasKey]string
+	LookupMutex sync.RWMutex
+	// RecordMutex serializes every write of records (merged writes check the record did not change, see storeUnchanged)
+	RecordMutex sync.Mutex
+
+	// loading is 1 while the initial load is running
+	loading int32
+	// configProblems are reported by /readyz
+	configProblems []string
+	// loadSummary is the outcome of the initial load (nil when nothing was loaded)
+	loadSummary *LoadSummary
+	loadMutex   sync.Mutex
+	// backendCheck is the last secrets manager check of /readyz (reused for readyCacheTTL)
+	backendCheck     HealthCheck
+	backendCheckedAt time.Time
+	backendMutex     sync.Mutex
+	// fixturesDir contains records stored after the initial load unless they exist (ENV=local only)
+	fixturesDir string
 
 	SecretsManager local_utils.SecretsManager
 }
@@ -31,24 +60,36 @@ type Handlers struct {
 // MakeNewHandlers - creates new Handlers
 func MakeNewHandlers() *Handlers {
 	r := &Handlers{
-		Lookup: make(map[string]entities.Data),
+		Lookup:        make(map[string]entities.Data),
+		aliases:       make(map[aliasKey]string),
+		Approvals:     NewApprovals(),
+		BreakGlass:    NewBreakGlass(),
+		CertAlerts:    NewCertAlerts(),
+		Verifications: NewVerifications(),
 	}
 
 	r.SecretsManager = local_utils.GetPlatformSecretsManager()
 
 	r.VerifyCall = r.verify
+	r.CheckCall = checkCredentials
 	return r
 }
 
 // MakeNewDummyHandlers - create new Handlers that have external calls mocked
 func MakeNewDummyHandlers() *Handlers {
 	r := &Handlers{
-		Lookup: make(map[string]entities.Data),
+		Lookup:        make(map[string]entities.Data),
+		aliases:       make(map[aliasKey]string),
+		Approvals:     NewApprovals(),
+		BreakGlass:    NewBreakGlass(),
+		CertAlerts:    NewCertAlerts(),
+		Verifications: NewVerifications(),
 	}
 
 	r.SecretsManager = local_utils.SecretsManager(local_utils.NewTestSecretsManager())
 
 	r.VerifyCall = r.verify
+	r.CheckCall = checkCredentials
 	return r
 }
 
@@ -65,7 +106,7 @@ func (h *Handlers) obtainUniqueID(w http.ResponseWriter, r *http.Request) (strin
 		uniqueID = ""
 	} else {
 		if !utils.AlphaNumeric.MatchString(uniqueID) {
-			h.badRequest(w, r, "uniqueId parameter is invalid", fmt.Sprintf("uniqueId parameter is invalid - %v", uniqueID))
+			h.badRequest(w, r, CodeUniqueIDInvalid, "uniqueId parameter is invalid", fmt.Sprintf("uniqueId parameter is invalid - %v", uniqueID))
 			return "", fmt.Errorf("invalid parameter")
 		}
 	}
@@ -87,16 +128,14 @@ func (h *Handlers) QueryHandler(w http.ResponseWriter, r *http.Request) {
 
 	auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Query %s (%s)", pubkey, uniqueID), r.Method)
 
-	_, ok := h.Lookup[pubkey+uniqueID]
+	_, ok := h.resolve(r, pubkey, uniqueID)
 	if !ok {
 		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[Query] Secret %s not found", pubkey), r.Method)
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(w, "Not found\n")
+		notFound(w, r)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "Macaroon exists\n")
+	respond(w, r, http.StatusOK, OperationResult{PubKey: pubkey, UniqueID: uniqueID, Result: ResultExists}, "Macaroon exists\n")
 }
 
 // DeleteHandler - delete macaroon
@@ -113,27 +152,38 @@ func (h *Handlers) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 
 	auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Delete %s (%s)", pubkey, uniqueID), r.Method)
 
-	e, ok := h.Lookup[pubkey+uniqueID]
+	e, ok := h.resolve(r, pubkey, uniqueID)
 	if !ok {
 		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[Delete] Secret %s not found", pubkey), r.Method)
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(w, "Not found\n")
+		notFound(w, r)
 		return
 	}
 
-	_, err = h.SecretsManager.DeleteSecret(ctx, fmt.Sprintf("%s_%s%s_", prefix, e.PubKey, uniqueID))
+	options, err := deleteOptions(r)
+	if err != nil {
+		h.badRequest(w, r, CodeBadRequest, err.Error(), fmt.Sprintf("[Delete] %v", err))
+		return
+	}
+	if _, ok := h.SecretsManager.(local_utils.Purger); options.Mode == DeleteModeSchedule && !ok {
+		h.badRequest(w, r, CodeBadRequest, errDeletionUnsupported.Error(), fmt.Sprintf("[Delete] %v", errDeletionUnsupported))
+		return
+	}
 
+	if approvalRequired {
+		h.submitChangeRequest(w, r, OperationDelete, &e, uniqueID, false)
+		return
+	}
+
+	h.RecordMutex.Lock()
+	err = h.removeSecret(ctx, e, uniqueID, options)
+	h.RecordMutex.Unlock()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("AWS delete secret failed with error %v", err), r.Method)
-		fmt.Fprintf(w, "Internal error\n")
+		internalError(w, r)
 		return
 	}
 
-	h.deleteLookup(e, uniqueID)
-
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "Macaroon deleted\n")
+	respond(w, r, http.StatusOK, OperationResult{PubKey: pubkey, UniqueID: uniqueID, Result: ResultDeleted}, "Macaroon deleted\n")
 }
 
 // GetHandler - gets nacaroon
@@ -151,29 +201,21 @@ func (h *Handlers) GetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	data, ok = h.Lookup[pubkey+uniqueID]
+	data, ok = h.resolve(r, pubkey, uniqueID)
 	if !ok {
 		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[Get] Secret %s not found", pubkey), r.Method)
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(w, "Not found\n")
+		notFound(w, r)
 		return
 	}
 
-	duration, ok := readDurations[r.Header.Get("Authorization")]
-	if !ok {
-		duration = time.Minute * 10
-	}
+	duration := readDuration(r)
 
-	data = local_utils.GetConstrained(&data, duration)
+	data, info := local_utils.GetConstrainedWithInfo(&data, duration)
+	info.IssuanceID = randomID()
+	info.SetHeaders(w.Header())
 
-	auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Get %s (%s) valid for %v", pubkey, uniqueID, duration), r.Method)
-	encoder := json.NewEncoder(w)
-	err = encoder.Encode(&data)
-	if err != nil {
-		h.badRequest(w, r, "json encoding failed", fmt.Sprintf("[Get] json encoding failed: %v", err))
-		sentry.CaptureException(err)
-		return
-	}
+	auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Get %s (%s) valid for %v issuance %s", pubkey, uniqueID, duration, info.IssuanceID), r.Method)
+	respondJSON(w, r, http.StatusOK, GetResult{Data: data, CredentialInfo: info, UniqueID: uniqueID}, &data)
 }
 
 func extractHostnameAndPort(endpoint string) (string, int) {
@@ -269,67 +311,170 @@ func complainAboutInvalidAuthenticator(data entities.Data) bool {
 
 // PutHandler - put a macaroon
 func (h *Handlers) PutHandler(w http.ResponseWriter, r *http.Request) {
+	data, uniqueID, base, ok := h.preparePut(w, r)
+	if !ok {
+		return
+	}
+
+	verified, ok := h.verifyPut(w, r, data, uniqueID)
+	if !ok {
+		return
+	}
+
+	dryRun, err := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	if err == nil && dryRun {
+		h.dryRunPut(w, r, data, uniqueID, verified)
+		return
+	}
+
+	if approvalRequired {
+		h.submitChangeRequest(w, r, OperationPut, data, uniqueID, verified)
+		return
+	}
+
+	status, err := h.storeUnchanged(context.Background(), data, uniqueID, base)
+	if errors.Is(err, errRecordChanged) {
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[Put] %s (%s) changed while it was verified", data.PubKey, uniqueID), r.Method)
+		respondError(w, r, http.StatusConflict, CodeConflict, "Record changed while the request was processed, retry")
+		return
+	}
+	if err != nil {
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("AWS add secret failed with error %v", err), r.Method)
+		internalError(w, r)
+		return
+	}
+
+	if status == local_utils.Updated {
+		auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Put (update) %v", data.PubKey), r.Method)
+		respond(w, r, http.StatusOK, OperationResult{PubKey: data.PubKey, UniqueID: uniqueID, Result: ResultUpdated}, fmt.Sprintf("Updated secret %v", data.PubKey))
+	} else {
+		auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Put (new) %v", data.PubKey), r.Method)
+		respond(w, r, http.StatusCreated, OperationResult{PubKey: data.PubKey, UniqueID: uniqueID, Result: ResultCreated}, fmt.Sprintf("Inserted secret %v", data.PubKey))
+	}
+}
+
+// preparePut decodes and validates the put request, base is the version of the record it was merged with
+func (h *Handlers) preparePut(w http.ResponseWriter, r *http.Request) (*entities.Data, string, string, bool) {
 	var data entities.Data
 
-	ctx := context.Background()
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(&data)
 	if err != nil {
-		h.badRequest(w, r, "json decoding failed", fmt.Sprintf("[Put] json decoding failed: %v", err))
+		h.badRequest(w, r, CodeJSONInvalid, "json decoding failed", fmt.Sprintf("[Put] json decoding failed: %v", err))
 		sentry.CaptureException(err)
-		return
+		return nil, "", "", false
 	}
 
 	uniqueID, err := h.obtainUniqueID(w, r)
 	if err != nil {
-		return
+		return nil, "", "", false
 	}
 
+	base, e := h.validatePut(r, &data, uniqueID)
+	if e != nil {
+		h.badRequest(w, r, e.Code, e.Reason, e.LogReason)
+		return nil, "", "", false
+	}
+
+	return &data, uniqueID, base, true
+}
+
+// requestError describes why (part of) a request was rejected
+type requestError struct {
+	Code      ErrorCode
+	Reason    string
+	LogReason string
+}
+
+// validatePut validates data, missing fields are taken from the existing record (its version is returned, see storeUnchanged)
+func (h *Handlers) validatePut(r *http.Request, data *entities.Data, uniqueID string) (string, *requestError) {
 	// Some basic validation
 	if !utils.ValidatePubkey(data.PubKey) {
-		h.badRequest(w, r, "pubkey validation failed", fmt.Sprintf("[Put] pubkey validation failed: %v", data.PubKey))
-		return
+		return "", &requestError{Code: CodePubkeyInvalid, Reason: "pubkey validation failed", LogReason: fmt.Sprintf("[Put] pubkey validation failed: %v", data.PubKey)}
+	}
+
+	if reqErr := h.aliasConflict(*data, uniqueID); reqErr != nil {
+		return "", reqErr
 	}
 
-	orig, ok := h.Lookup[data.PubKey+uniqueID]
+	orig, ok := h.lookup(data.PubKey + uniqueID)
+	base := noRecord
+	if ok {
+		base = dataVersion(&orig)
+	}
 
 	if data.Endpoint == "" {
 		if !ok {
-			h.badRequest(w, r, "empty endpoint", "[Put] empty endpoint")
-			return
+			return "", &requestError{Code: CodeEndpointInvalid, Reason: "empty endpoint", LogReason: "[Put] empty endpoint"}
 		}
 
 		auditLog(r.Header.Get("Authorization"), r.RemoteAddr, "[Put] using old endpoint (no new one supplied)", r.Method)
 		data.Endpoint = orig.Endpoint
 	}
 
-	if data.ApiType != nil {
-		t, err := api.GetAPIType(data.ApiType)
-
-		if err != nil || *t == api.ClnSocket {
-			h.badRequest(w, r, "invalid api type", fmt.Sprintf("[Put] invalid api type - %v", data.ApiType))
-		}
-	} else {
+	if data.ApiType == nil {
 		if ok {
 			if orig.ApiType != nil {
 				data.ApiType = orig.ApiType
 			}
 		} else {
-			autoDetectAPIType(&data)
+			autoDetectAPIType(data)
+		}
+	}
+
+	hostname, needCert, reqErr := recordRequirements(data, "Put")
+	if reqErr != nil {
+		return "", reqErr
+	}
+
+	if data.CertificateBase64 == "" {
+		if ok && orig.CertificateBase64 != "" {
+			auditLog(r.Header.Get("Authorization"), r.RemoteAddr, "[Put] using old certificate (no new one supplied)", r.Method)
+			data.CertificateBase64 = orig.CertificateBase64
+		} else {
+			// TODO: deprecate this
+			if needCert {
+				data.CertificateBase64 = utils.ObtainCert(hostname)
+			}
+		}
+	}
+
+	if data.MacaroonHex == "" {
+		if !ok {
+			return "", &requestError{Code: CodeAuthenticatorInvalid, Reason: "empty macaroon/rune value", LogReason: "[Put] empty macaroon/rune value"}
+		}
+
+		auditLog(r.Header.Get("Authorization"), r.RemoteAddr, "[Put] using old macaroon/rune (no new one supplied)", r.Method)
+		data.MacaroonHex = orig.MacaroonHex
+	}
+
+	if data.CertVerificationType == nil && ok {
+		if orig.CertVerificationType != nil {
+			auditLog(r.Header.Get("Authorization"), r.RemoteAddr, "[Put] using old certificate verification type (no new one supplied)", r.Method)
+			data.CertVerificationType = orig.CertVerificationType
 		}
 	}
 
+	return base, validateRecord(data, "Put")
+}
+
+// recordRequirements checks api type and endpoint, returns the hostname (for obtaining the certificate) and whether a certificate is needed
+func recordRequirements(data *entities.Data, op string) (string, bool, *requestError) {
 	hostname := ""
 	port := -1
 	needCert := false
 
 	if data.ApiType != nil {
+		t, err := api.GetAPIType(data.ApiType)
+		if err != nil || *t == api.ClnSocket {
+			return "", false, &requestError{Code: CodeAPITypeInvalid, Reason: "invalid api type", LogReason: fmt.Sprintf("[%s] invalid api type - %v", op, data.ApiType)}
+		}
+
 		if *data.ApiType == int(api.LndGrpc) {
 			hostname, port = extractHostnameAndPort(data.Endpoint)
 			needCert = true
 			if port < 0 {
-				h.badRequest(w, r, "invalid endpoint", fmt.Sprintf("[Put] invalid endpoint - %s", data.Endpoint))
-				return
+				return "", false, &requestError{Code: CodeEndpointInvalid, Reason: "invalid endpoint", LogReason: fmt.Sprintf("[%s] invalid endpoint - %s", op, data.Endpoint)}
 			}
 		} else if *data.ApiType == int(api.LndRest) {
 			hostname, port = extractHostnameAndPort(data.Endpoint)
@@ -337,7 +482,7 @@ func (h *Handlers) PutHandler(w http.ResponseWriter, r *http.Request) {
 		} else if *data.ApiType == int(api.ClnCommando) {
 			needCert = false
 		} else {
-			h.badRequest(w, r, "unsupported api type", fmt.Sprintf("[Put] unsupported api type - %v", *data.ApiType))
+			return "", false, &requestError{Code: CodeAPITypeInvalid, Reason: "unsupported api type", LogReason: fmt.Sprintf("[%s] unsupported api type - %v", op, *data.ApiType)}
 		}
 	}
 
@@ -345,49 +490,35 @@ func (h *Handlers) PutHandler(w http.ResponseWriter, r *http.Request) {
 		hostname = fmt.Sprintf("%s:%d", hostname, port)
 	}
 
-	if data.CertificateBase64 == "" {
-		if ok && orig.CertificateBase64 != "" {
-			auditLog(r.Header.Get("Authorization"), r.RemoteAddr, "[Put] using old certificate (no new one supplied)", r.Method)
-			data.CertificateBase64 = orig.CertificateBase64
-		} else {
-			// TODO: deprecate this
-			if needCert {
-				data.CertificateBase64 = utils.ObtainCert(hostname)
-			}
-		}
+	return hostname, needCert, nil
+}
+
+// validateRecord validates a complete record (nothing is taken from the existing one)
+func validateRecord(data *entities.Data, op string) *requestError {
+	if data.Endpoint == "" {
+		return &requestError{Code: CodeEndpointInvalid, Reason: "empty endpoint", LogReason: fmt.Sprintf("[%s] empty endpoint", op)}
+	}
+
+	_, needCert, reqErr := recordRequirements(data, op)
+	if reqErr != nil {
+		return reqErr
 	}
 
 	if data.CertificateBase64 == "" && needCert {
-		h.badRequest(w, r, "empty certificate", "[Put] empty certificate")
-		return
+		return &requestError{Code: CodeCertificateInvalid, Reason: "empty certificate", LogReason: fmt.Sprintf("[%s] empty certificate", op)}
 	}
 
-	_, err = utils.SafeBase64Decode(data.CertificateBase64)
+	_, err := utils.SafeBase64Decode(data.CertificateBase64)
 	if err != nil {
-		h.badRequest(w, r, "invalid certificate", fmt.Sprintf("[Put] invalid certificate - %s", data.CertificateBase64))
-		return
+		return &requestError{Code: CodeCertificateInvalid, Reason: "invalid certificate", LogReason: fmt.Sprintf("[%s] invalid certificate - %s", op, data.CertificateBase64)}
 	}
 
 	if data.MacaroonHex == "" {
-		if !ok {
-			h.badRequest(w, r, "empty macaroon/rune value", "[Put] empty macaroon/rune value")
-			return
-		}
-
-		auditLog(r.Header.Get("Authorization"), r.RemoteAddr, "[Put] using old macaroon/rune (no new one supplied)", r.Method)
-		data.MacaroonHex = orig.MacaroonHex
+		return &requestError{Code: CodeAuthenticatorInvalid, Reason: "empty macaroon/rune value", LogReason: fmt.Sprintf("[%s] empty macaroon/rune value", op)}
 	}
 
-	if data.CertVerificationType == nil && ok {
-		if orig.CertVerificationType != nil {
-			auditLog(r.Header.Get("Authorization"), r.RemoteAddr, "[Put] using old certificate verification type (no new one supplied)", r.Method)
-			data.CertVerificationType = orig.CertVerificationType
-		}
-	}
-
-	if complainAboutInvalidAuthenticator(data) {
-		h.badRequest(w, r, "invalid macaroon/rune", "[Put] invalid macaroon/rune - not compatible with API type")
-		return
+	if complainAboutInvalidAuthenticator(*data) {
+		return &requestError{Code: CodeAuthenticatorInvalid, Reason: "invalid macaroon/rune", LogReason: fmt.Sprintf("[%s] invalid macaroon/rune - not compatible with API type", op)}
 	}
 
 	apiType, err := api.GetAPIType(data.ApiType)
@@ -397,19 +528,20 @@ func (h *Handlers) PutHandler(w http.ResponseWriter, r *http.Request) {
 
 	_, err = local_utils.Constrain(data.MacaroonHex, 1*time.Minute, apiType)
 	if err != nil {
-		h.badRequest(w, r, "invalid macaroon/rune", "[Put] invalid macaroon/rune - could not constrain")
-		return
+		return &requestError{Code: CodeAuthenticatorInvalid, Reason: "invalid macaroon/rune", LogReason: fmt.Sprintf("[%s] invalid macaroon/rune - could not constrain", op)}
 	}
 
-	result := new(bytes.Buffer)
-	encoder := json.NewEncoder(result)
-	err = encoder.Encode(&data)
+	_, err = json.Marshal(data)
 	if err != nil {
-		h.badRequest(w, r, "json encoding failed", fmt.Sprintf("[Put] json encoding failed: %v", err))
 		sentry.CaptureException(err)
-		return
+		return &requestError{Code: CodeJSONInvalid, Reason: "json encoding failed", LogReason: fmt.Sprintf("[%s] json encoding failed: %v", op, err)}
 	}
 
+	return nil
+}
+
+// verifyEnabled returns whether puts of request r are verified (VERIFY and the verify query parameter)
+func verifyEnabled(r *http.Request) bool {
 	verifyQuery, err := strconv.ParseBool(r.URL.Query().Get("verify"))
 	if err != nil {
 		verifyQuery = true
@@ -420,36 +552,123 @@ func (h *Handlers) PutHandler(w http.ResponseWriter, r *http.Request) {
 		verify = true
 	}
 
-	if verify && verifyQuery && !h.VerifyCall(w, r, &data, data.PubKey, uniqueID) {
-		return
+	return verify && verifyQuery
+}
+
+// verifyPut runs the verification (unless disabled), returns whether it was done and whether put can proceed
+func (h *Handlers) verifyPut(w http.ResponseWriter, r *http.Request, data *entities.Data, uniqueID string) (bool, bool) {
+	if !verifyEnabled(r) {
+		return false, true
+	}
+
+	if !h.VerifyCall(w, r, data, data.PubKey, uniqueID) {
+		return true, false
+	}
+
+	return true, true
+}
+
+// secretName returns the name under which a record is stored
+func secretName(prefix, pubkey, uniqueID string) string {
+	return fmt.Sprintf("%s_%s%s_", prefix, pubkey, uniqueID)
+}
+
+// apiTypeNames are used in metadata of stored secrets
+var apiTypeNames = map[api.APIType]string{
+	api.LndGrpc:     "lnd-grpc",
+	api.LndRest:     "lnd-rest",
+	api.ClnSocket:   "cln-socket",
+	api.ClnCommando: "cln-commando",
+}
+
+// envMetadata returns metadata of every secret stored in environment env
+func envMetadata(env string) local_utils.Metadata {
+	ret := local_utils.Metadata{local_utils.MetadataManagedBy: local_utils.ManagedBy}
+	if env != "" {
+		ret[local_utils.MetadataEnv] = env
+	}
+
+	return ret
+}
+
+// recordMetadata returns metadata of the secret storing data in environment env
+func recordMetadata(env string, data *entities.Data, uniqueID string) local_utils.Metadata {
+	ret := envMetadata(env)
+	ret[local_utils.MetadataPubKey] = data.PubKey
+	if uniqueID != "" {
+		ret[local_utils.MetadataUniqueID] = uniqueID
+	}
+	if data.ApiType != nil {
+		if name, ok := apiTypeNames[api.APIType(*data.ApiType)]; ok {
+			ret[local_utils.MetadataAPIType] = name
+		}
+	}
+
+	return ret
+}
+
+// encodeRecord returns the stored representation of data
+func encodeRecord(data *entities.Data) (string, error) {
+	result := new(bytes.Buffer)
+	encoder := json.NewEncoder(result)
+	err := encoder.Encode(data)
+	if err != nil {
+		sentry.CaptureException(err)
+		return "", err
 	}
 
-	h.toLookup(data, uniqueID)
+	return result.String(), nil
+}
 
-	_, status, err := h.SecretsManager.InsertOrUpdateSecret(ctx, fmt.Sprintf("%s_%s%s_", prefix, data.PubKey, uniqueID), result.String())
+// storeSecret persists data to the secrets manager and updates the lookup table
+func (h *Handlers) storeSecret(ctx context.Context, data *entities.Data, uniqueID string) (local_utils.Change, error) {
+	value, err := encodeRecord(data)
+	if err != nil {
+		return local_utils.Undefined, err
+	}
 
+	_, status, err := h.SecretsManager.InsertOrUpdateSecret(ctx, secretName(prefix, data.PubKey, uniqueID), value, recordMetadata(environment, data, uniqueID))
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("AWS add secret failed with error %v", err), r.Method)
-		fmt.Fprintf(w, "Internal error\n")
-		return
+		return local_utils.Undefined, err
 	}
 
-	if status == local_utils.Updated {
-		w.WriteHeader(http.StatusOK)
-		auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Put (update) %v", data.PubKey), r.Method)
-		fmt.Fprintf(w, "Updated secret %v", data.PubKey)
-	} else {
-		w.WriteHeader(http.StatusCreated)
-		auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Put (new) %v", data.PubKey), r.Method)
-		fmt.Fprintf(w, "Inserted secret %v", data.PubKey)
+	h.toLookup(*data, uniqueID)
+
+	return status, nil
+}
+
+// storeUnchanged stores data like storeSecret unless the record changed since version base was read (errRecordChanged)
+func (h *Handlers) storeUnchanged(ctx context.Context, data *entities.Data, uniqueID, base string) (local_utils.Change, error) {
+	h.RecordMutex.Lock()
+	defer h.RecordMutex.Unlock()
+
+	if h.recordVersion(data.PubKey, uniqueID) != base {
+		return local_utils.Undefined, errRecordChanged
 	}
+
+	return h.storeSecret(ctx, data, uniqueID)
+}
+
+// removeSecret deletes data from the secrets manager and the lookup table
+func (h *Handlers) removeSecret(ctx context.Context, data entities.Data, uniqueID string, options DeleteOptions) error {
+	err := h.deleteSecret(ctx, secretName(prefix, data.PubKey, uniqueID), options)
+	if err != nil {
+		return err
+	}
+
+	h.deleteLookup(data, uniqueID)
+
+	return nil
 }
 
-func (h *Handlers) badRequest(w http.ResponseWriter, r *http.Request, reason, logReason string) {
+func (h *Handlers) badRequest(w http.ResponseWriter, r *http.Request, code ErrorCode, reason, logReason string) {
 	failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Bad request - %s", logReason), r.Method)
-	w.WriteHeader(http.StatusBadRequest)
-	fmt.Fprintf(w, "Bad request - %s\n", reason)
+	message := fmt.Sprintf("Bad request - %s", reason)
+	if isV1(r) {
+		message = reason
+	}
+
+	respondError(w, r, http.StatusBadRequest, code, message)
 }
 
 // VerifyHandler - check whether macaroon is usable
@@ -465,15 +684,14 @@ func (h *Handlers) VerifyHandler(w http.ResponseWriter, r *http.Request) {
 	auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Verify %s (%s)", pubkey, uniqueID), r.Method)
 
 	if !utils.ValidatePubkey(pubkey) {
-		h.badRequest(w, r, "pubkey validation failed", fmt.Sprintf("[Verify] pubkey validation failed: %v", pubkey))
+		h.badRequest(w, r, CodePubkeyInvalid, "pubkey validation failed", fmt.Sprintf("[Verify] pubkey validation failed: %v", pubkey))
 		return
 	}
 
-	data, ok := h.Lookup[pubkey+uniqueID]
+	data, ok := h.lookup(pubkey + uniqueID)
 	if !ok {
 		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[Verify] Secret %s not found", pubkey), r.Method)
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(w, "Not found\n")
+		notFound(w, r)
 		return
 	}
 
@@ -481,41 +699,58 @@ func (h *Handlers) VerifyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "Everything is ok\n")
+	respond(w, r, http.StatusOK, OperationResult{PubKey: pubkey, UniqueID: uniqueID, Result: ResultVerified}, "Everything is ok\n")
 }
 
 func (h *Handlers) verify(w http.ResponseWriter, r *http.Request, data *entities.Data, pubkey, uniqueID string) bool {
-	api, err := api.NewAPI(api.LndGrpc, func() (*entities.Data, error) { return data, nil })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := h.CheckCall(ctx, data, pubkey)
 	if err != nil {
-		h.badRequest(w, r, "invalid credentials - check failed", fmt.Sprintf("failed to get lightning client, error %v", err))
+		h.badRequest(w, r, CodeVerifyFailed, "invalid credentials - check failed", err.Error())
 		return false
 	}
+
+	return true
+}
+
+// errUnsupportedAPIType is returned by checkCredentials when the api_type of the record is unknown
+var errUnsupportedAPIType = errors.New("api type is not supported")
+
+// checkCredentials returns an error unless the node at the endpoint is pubkey and the credential works
+func checkCredentials(ctx context.Context, data *entities.Data, pubkey string) error {
+	apiType := api.LndGrpc
+	if data.ApiType != nil {
+		t, err := api.GetAPIType(data.ApiType)
+		if err != nil {
+			return fmt.Errorf("%w: %d", errUnsupportedAPIType, *data.ApiType)
+		}
+		apiType = *t
+	}
+
+	api, err := api.NewAPI(apiType, func() (*entities.Data, error) { return data, nil })
+	if err != nil {
+		return fmt.Errorf("failed to get lightning client, error %v", err)
+	}
 	if api == nil {
-		h.badRequest(w, r, "invalid credentials - check failed", "failed to get lightning client")
-		return false
+		return fmt.Errorf("failed to get lightning client")
 	}
 	defer api.Cleanup()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
 	info, err := api.GetInfo(ctx)
 	if err != nil {
-		h.badRequest(w, r, "invalid credentials - check failed", fmt.Sprintf("[Verify] failed to get info %v", err))
-		return false
+		return fmt.Errorf("[Verify] failed to get info %v", err)
 	}
 
 	if !strings.EqualFold(info.IdentityPubkey, pubkey) {
-		h.badRequest(w, r, "invalid credentials - check failed", fmt.Sprintf("[Verify] endpoint is %s not %s", info.IdentityPubkey, pubkey))
-		return false
+		return fmt.Errorf("[Verify] endpoint is %s not %s", info.IdentityPubkey, pubkey)
 	}
 
 	_, err = api.GetChannels(ctx)
 	if err != nil {
-		h.badRequest(w, r, "invalid credentials - check failed", fmt.Sprintf("[Verify] failed to get channels %v", err))
-		return false
+		return fmt.Errorf("[Verify] failed to get channels %v", err)
 	}
 
-	return true
+	return nil
 }
@@ -72,7 +72,7 @@ func TestPutHandler(t *testing.T) {
 	wasCalled := false
 	mgr := h.SecretsManager.(*local_utils.TestSecretsManager)
 
-	mgr.InsertOrUpdateSecretFn = func(ctx context.Context, name, value string) (string, local_utils.Change, error) {
+	mgr.InsertOrUpdateSecretFn = func(ctx context.Context, name, value string, metadata local_utils.Metadata) (string, local_utils.Change, error) {
 		wasCalled = true
 		return "", local_utils.Inserted, nil
 	}
@@ -113,7 +113,7 @@ func TestPutHandlerWithNoApiType(t *testing.T) {
 	w := httptest.NewRecorder()
 
 	mgr := h.SecretsManager.(*local_utils.TestSecretsManager)
-	mgr.InsertOrUpdateSecretFn = func(ctx context.Context, name, value string) (string, local_utils.Change, error) {
+	mgr.InsertOrUpdateSecretFn = func(ctx context.Context, name, value string, metadata local_utils.Metadata) (string, local_utils.Change, error) {
 		return "", local_utils.Inserted, nil
 	}
 
@@ -168,7 +168,7 @@ func TestPutHandlerInvalidAuthenticator(t *testing.T) {
 	w = httptest.NewRecorder()
 
 	mgr := h.SecretsManager.(*local_utils.TestSecretsManager)
-	mgr.InsertOrUpdateSecretFn = func(ctx context.Context, name, value string) (string, local_utils.Change, error) {
+	mgr.InsertOrUpdateSecretFn = func(ctx context.Context, name, value string, metadata local_utils.Metadata) (string, local_utils.Change, error) {
 		return "", local_utils.Inserted, nil
 	}
 
@@ -192,7 +192,7 @@ func TestUniqueId(t *testing.T) {
 	h := MakeNewDummyHandlers()
 
 	mgr := h.SecretsManager.(*local_utils.TestSecretsManager)
-	mgr.InsertOrUpdateSecretFn = func(ctx context.Context, name, value string) (string, local_utils.Change, error) {
+	mgr.InsertOrUpdateSecretFn = func(ctx context.Context, name, value string, metadata local_utils.Metadata) (string, local_utils.Change, error) {
 		return "", local_utils.Inserted, nil
 	}
 	h.VerifyCall = func(w http.ResponseWriter, r *http.Request, data *entities.Data, pubkey, uniqueId string) bool {
@@ -284,7 +284,7 @@ func readMyWrite(t *testing.T, pubKey, origMac string) {
 	saveCalled := false
 	mgr := h.SecretsManager.(*local_utils.TestSecretsManager)
 
-	mgr.InsertOrUpdateSecretFn = func(ctx context.Context, name, value string) (string, local_utils.Change, error) {
+	mgr.InsertOrUpdateSecretFn = func(ctx context.Context, name, value string, metadata local_utils.Metadata) (string, local_utils.Change, error) {
 		saveCalled = true
 		return "", local_utils.Inserted, nil
 	}
@@ -357,6 +357,25 @@ func TestAuth(t *testing.T) {
 	auth("user3", "pass3", http.StatusUnauthorized, router, t)
 }
 
+func TestMatchIdentity(t *testing.T) {
+	identity := &local_utils.GetCallerIdentityResult{
+		Arn:     "arn:aws:sts::123456789012:assumed-role/some-machine-role/i-0123456789abcdef0",
+		UserID:  "AROAEXAMPLEID:i-0123456789abcdef0",
+		Account: "123456789012",
+	}
+
+	assert.True(t, matchIdentity("arn:aws:sts::123456789012:assumed-role/some-machine-role/*", identity))
+	assert.False(t, matchIdentity("arn:aws:sts::123456789012:assumed-role/other-role/*", identity))
+	assert.True(t, matchIdentity("account:123456789012", identity))
+	assert.False(t, matchIdentity("account:210987654321", identity))
+	assert.True(t, matchIdentity("userid:123456789012:AROAEXAMPLEID:*", identity))
+	assert.False(t, matchIdentity("userid:123456789012:AROAOTHER:*", identity))
+	// Account is required
+	assert.False(t, matchIdentity("userid:AROAEXAMPLEID:*", identity))
+	assert.False(t, matchIdentity("userid:*:AROAEXAMPLEID:*", identity))
+	assert.False(t, matchIdentity("userid:210987654321:AROAEXAMPLEID:*", identity))
+}
+
 func auth(user, pass string, status int, router *mux.Router, t *testing.T) {
 	r := httptest.NewRequest(http.MethodGet, "https://localhost/", nil)
 	w := httptest.NewRecorder()
@@ -537,7 +556,7 @@ func TestPutHandlerNeedsCert(t *testing.T) {
 	}
 
 	mgr := h.SecretsManager.(*local_utils.TestSecretsManager)
-	mgr.InsertOrUpdateSecretFn = func(ctx context.Context, name, value string) (string, local_utils.Change, error) {
+	mgr.InsertOrUpdateSecretFn = func(ctx context.Context, name, value string, metadata local_utils.Metadata) (string, local_utils.Change, error) {
 		return "", local_utils.Inserted, nil
 	}
 
@@ -575,6 +594,36 @@ func TestPutHandlerNeedsCert(t *testing.T) {
 	assert.Equal(t, "Inserted secret 0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7", strings.Trim(getBody(w), "\n\r"))
 }
 
+func TestRecordMetadata(t *testing.T) {
+	old := environment
+	environment = "staging"
+	defer func() { environment = old }()
+
+	pubkey := "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7"
+
+	h := MakeNewDummyHandlers()
+	var stored local_utils.Metadata
+	mgr := h.SecretsManager.(*local_utils.TestSecretsManager)
+	mgr.InsertOrUpdateSecretFn = func(ctx context.Context, name, value string, metadata local_utils.Metadata) (string, local_utils.Change, error) {
+		stored = metadata
+		return name, local_utils.Inserted, nil
+	}
+
+	_, err := h.storeSecret(context.Background(), &entities.Data{PubKey: pubkey, MacaroonHex: testMacaroon, ApiType: intPtr(int(api.ClnCommando))}, "id1")
+	assert.NoError(t, err)
+	assert.Equal(t, local_utils.Metadata{
+		"pubkey":     pubkey,
+		"unique-id":  "id1",
+		"env":        "staging",
+		"api-type":   "cln-commando",
+		"managed-by": "lightning-vault",
+	}, stored)
+
+	_, err = h.storeSecret(context.Background(), &entities.Data{PubKey: pubkey, MacaroonHex: testMacaroon}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, local_utils.Metadata{"pubkey": pubkey, "env": "staging", "managed-by": "lightning-vault"}, stored)
+}
+
 func TestExtractHostnameAndPort(t *testing.T) {
 	endpoint := "[::1]:1337"
 
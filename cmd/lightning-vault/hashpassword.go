@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	local_utils "github.com/bolt-observer/lightning-vault/utils"
+)
+
+// hashPasswordCommand implements "lightning-vault hash-password", password is read from the first line of in
+// and the entry is written to out (usage and errors go to errOut)
+func hashPasswordCommand(args []string, in io.Reader, out, errOut io.Writer) int {
+	fs := flag.NewFlagSet("hash-password", flag.ContinueOnError)
+	fs.SetOutput(errOut)
+
+	user := fs.String("user", "", "username the entry is for")
+	algorithm := fs.String("algorithm", string(local_utils.Argon2id), "hash algorithm (argon2id, scrypt or bcrypt)")
+
+	fs.Usage = func() {
+		fmt.Fprintf(errOut, "usage: echo -n password | lightning-vault hash-password -user=[string] -algorithm=[argon2id|scrypt|bcrypt]\n")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *user == "" || strings.ContainsAny(*user, local_utils.UserPassSeparator+local_utils.Delimiter) {
+		fmt.Fprintf(errOut, "invalid user %q\n", *user)
+		return 2
+	}
+
+	reader := bufio.NewReader(in)
+	password, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		fmt.Fprintf(errOut, "could not read password: %v\n", err)
+		return 1
+	}
+	password = strings.TrimRight(password, "\r\n")
+
+	if password == "" {
+		fmt.Fprintf(errOut, "empty password\n")
+		return 2
+	}
+
+	hash, err := local_utils.HashPassword(local_utils.HashAlgorithm(strings.ToLower(*algorithm)), password)
+	if err != nil {
+		fmt.Fprintf(errOut, "could not hash password: %v\n", err)
+		return 1
+	}
+
+	fmt.Fprintf(out, "%s\n", local_utils.EscapeEntry(*user+local_utils.UserPassSeparator+hash))
+	return 0
+}
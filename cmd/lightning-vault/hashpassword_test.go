@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	local_utils "github.com/bolt-observer/lightning-vault/utils"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashPasswordCommand(t *testing.T) {
+	prometheusInit()
+
+	out, errOut := new(bytes.Buffer), new(bytes.Buffer)
+	require.Equal(t, 0, hashPasswordCommand([]string{"-user", "user1"}, strings.NewReader("pass1\n"), out, errOut))
+
+	entry := strings.TrimRight(out.String(), "\n")
+	assert.True(t, strings.HasPrefix(entry, "user1|$argon2id$"))
+	assert.Contains(t, entry, `\,t=`)
+	assert.Empty(t, errOut.String())
+
+	out.Reset()
+	require.Equal(t, 0, hashPasswordCommand([]string{"-user", "user2", "-algorithm", "scrypt"}, strings.NewReader("pass2"), out, errOut))
+	entry2 := strings.TrimRight(out.String(), "\n")
+	assert.True(t, strings.HasPrefix(entry2, "user2|$scrypt$"))
+
+	// Output can be pasted into the configuration as is
+	credentials := toDict(local_utils.SplitEntries(entry + local_utils.Delimiter + entry2))
+	router := mux.NewRouter()
+	router.Use(authMiddleware(credentials))
+	router.Path("/").Methods(http.MethodGet).HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+
+	auth("user1", "pass1", http.StatusOK, router, t)
+	auth("user2", "pass2", http.StatusOK, router, t)
+
+	// Errors go to errOut
+	out.Reset()
+	assert.Equal(t, 2, hashPasswordCommand([]string{}, strings.NewReader("pass1\n"), out, errOut))
+	assert.Equal(t, 2, hashPasswordCommand([]string{"-user", "user1"}, strings.NewReader(""), out, errOut))
+	assert.Equal(t, 1, hashPasswordCommand([]string{"-user", "user1", "-algorithm", "md5"}, strings.NewReader("pass1\n"), out, errOut))
+	assert.Empty(t, out.String())
+	assert.Contains(t, errOut.String(), "could not hash password")
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	utils "github.com/bolt-observer/go_common/utils"
+	local_utils "github.com/bolt-observer/lightning-vault/utils"
+	sentry "github.com/getsentry/sentry-go"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// DefaultReadyTimeout is how long /readyz waits for the secrets manager
+	DefaultReadyTimeout = 2 * time.Second
+	// DefaultReadyCacheTTL is how long /readyz reuses the outcome of the secrets manager check
+	DefaultReadyCacheTTL = 10 * time.Second
+)
+
+// Health statuses
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+)
+
+// Names of readiness checks
+const (
+	CheckInitialLoad = "initial_load"
+	CheckBackend     = "backend"
+	CheckConfig      = "config"
+)
+
+var (
+	readyTimeout  = DefaultReadyTimeout
+	readyCacheTTL = DefaultReadyCacheTTL
+)
+
+// HealthCheck is the outcome of one readiness check
+type HealthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// HealthResult is the response of /healthz and /readyz
+type HealthResult struct {
+	Status  string        `json:"status"`
+	Version string        `json:"version"`
+	Checks  []HealthCheck `json:"checks,omitempty"`
+}
+
+func configureHealth() {
+	timeout, err := time.ParseDuration(utils.GetEnvWithDefault("READY_TIMEOUT", DefaultReadyTimeout.String()))
+	if err != nil {
+		fatalError("READY_TIMEOUT could not be parsed", err)
+	}
+
+	readyTimeout = timeout
+
+	ttl, err := time.ParseDuration(utils.GetEnvWithDefault("READY_CACHE_TTL", DefaultReadyCacheTTL.String()))
+	if err != nil {
+		fatalError("READY_CACHE_TTL could not be parsed", err)
+	}
+
+	readyCacheTTL = ttl
+}
+
+// validateConfig returns problems with the configuration that make the service useless (reported by /readyz)
+func validateConfig(credentials RouteCredentials) []string {
+	ret := make([]string, 0)
+
+	if len(credentials.Read) == 0 && len(credentials.Write) == 0 {
+		ret = append(ret, "no READ_API_KEY_* or WRITE_API_KEY configured")
+	}
+
+	_, err := strconv.ParseBool(utils.GetEnvWithDefault("VERIFY", "true"))
+	if err != nil {
+		ret = append(ret, "VERIFY is not a boolean")
+	}
+
+	return ret
+}
+
+// startLoading marks records as not (yet) available
+func (h *Handlers) startLoading() {
+	atomic.StoreInt32(&h.loading, 1)
+}
+
+// doneLoading marks records as available
+func (h *Handlers) doneLoading() {
+	atomic.StoreInt32(&h.loading, 0)
+}
+
+func (h *Handlers) isLoading() bool {
+	return atomic.LoadInt32(&h.loading) == 1
+}
+
+// loadingMiddleware rejects requests for records until the initial load is done
+func (h *Handlers) loadingMiddleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if h.isLoading() {
+				w.Header().Set("Retry-After", "5")
+				respondError(w, r, http.StatusServiceUnavailable, CodeUnavailable, "Initial load in progress")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// HealthHandler - /healthz route response (process is alive)
+func (h *Handlers) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	respondJSON(w, r, http.StatusOK, HealthResult{Status: StatusOK, Version: GitRevision}, HealthResult{Status: StatusOK, Version: GitRevision})
+}
+
+// ReadyHandler - /readyz route response (ready to serve requests)
+func (h *Handlers) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	result := HealthResult{Status: StatusOK, Version: GitRevision}
+	result.Checks = []HealthCheck{h.checkInitialLoad(), h.checkBackend(), h.checkConfig()}
+
+	status := http.StatusOK
+	for _, check := range result.Checks {
+		if !check.OK {
+			result.Status = StatusUnavailable
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	respondJSON(w, r, status, result, result)
+}
+
+func (h *Handlers) checkInitialLoad() HealthCheck {
+	if h.isLoading() {
+		return HealthCheck{Name: CheckInitialLoad, OK: false, Detail: "in progress"}
+	}
+
+	h.LookupMutex.RLock()
+	records := len(h.Lookup)
+	h.LookupMutex.RUnlock()
+
+	summary, ok := h.getLoadSummary()
+	if ok && !summary.Complete() {
+		return HealthCheck{Name: CheckInitialLoad, OK: true, Detail: fmt.Sprintf("%d record(s) loaded, %d secret(s) failed (see /admin/load)", records, summary.Failed)}
+	}
+
+	return HealthCheck{Name: CheckInitialLoad, OK: true, Detail: fmt.Sprintf("%d record(s) loaded", records)}
+}
+
+// checkBackend pings the secrets manager at most once per readyCacheTTL (/readyz is unauthenticated)
+func (h *Handlers) checkBackend() HealthCheck {
+	pinger, ok := h.SecretsManager.(local_utils.Pinger)
+	if !ok {
+		return HealthCheck{Name: CheckBackend, OK: true, Detail: "not checked"}
+	}
+
+	// Concurrent probes wait for the running check instead of starting their own
+	h.backendMutex.Lock()
+	defer h.backendMutex.Unlock()
+
+	if time.Since(h.backendCheckedAt) < readyCacheTTL {
+		return h.backendCheck
+	}
+
+	h.backendCheck = h.pingBackend(pinger)
+	h.backendCheckedAt = time.Now()
+
+	return h.backendCheck
+}
+
+func (h *Handlers) pingBackend(pinger local_utils.Pinger) HealthCheck {
+	ctx, cancel := context.WithTimeout(context.Background(), readyTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := pinger.Ping(ctx)
+	if err != nil {
+		// The error can name accounts, projects and endpoints, /readyz is not authenticated
+		glog.Warningf("[Ready] secrets manager unreachable: %v", err)
+		sentry.CaptureException(err)
+		return HealthCheck{Name: CheckBackend, OK: false, Detail: "secrets manager unreachable"}
+	}
+
+	return HealthCheck{Name: CheckBackend, OK: true, Detail: fmt.Sprintf("reachable in %v", time.Since(start).Round(time.Millisecond))}
+}
+
+func (h *Handlers) checkConfig() HealthCheck {
+	if len(h.configProblems) > 0 {
+		return HealthCheck{Name: CheckConfig, OK: false, Detail: strings.Join(h.configProblems, "; ")}
+	}
+
+	return HealthCheck{Name: CheckConfig, OK: true}
+}
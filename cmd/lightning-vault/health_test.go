@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	local_utils "github.com/bolt-observer/lightning-vault/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readiness(t *testing.T, h *Handlers) (int, HealthResult) {
+	r := httptest.NewRequest(http.MethodGet, "https://localhost/readyz", nil)
+	w := httptest.NewRecorder()
+	h.ReadyHandler(w, r)
+
+	var result HealthResult
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	return w.Code, result
+}
+
+func TestHealthHandler(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "https://localhost/healthz", nil)
+	w := httptest.NewRecorder()
+
+	h := MakeNewDummyHandlers()
+	h.startLoading()
+	h.HealthHandler(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var result HealthResult
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, StatusOK, result.Status)
+}
+
+func TestReadyHandler(t *testing.T) {
+	prometheusInit()
+
+	h := MakeNewDummyHandlers()
+	mgr := h.SecretsManager.(*local_utils.TestSecretsManager)
+
+	pings := 0
+	mgr.PingFn = func(ctx context.Context) error {
+		pings++
+		return nil
+	}
+
+	code, result := readiness(t, h)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, StatusOK, result.Status)
+	assert.Equal(t, []string{CheckInitialLoad, CheckBackend, CheckConfig}, []string{result.Checks[0].Name, result.Checks[1].Name, result.Checks[2].Name})
+
+	// Records are not served while loading
+	h.startLoading()
+	code, result = readiness(t, h)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, StatusUnavailable, result.Status)
+	assert.False(t, result.Checks[0].OK)
+
+	w := call(v1Router(h), http.MethodGet, "/v1/get/0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7", "reader", "")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "5", w.Header().Get("Retry-After"))
+	response := decodeEnvelope(t, w, nil)
+	assert.Equal(t, CodeUnavailable, response.Error.Code)
+
+	h.doneLoading()
+	code, _ = readiness(t, h)
+	assert.Equal(t, http.StatusOK, code)
+
+	// The backend check is cached
+	assert.Equal(t, 1, pings)
+
+	// Backend unreachable
+	h.backendCheckedAt = time.Time{}
+	mgr.PingFn = func(ctx context.Context) error {
+		_, ok := ctx.Deadline()
+		assert.True(t, ok)
+		return fmt.Errorf("connection refused")
+	}
+	code, result = readiness(t, h)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, result.Checks[1].OK)
+	assert.Equal(t, "secrets manager unreachable", result.Checks[1].Detail)
+	mgr.PingFn = nil
+	h.backendCheckedAt = time.Time{}
+
+	// Invalid configuration
+	h.configProblems = validateConfig(RouteCredentials{})
+	code, result = readiness(t, h)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, result.Checks[2].OK)
+}
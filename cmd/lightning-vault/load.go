@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	entities "github.com/bolt-observer/go_common/entities"
+	utils "github.com/bolt-observer/go_common/utils"
+	local_utils "github.com/bolt-observer/lightning-vault/utils"
+	backoff "github.com/cenkalti/backoff/v4"
+	sentry "github.com/getsentry/sentry-go"
+	"github.com/golang/glog"
+)
+
+// LoadPolicy decides what happens when secrets fail to load at startup
+type LoadPolicy string
+
+// Load policies
+const (
+	// LoadPolicyFail - startup fails
+	LoadPolicyFail LoadPolicy = "fail"
+	// LoadPolicyRetry - loading is retried with backoff (for up to LOAD_RETRY_MAX), then startup fails
+	LoadPolicyRetry LoadPolicy = "retry"
+	// LoadPolicyPartial - whatever could be loaded is served
+	LoadPolicyPartial LoadPolicy = "partial"
+)
+
+// DefaultLoadRetryMax is how long secrets are reloaded with LoadPolicyRetry
+const DefaultLoadRetryMax = 5 * time.Minute
+
+// States of loaded secrets (see LoadSummary)
+const (
+	LoadStateLoaded  = "loaded"
+	LoadStateFailed  = "failed"
+	LoadStateIgnored = "ignored"
+)
+
+var (
+	loadPolicy   = LoadPolicyPartial
+	loadRetryMax = DefaultLoadRetryMax
+)
+
+// LoadFailure is a secret that could not be loaded
+type LoadFailure struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// LoadSummary is the outcome of the initial load
+type LoadSummary struct {
+	Policy     LoadPolicy    `json:"policy"`
+	StartedAt  time.Time     `json:"started_at"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+	Attempts   int           `json:"attempts"`
+	Loaded     int           `json:"loaded"`
+	Failed     int           `json:"failed"`
+	Ignored    int           `json:"ignored"`
+	ListError  string        `json:"list_error,omitempty"`
+	Failures   []LoadFailure `json:"failures"`
+}
+
+// Complete returns true when nothing failed
+func (s *LoadSummary) Complete() bool {
+	return s.Failed == 0 && s.ListError == ""
+}
+
+func (s *LoadSummary) fail(name, reason string) {
+	s.Failed++
+	s.Failures = append(s.Failures, LoadFailure{Name: name, Reason: reason})
+}
+
+func configureLoading() {
+	policy := LoadPolicy(strings.ToLower(utils.GetEnvWithDefault("LOAD_FAILURE_POLICY", string(LoadPolicyPartial))))
+	switch policy {
+	case LoadPolicyFail, LoadPolicyRetry, LoadPolicyPartial:
+		loadPolicy = policy
+	default:
+		fatalError(fmt.Sprintf("LOAD_FAILURE_POLICY %q is invalid (fail, retry or partial)", policy), nil)
+	}
+
+	retryMax, err := time.ParseDuration(utils.GetEnvWithDefault("LOAD_RETRY_MAX", DefaultLoadRetryMax.String()))
+	if err != nil {
+		fatalError("LOAD_RETRY_MAX could not be parsed", err)
+	}
+
+	loadRetryMax = retryMax
+}
+
+func (h *Handlers) initialLoad() {
+	glog.Info("Initial load of keys from secrets manager...")
+	ctx := context.Background()
+
+	summary := h.loadRecords(ctx)
+
+	if !summary.Complete() {
+		glog.Warningf("Initial load: %d secret(s) loaded, %d failed, %d ignored", summary.Loaded, summary.Failed, summary.Ignored)
+		sentry.CaptureMessage(fmt.Sprintf("Initial load: %d secret(s) failed to load", summary.Failed))
+
+		if loadPolicy != LoadPolicyPartial {
+			fatalError(fmt.Sprintf("Initial load failed (policy %s)", loadPolicy), nil)
+			return
+		}
+	}
+
+	h.loadChangeRequests(ctx)
+
+	if h.fixturesDir != "" {
+		h.seedFixtures(ctx, h.fixturesDir)
+	}
+
+	glog.Info("Initial load of keys from secrets manager... done")
+
+	if os.Getenv("DUMP") != "" {
+		for node := range h.allNodes() {
+			dump(node)
+		}
+	}
+}
+
+// loadSecrets fetches all secrets, retrying on failures when the policy says so
+func (h *Handlers) loadSecrets(ctx context.Context, summary *LoadSummary) (map[string]string, error) {
+	back := backoff.NewExponentialBackOff()
+	back.MaxElapsedTime = loadRetryMax
+
+	for {
+		summary.Attempts++
+		secrets, err := h.SecretsManager.LoadSecrets(ctx, prefix)
+		if err == nil || loadPolicy != LoadPolicyRetry {
+			return secrets, err
+		}
+
+		wait := back.NextBackOff()
+		if wait == backoff.Stop {
+			return secrets, err
+		}
+
+		glog.Warningf("Loading secrets failed (attempt %d), retrying in %v: %v", summary.Attempts, wait, err)
+		time.Sleep(wait)
+	}
+}
+
+// loadRecords loads all records into the lookup
+func (h *Handlers) loadRecords(ctx context.Context) LoadSummary {
+	summary := LoadSummary{Policy: loadPolicy, StartedAt: time.Now(), Failures: make([]LoadFailure, 0)}
+
+	secrets, err := h.loadSecrets(ctx, &summary)
+	if err != nil {
+		var loadErr *local_utils.LoadError
+		if errors.As(err, &loadErr) {
+			if loadErr.ListErr != nil {
+				summary.ListError = loadErr.ListErr.Error()
+			}
+			for _, secret := range loadErr.Secrets {
+				summary.fail(secret.Name, secret.Err.Error())
+			}
+		} else {
+			summary.ListError = err.Error()
+		}
+	}
+
+	for k, v := range secrets {
+		if v == "{}" {
+			glog.Infof("Ignoring empty secret: %v\n", k)
+			summary.Ignored++
+			continue
+		}
+		var data entities.Data
+		err := json.Unmarshal([]byte(v), &data)
+		if err != nil || !utils.ValidatePubkey(data.PubKey) {
+			sentry.CaptureMessage(fmt.Sprintf("Error unmarshaling secrets: %v", k))
+			glog.Warningf("Error unmarshalling secret %v: %v\n", k, err)
+			if err == nil {
+				err = fmt.Errorf("invalid pubkey %q", data.PubKey)
+			}
+			summary.fail(k, fmt.Sprintf("invalid record: %v", err))
+			continue
+		}
+
+		keys := strings.Split(k, "_")
+		if len(keys) != 3 && len(keys) != 2 {
+			sentry.CaptureMessage(fmt.Sprintf("Invalid key: %v", k))
+			glog.Warningf("Invalid key %v\n", k)
+			summary.fail(k, "invalid name")
+			continue
+		}
+
+		if len(keys[1]) < utils.PUBKEY_LEN || keys[1][0:utils.PUBKEY_LEN] != data.PubKey {
+			sentry.CaptureMessage(fmt.Sprintf("Invalid key: %v vs %v", k, data.PubKey))
+			glog.Warningf("Invalid key %v vs. %v\n", k, data.PubKey)
+			summary.fail(k, fmt.Sprintf("name does not match pubkey %s", data.PubKey))
+			continue
+		}
+
+		h.toLookup(data, keys[1][66:])
+		summary.Loaded++
+	}
+
+	sort.Slice(summary.Failures, func(i, j int) bool {
+		return summary.Failures[i].Name < summary.Failures[j].Name
+	})
+
+	finished := time.Now()
+	summary.FinishedAt = &finished
+
+	metrics.Secrets(loadLabels{State: LoadStateLoaded}).Set(float64(summary.Loaded))
+	metrics.Secrets(loadLabels{State: LoadStateFailed}).Set(float64(summary.Failed))
+	metrics.Secrets(loadLabels{State: LoadStateIgnored}).Set(float64(summary.Ignored))
+
+	h.setLoadSummary(summary)
+	return summary
+}
+
+func (h *Handlers) setLoadSummary(summary LoadSummary) {
+	h.loadMutex.Lock()
+	defer h.loadMutex.Unlock()
+
+	h.loadSummary = &summary
+}
+
+func (h *Handlers) getLoadSummary() (LoadSummary, bool) {
+	h.loadMutex.Lock()
+	defer h.loadMutex.Unlock()
+
+	if h.loadSummary == nil {
+		return LoadSummary{}, false
+	}
+
+	return *h.loadSummary, true
+}
+
+// LoadSummaryHandler - returns the outcome of the initial load
+func (h *Handlers) LoadSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	summary, ok := h.getLoadSummary()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+
+	auditLog(r.Header.Get("Authorization"), r.RemoteAddr, "Load summary", r.Method)
+	respondJSON(w, r, http.StatusOK, summary, summary)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	entities "github.com/bolt-observer/go_common/entities"
+	local_utils "github.com/bolt-observer/lightning-vault/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func withLoadPolicy(t *testing.T, policy LoadPolicy) {
+	old := loadPolicy
+	loadPolicy = policy
+	t.Cleanup(func() { loadPolicy = old })
+}
+
+func TestLoadRecords(t *testing.T) {
+	prometheusInit()
+	freshAuthThrottle(t)
+	withLoadPolicy(t, LoadPolicyPartial)
+
+	pubkey := "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7"
+	value, err := encodeRecord(&entities.Data{PubKey: pubkey, MacaroonHex: testMacaroon, Endpoint: "127.0.0.1:10009"})
+	require.NoError(t, err)
+
+	h := MakeNewDummyHandlers()
+	mgr := h.SecretsManager.(*local_utils.TestSecretsManager)
+	mgr.LoadSecretsFn = func(ctx context.Context, prefix string) (map[string]string, error) {
+		loadErr := &local_utils.LoadError{}
+		loadErr.Add("_broken_", fmt.Errorf("access denied"))
+
+		return map[string]string{
+			"_" + pubkey + "_":      value,
+			"_" + pubkey + "id1_":   value,
+			"_" + pubkey + "gone_":  "{}",
+			"_" + pubkey + "junk_":  "junk",
+			"_02" + pubkey[2:] + "": value,
+		}, loadErr
+	}
+
+	summary := h.loadRecords(context.Background())
+	assert.Equal(t, 2, summary.Loaded)
+	assert.Equal(t, 3, summary.Failed)
+	assert.Equal(t, 1, summary.Ignored)
+	assert.Equal(t, 1, summary.Attempts)
+	assert.False(t, summary.Complete())
+	assert.NotNil(t, summary.FinishedAt)
+	assert.Equal(t, []LoadFailure{
+		{Name: "_02" + pubkey[2:], Reason: "name does not match pubkey " + pubkey},
+		{Name: "_" + pubkey + "junk_", Reason: summary.Failures[1].Reason},
+		{Name: "_broken_", Reason: "access denied"},
+	}, summary.Failures)
+
+	_, ok := h.lookup(pubkey)
+	assert.True(t, ok)
+	_, ok = h.lookup(pubkey + "id1")
+	assert.True(t, ok)
+
+	router := v1Router(h)
+	w := call(router, http.MethodGet, "/v1/admin/load", "admin", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var result LoadSummary
+	decodeEnvelope(t, w, &result)
+	assert.Equal(t, LoadPolicyPartial, result.Policy)
+	assert.Equal(t, 3, result.Failed)
+	assert.Len(t, result.Failures, 3)
+
+	w = call(router, http.MethodGet, "/v1/admin/load", "writer", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = call(v1Router(MakeNewDummyHandlers()), http.MethodGet, "/v1/admin/load", "admin", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestLoadRecordsRetry(t *testing.T) {
+	prometheusInit()
+	withLoadPolicy(t, LoadPolicyRetry)
+
+	h := MakeNewDummyHandlers()
+	mgr := h.SecretsManager.(*local_utils.TestSecretsManager)
+	attempts := 0
+	mgr.LoadSecretsFn = func(ctx context.Context, prefix string) (map[string]string, error) {
+		attempts++
+		if attempts == 1 {
+			return map[string]string{}, &local_utils.LoadError{ListErr: fmt.Errorf("throttled")}
+		}
+		return map[string]string{}, nil
+	}
+
+	summary := h.loadRecords(context.Background())
+	assert.Equal(t, 2, summary.Attempts)
+	assert.True(t, summary.Complete())
+	assert.Empty(t, summary.Failures)
+}
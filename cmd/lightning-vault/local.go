@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	utils "github.com/bolt-observer/go_common/utils"
+	local_utils "github.com/bolt-observer/lightning-vault/utils"
+	"github.com/golang/glog"
+)
+
+// MakeNewLocalHandlers - creates new Handlers for ENV=local (secrets are kept in memory or LOCAL_SECRETS_FILE)
+func MakeNewLocalHandlers() *Handlers {
+	r := MakeNewDummyHandlers()
+
+	secrets := local_utils.NewDummySecretsManager()
+	if file := utils.GetEnvWithDefault("LOCAL_SECRETS_FILE", ""); file != "" {
+		var err error
+		secrets, err = local_utils.NewDummySecretsManagerWithFile(file)
+		if err != nil {
+			fatalError("LOCAL_SECRETS_FILE could not be read", err)
+		}
+	}
+
+	r.SecretsManager = secrets
+	r.fixturesDir = utils.GetEnvWithDefault("LOCAL_FIXTURES_DIR", "")
+	return r
+}
+
+// readFixtures returns records from all .json files in dir (a file holds one record or a list of them)
+func readFixtures(dir string) ([]BulkPutItem, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	ret := make([]BulkPutItem, 0)
+	for _, file := range files {
+		contents, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		items := make([]BulkPutItem, 0)
+		contents = bytes.TrimSpace(contents)
+		if bytes.HasPrefix(contents, []byte("[")) {
+			err = json.Unmarshal(contents, &items)
+		} else {
+			var item BulkPutItem
+			err = json.Unmarshal(contents, &item)
+			items = append(items, item)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid fixture %s: %w", file, err)
+		}
+
+		ret = append(ret, items...)
+	}
+
+	return ret, nil
+}
+
+// seedFixtures stores records from dir that do not exist yet and returns how many were stored
+func (h *Handlers) seedFixtures(ctx context.Context, dir string) int {
+	items, err := readFixtures(dir)
+	if err != nil {
+		glog.Warningf("Could not read fixtures: %v", err)
+		return 0
+	}
+
+	seeded := 0
+	for _, item := range items {
+		if !utils.ValidatePubkey(item.PubKey) || (item.UniqueID != "" && !utils.AlphaNumeric.MatchString(item.UniqueID)) {
+			glog.Warningf("Ignoring fixture with invalid pubkey %q or uniqueId %q", item.PubKey, item.UniqueID)
+			continue
+		}
+
+		// Records changed or deleted while running locally are kept
+		name := secretName(prefix, item.PubKey, item.UniqueID)
+		existing, err := h.SecretsManager.LoadSecrets(ctx, name)
+		if err != nil {
+			glog.Warningf("Could not check fixture %s (%s): %v", item.PubKey, item.UniqueID, err)
+			continue
+		}
+		if _, ok := existing[name]; ok {
+			continue
+		}
+
+		data := item.Data
+		if reqErr := validateRecord(&data, "Seed"); reqErr != nil {
+			glog.Warningf("Ignoring invalid fixture %s (%s): %s", item.PubKey, item.UniqueID, reqErr.LogReason)
+			continue
+		}
+
+		h.RecordMutex.Lock()
+		_, err = h.storeSecret(ctx, &data, item.UniqueID)
+		h.RecordMutex.Unlock()
+		if err != nil {
+			glog.Warningf("Could not store fixture %s (%s): %v", item.PubKey, item.UniqueID, err)
+			continue
+		}
+		seeded++
+	}
+
+	glog.Infof("Seeded %d record(s) from %s", seeded, dir)
+	return seeded
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalHandlers(t *testing.T) {
+	prometheusInit()
+	freshAuthThrottle(t)
+	withLoadPolicy(t, LoadPolicyPartial)
+
+	pubkey := "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7"
+	record := `{"pubkey": "` + pubkey + `", "macaroon_hex": "` + testMacaroon + `", "endpoint": "127.0.0.1:10009"`
+
+	dir := t.TempDir()
+	fixtures := filepath.Join(dir, "fixtures")
+	require.NoError(t, os.Mkdir(fixtures, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(fixtures, "alice.json"), []byte(record+`}`), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(fixtures, "more.json"), []byte(`[`+record+`, "unique_id": "bob"}, `+record+`, "unique_id": "carol"}, `+record+`, "unique_id": "dave", "api_type": 7}, {"pubkey": "invalid"}]`), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(fixtures, "README.md"), []byte("not a fixture"), 0o644))
+
+	t.Setenv("LOCAL_SECRETS_FILE", filepath.Join(dir, "secrets.json"))
+	t.Setenv("LOCAL_FIXTURES_DIR", fixtures)
+
+	h := MakeNewLocalHandlers()
+	h.initialLoad()
+	for _, key := range []string{pubkey, pubkey + "bob", pubkey + "carol"} {
+		_, ok := h.lookup(key)
+		assert.True(t, ok, key)
+	}
+
+	// Invalid records are not seeded
+	_, ok := h.lookup(pubkey + "dave")
+	assert.False(t, ok)
+
+	w := call(v1Router(h), http.MethodDelete, "/v1/delete/bob/"+pubkey, "writer", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Restart keeps the deletion and does not seed the record again
+	h = MakeNewLocalHandlers()
+	h.initialLoad()
+	_, ok = h.lookup(pubkey + "bob")
+	assert.False(t, ok)
+	_, ok = h.lookup(pubkey + "carol")
+	assert.True(t, ok)
+	assert.Equal(t, 0, h.seedFixtures(context.Background(), fixtures))
+
+	require.NoError(t, os.WriteFile(filepath.Join(fixtures, "broken.json"), []byte("{"), 0o644))
+	assert.Equal(t, 0, h.seedFixtures(context.Background(), fixtures))
+}
@@ -20,7 +20,6 @@ import (
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
-	"golang.org/x/crypto/bcrypt"
 
 	sentry "github.com/getsentry/sentry-go"
 )
@@ -80,19 +79,33 @@ var (
 	GitRevision = "unknownVersion"
 )
 
+// lookup returns the record for pubkey + uniqueID (see resolve for aliases)
+func (h *Handlers) lookup(key string) (entities.Data, bool) {
+	h.LookupMutex.RLock()
+	defer h.LookupMutex.RUnlock()
+
+	data, ok := h.Lookup[key]
+	return data, ok
+}
+
 func (h *Handlers) toLookup(data entities.Data, uniqueID string) {
-	if data.Tags != "" {
-		for _, v := range strings.Split(data.Tags, local_utils.Delimiter) {
-			if !utils.ValidatePubkey(v) && !utils.ValidatePubkey(v+uniqueID) && utils.AlphaNumeric.MatchString(v) {
-				old, exists := h.Lookup[v+uniqueID]
-				if exists && old.PubKey != data.PubKey {
-					glog.Warningf("Key already exists %s", v+uniqueID)
-					continue
-				}
+	h.LookupMutex.Lock()
+	defer h.LookupMutex.Unlock()
 
-				h.Lookup[v+uniqueID] = data
-			}
+	old, exists := h.Lookup[data.PubKey+uniqueID]
+	if exists {
+		h.dropAliases(old, uniqueID)
+	}
+
+	for _, alias := range aliasesOf(data) {
+		key := aliasKey{Alias: alias, UniqueID: uniqueID}
+		pubkey, exists := h.aliases[key]
+		if exists && pubkey != data.PubKey {
+			glog.Warningf("Alias %s (%s) already used by %s, ignoring it for %s", alias, uniqueID, pubkey, data.PubKey)
+			continue
 		}
+
+		h.aliases[key] = data.PubKey
 	}
 
 	h.Lookup[data.PubKey+uniqueID] = data
@@ -108,10 +121,17 @@ func (h *Handlers) allNodes() <-chan NodeData {
 	glog.Info("All nodes")
 	ch := make(chan NodeData)
 
+	h.LookupMutex.RLock()
+	snapshot := make(map[string]entities.Data, len(h.Lookup))
+	for k, v := range h.Lookup {
+		snapshot[k] = v
+	}
+	h.LookupMutex.RUnlock()
+
 	go func() {
 		defer close(ch)
 
-		for k, v := range h.Lookup {
+		for k, v := range snapshot {
 			if len(k) < utils.PUBKEY_LEN {
 				continue
 			}
@@ -132,60 +152,13 @@ func (h *Handlers) allNodes() <-chan NodeData {
 }
 
 func (h *Handlers) deleteLookup(data entities.Data, uniqueID string) {
-	if data.Tags != "" {
-		for _, v := range strings.Split(data.Tags, local_utils.Delimiter) {
-			if !utils.ValidatePubkey(v) && !utils.ValidatePubkey(v+uniqueID) && utils.AlphaNumeric.MatchString(v) {
-				delete(h.Lookup, v+uniqueID)
-			}
-		}
-	}
+	h.LookupMutex.Lock()
+	defer h.LookupMutex.Unlock()
 
+	h.dropAliases(data, uniqueID)
 	delete(h.Lookup, data.PubKey+uniqueID)
 }
 
-func (h *Handlers) initialLoad() {
-	glog.Info("Initial load of keys from secrets manager...")
-	ctx := context.Background()
-	secrets := h.SecretsManager.LoadSecrets(ctx, prefix)
-
-	for k, v := range secrets {
-		if v == "{}" {
-			glog.Infof("Ignoring empty secret: %v\n", k)
-			continue
-		}
-		var data entities.Data
-		err := json.Unmarshal([]byte(v), &data)
-		if err != nil || !utils.ValidatePubkey(data.PubKey) {
-			sentry.CaptureMessage(fmt.Sprintf("Error unmarshaling secrets: %v", k))
-			glog.Warningf("Error unmarshalling secret %v: %v\n", k, err)
-			continue
-		}
-
-		keys := strings.Split(k, "_")
-		if len(keys) != 3 && len(keys) != 2 {
-			sentry.CaptureMessage(fmt.Sprintf("Invalid key: %v", k))
-			glog.Warningf("Invalid key %v\n", k)
-			continue
-		}
-
-		if len(keys[1]) < utils.PUBKEY_LEN || keys[1][0:utils.PUBKEY_LEN] != data.PubKey {
-			sentry.CaptureMessage(fmt.Sprintf("Invalid key: %v vs %v", k, data.PubKey))
-			glog.Warningf("Invalid key %v vs. %v\n", k, data.PubKey)
-			continue
-		}
-
-		h.toLookup(data, keys[1][66:])
-	}
-
-	glog.Info("Initial load of keys from secrets manager... done")
-
-	if os.Getenv("DUMP") != "" {
-		for node := range h.allNodes() {
-			dump(node)
-		}
-	}
-}
-
 func dump(data NodeData) error {
 	file, err := os.Create(fmt.Sprintf("%s_%s.json", data.Data.PubKey, data.UniqueID))
 	if err != nil {
@@ -205,10 +178,20 @@ func dump(data NodeData) error {
 
 var (
 	readDurations map[string]time.Duration
+	environment   string
 	prefix        string
 )
 
+// envPrefix returns the secret name prefix of environment env
+func envPrefix(env string) string {
+	return fmt.Sprintf("%s%s", env, "macaroon")
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		os.Exit(hashPasswordCommand(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	}
+
 	initalize()
 
 	env := utils.GetEnvWithDefault("ENV", "")
@@ -216,11 +199,13 @@ func main() {
 
 	fmt.Printf("Macaroon service %s (env: %s) started\n", GitRevision, env)
 	godotenv.Load()
-	prefix = fmt.Sprintf("%s%s", env, "macaroon")
+	environment = env
+	prefix = envPrefix(env)
+	approvalPrefix = fmt.Sprintf("%s%s", env, "approval")
 
 	if strings.ToLower(env) == "local" {
-		h := MakeNewDummyHandlers()
-		h.httpListen(false)
+		h := MakeNewLocalHandlers()
+		h.httpListen(true)
 	} else {
 		h := MakeNewHandlers()
 		h.httpListen(true)
@@ -230,25 +215,42 @@ func main() {
 func (h *Handlers) httpListen(load bool) {
 	readDurations = make(map[string]time.Duration)
 
-	for _, key := range strings.Split(utils.GetEnv("READ_API_KEY_10M"), local_utils.Delimiter) {
+	for _, key := range local_utils.SplitEntries(utils.GetEnv("READ_API_KEY_10M")) {
 		readDurations[key] = time.Minute * 10
 	}
-	for _, key := range strings.Split(utils.GetEnv("READ_API_KEY_1H"), local_utils.Delimiter) {
+	for _, key := range local_utils.SplitEntries(utils.GetEnv("READ_API_KEY_1H")) {
 		readDurations[key] = time.Hour
 	}
-	for _, key := range strings.Split(utils.GetEnv("READ_API_KEY_1D"), local_utils.Delimiter) {
+	for _, key := range local_utils.SplitEntries(utils.GetEnv("READ_API_KEY_1D")) {
 		readDurations[key] = time.Hour * 24
 	}
 
-	writeAPIKeys := strings.Split(utils.GetEnv("WRITE_API_KEY"), local_utils.Delimiter)
+	writeAPIKeys := local_utils.SplitEntries(utils.GetEnv("WRITE_API_KEY"))
 	port := utils.GetEnvWithDefault("PORT", "1339")
 
+	configureThrottling()
+	configureApprovals()
+	configureHealth()
+	configureLoading()
+	configureDeletion()
+	configureCertMonitoring()
+	configureVerification()
+
 	if load {
-		h.initialLoad()
+		// Not ready (see /readyz) until records are loaded
+		h.startLoading()
+		go func() {
+			defer h.doneLoading()
+			h.initialLoad()
+			go h.monitorCertificates()
+			go h.monitorVerification()
+		}()
 	}
 
 	router := mux.NewRouter().StrictSlash(false)
+	router.Use(peerMiddleware())
 	router.Use(handlers.ProxyHeaders)
+	router.Use(requestIDMiddleware())
 	router.Use(recoveryMiddleware())
 
 	registerPrometheusHandler(router)
@@ -262,40 +264,36 @@ func (h *Handlers) httpListen(load bool) {
 		return
 	}
 
-	router.Path("/").HandlerFunc(h.MainHandler).Methods(http.MethodGet)
+	checkPlaintextPasswords(utils.GetKeys(readDurations), writeAPIKeys)
+	checkIdentityEntries(utils.GetKeys(readDurations), writeAPIKeys)
 
-	readRoutes := router.PathPrefix("/get/").Subrouter()
-	readRoutes.Use(authMiddleware(toDict(utils.GetKeys(readDurations))))
-	writeRoutes := router.PathPrefix("/put/").Subrouter()
-	writeRoutes.Use(authMiddleware(toDict(writeAPIKeys)))
-	deleteRoutes := router.PathPrefix("/delete/").Subrouter()
-	deleteRoutes.Use(authMiddleware(toDict(writeAPIKeys)))
-	verifyRoutes := router.PathPrefix("/verify/").Subrouter()
-	verifyRoutes.Use(authMiddleware(toDict(writeAPIKeys)))
+	router.Path("/").HandlerFunc(h.MainHandler).Methods(http.MethodGet)
+	router.Path("/openapi.json").HandlerFunc(h.OpenAPIHandler).Methods(http.MethodGet)
+	router.Path("/healthz").HandlerFunc(h.HealthHandler).Methods(http.MethodGet)
+	router.Path("/readyz").HandlerFunc(h.ReadyHandler).Methods(http.MethodGet)
 
 	keys := make([]string, 0)
 	keys = append(keys, utils.GetKeys(readDurations)...)
 	keys = append(keys, writeAPIKeys...)
-	queryRoutes := router.PathPrefix("/query/").Subrouter()
-	queryRoutes.Use(authMiddleware(toDict(keys)))
-
-	writeRoutes.Path("/").HandlerFunc(h.PutHandler).Methods(http.MethodPost)
-	writeRoutes.Path("/{uniqueId}").HandlerFunc(h.PutHandler).Methods(http.MethodPost)
 
-	writeRoutes.Path("/{pubkey}").HandlerFunc(h.DeleteHandler).Methods(http.MethodDelete)
-	writeRoutes.Path("/{uniqueId}/{pubkey}").HandlerFunc(h.DeleteHandler).Methods(http.MethodDelete)
-
-	deleteRoutes.Path("/{pubkey}").HandlerFunc(h.DeleteHandler).Methods(http.MethodPost, http.MethodDelete)
-	deleteRoutes.Path("/{uniqueId}/{pubkey}").HandlerFunc(h.DeleteHandler).Methods(http.MethodPost, http.MethodDelete)
+	credentials := RouteCredentials{
+		Read:       toDict(utils.GetKeys(readDurations)),
+		Write:      toDict(writeAPIKeys),
+		Query:      toDict(keys),
+		BreakGlass: h.configureBreakGlass(utils.GetKeys(readDurations), writeAPIKeys, adminAPIKeys()),
+		Admin:      configureAdmin(),
+	}
 
-	readRoutes.Path("/{pubkey}").HandlerFunc(h.GetHandler).Methods(http.MethodPost, http.MethodGet)
-	readRoutes.Path("/{uniqueId}/{pubkey}").HandlerFunc(h.GetHandler).Methods(http.MethodPost, http.MethodGet)
+	h.configProblems = validateConfig(credentials)
+	for _, problem := range h.configProblems {
+		glog.Warningf("Configuration problem: %s", problem)
+	}
 
-	queryRoutes.Path("/{pubkey}").HandlerFunc(h.QueryHandler).Methods(http.MethodPost, http.MethodGet)
-	queryRoutes.Path("/{uniqueId}/{pubkey}").HandlerFunc(h.QueryHandler).Methods(http.MethodPost, http.MethodGet)
+	h.registerRoutes(router, credentials)
 
-	verifyRoutes.Path("/{pubkey}").HandlerFunc(h.VerifyHandler).Methods(http.MethodPost, http.MethodGet)
-	verifyRoutes.Path("/{uniqueId}/{pubkey}").HandlerFunc(h.VerifyHandler).Methods(http.MethodPost, http.MethodGet)
+	v1Routes := router.PathPrefix("/" + APIVersion).Subrouter()
+	v1Routes.Use(versionMiddleware(APIVersion))
+	h.registerRoutes(v1Routes, credentials)
 
 	timeout := utils.GetEnvWithDefault("TIMEOUT", "10")
 	timeoutInt, err := strconv.Atoi(timeout)
@@ -320,6 +318,86 @@ func (h *Handlers) httpListen(load bool) {
 	sentry.Flush(time.Second * 1)
 }
 
+// RouteCredentials are the users (or IAM globs) of each role
+type RouteCredentials struct {
+	Read       map[string]string
+	Write      map[string]string
+	Query      map[string]string
+	BreakGlass map[string]string
+	Admin      map[string]string
+}
+
+// registerRoutes registers the API on router (called for the old routes and for /v1/)
+func (h *Handlers) registerRoutes(parent *mux.Router, credentials RouteCredentials) {
+	// Records are not served until the initial load is done
+	router := parent.NewRoute().Subrouter()
+	router.Use(h.loadingMiddleware())
+
+	readRoutes := router.PathPrefix("/get/").Subrouter()
+	readRoutes.Use(authMiddleware(credentials.Read))
+	readRoutes.Use(rateLimitMiddleware(getLimiter))
+	writeRoutes := router.PathPrefix("/put/").Subrouter()
+	writeRoutes.Use(authMiddleware(credentials.Write))
+	deleteRoutes := router.PathPrefix("/delete/").Subrouter()
+	deleteRoutes.Use(authMiddleware(credentials.Write))
+	verifyRoutes := router.PathPrefix("/verify/").Subrouter()
+	verifyRoutes.Use(authMiddleware(credentials.Write))
+
+	approvalRoutes := router.PathPrefix("/approval/").Subrouter()
+	approvalRoutes.Use(authMiddleware(credentials.Write))
+
+	tagRoutes := router.PathPrefix("/tags/").Subrouter()
+	tagRoutes.Use(authMiddleware(credentials.Write))
+
+	queryRoutes := router.PathPrefix("/query/").Subrouter()
+	queryRoutes.Use(authMiddleware(credentials.Query))
+	aliasRoutes := router.PathPrefix("/alias/").Subrouter()
+	aliasRoutes.Use(authMiddleware(credentials.Query))
+
+	writeRoutes.Path("/").HandlerFunc(h.PutHandler).Methods(http.MethodPost)
+	// Needs to be registered before /{uniqueId}
+	writeRoutes.Path("/bulk").HandlerFunc(h.BulkPutHandler).Methods(http.MethodPost)
+	writeRoutes.Path("/{uniqueId}").HandlerFunc(h.PutHandler).Methods(http.MethodPost)
+
+	writeRoutes.Path("/{pubkey}").HandlerFunc(h.PatchHandler).Methods(http.MethodPatch)
+	writeRoutes.Path("/{uniqueId}/{pubkey}").HandlerFunc(h.PatchHandler).Methods(http.MethodPatch)
+
+	writeRoutes.Path("/{pubkey}").HandlerFunc(h.DeleteHandler).Methods(http.MethodDelete)
+	writeRoutes.Path("/{uniqueId}/{pubkey}").HandlerFunc(h.DeleteHandler).Methods(http.MethodDelete)
+
+	deleteRoutes.Path("/{pubkey}").HandlerFunc(h.DeleteHandler).Methods(http.MethodPost, http.MethodDelete)
+	deleteRoutes.Path("/{uniqueId}/{pubkey}").HandlerFunc(h.DeleteHandler).Methods(http.MethodPost, http.MethodDelete)
+
+	// Needs to be registered before /{pubkey}
+	readRoutes.Path("/bulk").HandlerFunc(h.BulkGetHandler).Methods(http.MethodPost)
+	readRoutes.Path("/{pubkey}").HandlerFunc(h.GetHandler).Methods(http.MethodPost, http.MethodGet)
+	readRoutes.Path("/{uniqueId}/{pubkey}").HandlerFunc(h.GetHandler).Methods(http.MethodPost, http.MethodGet)
+
+	queryRoutes.Path("/{pubkey}").HandlerFunc(h.QueryHandler).Methods(http.MethodPost, http.MethodGet)
+	queryRoutes.Path("/{uniqueId}/{pubkey}").HandlerFunc(h.QueryHandler).Methods(http.MethodPost, http.MethodGet)
+
+	verifyRoutes.Path("/{pubkey}").HandlerFunc(h.VerifyHandler).Methods(http.MethodPost, http.MethodGet)
+	verifyRoutes.Path("/{uniqueId}/{pubkey}").HandlerFunc(h.VerifyHandler).Methods(http.MethodPost, http.MethodGet)
+
+	tagRoutes.Path("/{pubkey}").HandlerFunc(h.ListTagsHandler).Methods(http.MethodGet)
+	tagRoutes.Path("/{uniqueId}/{pubkey}").HandlerFunc(h.ListTagsHandler).Methods(http.MethodGet)
+	tagRoutes.Path("/{pubkey}").HandlerFunc(h.AddTagsHandler).Methods(http.MethodPost)
+	tagRoutes.Path("/{uniqueId}/{pubkey}").HandlerFunc(h.AddTagsHandler).Methods(http.MethodPost)
+	tagRoutes.Path("/{pubkey}").HandlerFunc(h.RemoveTagsHandler).Methods(http.MethodDelete)
+	tagRoutes.Path("/{uniqueId}/{pubkey}").HandlerFunc(h.RemoveTagsHandler).Methods(http.MethodDelete)
+
+	aliasRoutes.Path("/{alias}").HandlerFunc(h.AliasHandler).Methods(http.MethodGet)
+	aliasRoutes.Path("/{uniqueId}/{alias}").HandlerFunc(h.AliasHandler).Methods(http.MethodGet)
+
+	approvalRoutes.Path("/").HandlerFunc(h.ListChangeRequestsHandler).Methods(http.MethodGet)
+	approvalRoutes.Path("/{id}").HandlerFunc(h.GetChangeRequestHandler).Methods(http.MethodGet)
+	approvalRoutes.Path("/{id}/approve").HandlerFunc(h.ApproveHandler).Methods(http.MethodPost)
+	approvalRoutes.Path("/{id}/reject").HandlerFunc(h.RejectHandler).Methods(http.MethodPost)
+
+	h.registerBreakGlass(router, credentials.BreakGlass)
+	h.registerAdmin(router, credentials.Admin)
+}
+
 func fatalError(msg string, err error) {
 	if err != nil {
 		sentry.CaptureException(err)
@@ -347,71 +425,214 @@ func toDict(tokens []string) map[string]string {
 	return result
 }
 
+// PlaintextPolicy defines what happens when plaintext passwords are configured
+type PlaintextPolicy string
+
+// PlaintextPolicy values
+const (
+	PlaintextAllow  PlaintextPolicy = "allow"
+	PlaintextWarn   PlaintextPolicy = "warn"
+	PlaintextRefuse PlaintextPolicy = "refuse"
+)
+
+func checkPlaintextPasswords(entries ...[]string) {
+	policy := PlaintextPolicy(strings.ToLower(utils.GetEnvWithDefault("PLAINTEXT_PASSWORDS", string(PlaintextWarn))))
+
+	users := make([]string, 0)
+	for _, one := range entries {
+		for user, pass := range toDict(one) {
+			if !local_utils.IsPasswordHash(pass) {
+				users = append(users, user)
+			}
+		}
+	}
+
+	if len(users) == 0 {
+		return
+	}
+
+	switch policy {
+	case PlaintextAllow:
+		return
+	case PlaintextRefuse:
+		fatalError(fmt.Sprintf("Plaintext passwords are not allowed (users: %s), use lightning-vault hash-password", strings.Join(users, local_utils.Delimiter)), nil)
+	default:
+		glog.Warningf("Users %s are using plaintext passwords, consider using lightning-vault hash-password", strings.Join(users, local_utils.Delimiter))
+	}
+}
+
+// splitUserIDEntry splits userid:account:glob into the account id and the user id glob
+func splitUserIDEntry(entry string) (string, string, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(entry, userIDPrefix), ":", 2)
+	if len(parts) != 2 || len(parts[0]) != 12 || strings.Trim(parts[0], "0123456789") != "" {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+// checkIdentityEntries refuses to start with userid: entries that do not name the account
+func checkIdentityEntries(entries ...[]string) {
+	for _, one := range entries {
+		for user, pass := range toDict(one) {
+			if pass != local_utils.IAMAuthFlag || !strings.HasPrefix(user, userIDPrefix) {
+				continue
+			}
+
+			if _, _, ok := splitUserIDEntry(user); !ok {
+				fatalError(fmt.Sprintf("Entry %s must be in the form userid:account:glob", user), nil)
+			}
+		}
+	}
+}
+
 func unauthorized(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusUnauthorized)
-	fmt.Fprintf(w, "You are not authorized to do that\n")
+	respondError(w, r, http.StatusUnauthorized, CodeUnauthorized, "You are not authorized to do that")
 	// auth token here is invalid - do not use it for audit logging
 	failureLog("invalid", r.RemoteAddr, "Unauthorized", r.Method)
 }
 
-func verifyPresign(w http.ResponseWriter, r *http.Request, credentials map[string]string) bool {
+type contextKey string
+
+const (
+	principalKey  contextKey = "principal"
+	credentialKey contextKey = "credential"
+	peerKey       contextKey = "peer"
+)
+
+const (
+	accountPrefix = "account:"
+	userIDPrefix  = "userid:"
+)
+
+// getPrincipal returns the authenticated user (or ARN) of the request, remote IP when unknown
+func getPrincipal(r *http.Request) string {
+	principal, ok := r.Context().Value(principalKey).(string)
+	if !ok || principal == "" {
+		return remoteIP(r)
+	}
+
+	return principal
+}
+
+func withPrincipal(r *http.Request, principal string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey, principal))
+}
+
+// withCredential remembers which configured entry (username or IAM glob) authenticated the request
+func withCredential(r *http.Request, credential string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), credentialKey, credential))
+}
+
+// readDuration returns how long credentials issued for the request are valid
+func readDuration(r *http.Request) time.Duration {
+	credential, _ := r.Context().Value(credentialKey).(string)
+
+	for entry, duration := range readDurations {
+		if strings.SplitN(entry, local_utils.UserPassSeparator, 2)[0] == credential {
+			return duration
+		}
+	}
+
+	return time.Minute * 10
+}
+
+// verifyPresign returns the ARN of the caller and the matching entry
+func verifyPresign(w http.ResponseWriter, r *http.Request, credentials map[string]string) (string, string, bool) {
 	presign := r.Header.Get(local_utils.PresignHeader)
 	if presign == "" {
-		return false
+		return "", "", false
 	}
 
-	arn, err := local_utils.VerifyGetCallerIdentity(presign, 5*time.Second)
+	identity, err := local_utils.VerifyGetCallerIdentityResult(presign, 5*time.Second)
 	if err != nil {
 		glog.Warningf("Presign check failed: %v", err)
-		return false
+		return "", "", false
 	}
 
 	for k, v := range credentials {
-		if v == local_utils.IAMAuthFlag {
-			// k is a glob
-			g, err := glob.Compile(k)
-			if err != nil {
-				continue
-			}
+		if v == local_utils.IAMAuthFlag && matchIdentity(k, identity) {
+			return identity.Arn, k, true
+		}
+	}
 
-			if g.Match(arn) {
-				return true
-			}
+	return "", "", false
+}
+
+// matchIdentity matches an entry against the identity, entry is a glob matched against the ARN
+// or (when prefixed with account: or userid:account:) against the account id or user id
+func matchIdentity(entry string, identity *local_utils.GetCallerIdentityResult) bool {
+	value := identity.Arn
+	pattern := entry
+
+	if strings.HasPrefix(entry, accountPrefix) {
+		value = identity.Account
+		pattern = strings.TrimPrefix(entry, accountPrefix)
+	} else if strings.HasPrefix(entry, userIDPrefix) {
+		// Session name in the user id is chosen by the caller so the account has to match too
+		account, userID, ok := splitUserIDEntry(entry)
+		if !ok || account != identity.Account {
+			return false
 		}
+		value = identity.UserID
+		pattern = userID
 	}
 
-	return false
+	g, err := glob.Compile(pattern)
+	if err != nil {
+		return false
+	}
+
+	return g.Match(value)
 }
 
 func authMiddleware(credentials map[string]string) mux.MiddlewareFunc {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if !verifyPresign(w, r, credentials) {
+			ip := remoteIP(r)
+			if wait := authThrottle.Blocked(ip); wait > 0 {
+				tooManyRequests(w, r, wait, "auth_ip")
+				return
+			}
+
+			arn, entry, ok := verifyPresign(w, r, credentials)
+			if ok {
+				r = withPrincipal(r, arn)
+				r = withCredential(r, entry)
+			} else {
+				if r.Header.Get(local_utils.PresignHeader) != "" {
+					// Failed presign attempts cost us an STS round trip
+					authThrottle.Failure(ip)
+				}
+
 				u, p, ok := r.BasicAuth()
 				if !ok {
 					unauthorized(w, r)
 					return
 				}
 
+				userKey := "user:" + u
+				if wait := authThrottle.Blocked(userKey); wait > 0 {
+					tooManyRequests(w, r, wait, "auth_user")
+					return
+				}
+
 				pass, ok := credentials[u]
 				if !ok {
+					authThrottle.Failure(ip)
 					unauthorized(w, r)
 					return
 				}
-				if strings.HasPrefix(pass, "$") {
-					// Password hash
-					err := bcrypt.CompareHashAndPassword([]byte(pass), []byte(p))
-					if err != nil {
-						unauthorized(w, r)
-						return
-					}
-				} else {
-					// Plaintext password
-					if p != pass {
-						unauthorized(w, r)
-						return
-					}
+				if !local_utils.VerifyPassword(pass, p) {
+					authThrottle.Failure(ip)
+					authThrottle.Failure(userKey)
+					unauthorized(w, r)
+					return
 				}
+
+				authThrottle.Success(userKey)
+				r = withPrincipal(r, u)
+				r = withCredential(r, u)
 			}
 
 			h.ServeHTTP(w, r)
@@ -429,6 +650,11 @@ func recoveryMiddleware() mux.MiddlewareFunc {
 					sentry.CurrentHub().Recover(err)
 					sentry.Flush(time.Second * 5)
 
+					if strings.HasPrefix(r.URL.Path, "/"+APIVersion+"/") {
+						writeEnvelope(w, r, http.StatusInternalServerError, APIResponse{Error: &APIError{Code: CodeInternal, Message: "Internal server error"}})
+						return
+					}
+
 					w.WriteHeader(http.StatusUnauthorized)
 					fmt.Fprintf(w, "Internal server error\n")
 				}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	_ "embed" // for openapi.json
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	sentry "github.com/getsentry/sentry-go"
+)
+
+// openAPISpec describes all routes (the /v1/ ones and the old ones), openapi_test.go checks it against the registered routes
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// privateOpenAPITags are operations left out of the unauthenticated document
+var privateOpenAPITags = map[string]bool{
+	"admin":      true,
+	"breakglass": true,
+}
+
+var (
+	publicSpecOnce sync.Once
+	publicSpec     []byte
+)
+
+// publicOpenAPISpec returns openAPISpec without operations tagged with privateOpenAPITags
+func publicOpenAPISpec() []byte {
+	publicSpecOnce.Do(func() {
+		var doc map[string]interface{}
+		if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+			sentry.CaptureException(err)
+			publicSpec = []byte("{}")
+			return
+		}
+
+		paths, _ := doc["paths"].(map[string]interface{})
+		for path, value := range paths {
+			operations, _ := value.(map[string]interface{})
+			for method, operation := range operations {
+				tags, _ := operation.(map[string]interface{})["tags"].([]interface{})
+				for _, tag := range tags {
+					if name, ok := tag.(string); ok && privateOpenAPITags[name] {
+						delete(operations, method)
+						break
+					}
+				}
+			}
+			if len(operations) == 0 {
+				delete(paths, path)
+			}
+		}
+
+		var err error
+		publicSpec, err = json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			sentry.CaptureException(err)
+			publicSpec = []byte("{}")
+		}
+	})
+
+	return publicSpec
+}
+
+// OpenAPIHandler - serves the OpenAPI document (without admin and break-glass routes)
+func (h *Handlers) OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(publicOpenAPISpec())
+}
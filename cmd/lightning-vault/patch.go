@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	entities "github.com/bolt-observer/go_common/entities"
+)
+
+// PATCH uses JSON merge patch semantics (RFC 7396): fields that are present replace the stored ones, null removes them
+// and missing fields are kept. The macaroon/rune can not be patched.
+
+// patchableFields are the fields that can be patched
+var patchableFields = []string{FieldEndpoint, FieldCertificate, FieldAPIType, FieldCertVerificationType, FieldTags}
+
+// PatchResult is the result of a patch call
+type PatchResult struct {
+	OperationResult
+	Changed []string `json:"changed"`
+}
+
+func isNull(raw json.RawMessage) bool {
+	return bytes.Equal(bytes.TrimSpace(raw), []byte("null"))
+}
+
+func decodeOptionalInt(raw json.RawMessage) (*int, error) {
+	if isNull(raw) {
+		return nil, nil
+	}
+
+	var value int
+	err := json.Unmarshal(raw, &value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &value, nil
+}
+
+// applyPatch applies patch to data and returns the names of changed fields
+func applyPatch(data *entities.Data, patch map[string]json.RawMessage) ([]string, *requestError) {
+	orig := *data
+
+	for field := range patch {
+		if !containsTag(patchableFields, field) {
+			return nil, &requestError{Code: CodeBadRequest, Reason: fmt.Sprintf("field %s can not be patched", field), LogReason: fmt.Sprintf("[Patch] field %s can not be patched", field)}
+		}
+	}
+
+	for _, field := range []string{FieldEndpoint, FieldCertificate, FieldTags} {
+		raw, ok := patch[field]
+		if !ok {
+			continue
+		}
+
+		value := ""
+		if !isNull(raw) {
+			err := json.Unmarshal(raw, &value)
+			if err != nil {
+				return nil, &requestError{Code: CodeJSONInvalid, Reason: fmt.Sprintf("field %s must be a string", field), LogReason: fmt.Sprintf("[Patch] field %s: %v", field, err)}
+			}
+		}
+
+		switch field {
+		case FieldEndpoint:
+			data.Endpoint = value
+		case FieldCertificate:
+			data.CertificateBase64 = value
+		case FieldTags:
+			data.Tags = value
+		}
+	}
+
+	for _, field := range []string{FieldAPIType, FieldCertVerificationType} {
+		raw, ok := patch[field]
+		if !ok {
+			continue
+		}
+
+		value, err := decodeOptionalInt(raw)
+		if err != nil {
+			return nil, &requestError{Code: CodeJSONInvalid, Reason: fmt.Sprintf("field %s must be an integer", field), LogReason: fmt.Sprintf("[Patch] field %s: %v", field, err)}
+		}
+
+		switch field {
+		case FieldAPIType:
+			data.ApiType = value
+		case FieldCertVerificationType:
+			data.CertVerificationType = value
+		}
+	}
+
+	if _, ok := patch[FieldAPIType]; ok && data.ApiType == nil {
+		autoDetectAPIType(data)
+	}
+
+	return changedFields(diffRecords(orig, *data)), nil
+}
+
+// PatchHandler - changes fields of a stored record, the macaroon/rune is kept
+func (h *Handlers) PatchHandler(w http.ResponseWriter, r *http.Request) {
+	var patch map[string]json.RawMessage
+
+	pubkey, err := h.obtainPubkey(w, r)
+	if err != nil {
+		return
+	}
+
+	uniqueID, err := h.obtainUniqueID(w, r)
+	if err != nil {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&patch)
+	if err != nil || patch == nil {
+		h.badRequest(w, r, CodeJSONInvalid, "json decoding failed", fmt.Sprintf("[Patch] json decoding failed: %v", err))
+		return
+	}
+
+	// Re-verification is opt-in (unlike put)
+	verify, err := strconv.ParseBool(r.URL.Query().Get("verify"))
+	if err != nil {
+		verify = false
+	}
+
+	data, ok := h.lookup(pubkey + uniqueID)
+	if !ok {
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[Patch] Secret %s not found", pubkey), r.Method)
+		notFound(w, r)
+		return
+	}
+	base := dataVersion(&data)
+
+	changed, reqErr := applyPatch(&data, patch)
+	if reqErr == nil {
+		reqErr = validateRecord(&data, "Patch")
+	}
+	if reqErr != nil {
+		h.badRequest(w, r, reqErr.Code, reqErr.Reason, reqErr.LogReason)
+		return
+	}
+
+	if reqErr := h.aliasConflict(data, uniqueID); reqErr != nil {
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[Patch] %s", reqErr.LogReason), r.Method)
+		respondError(w, r, http.StatusConflict, reqErr.Code, reqErr.Reason)
+		return
+	}
+
+	result := PatchResult{OperationResult: OperationResult{PubKey: pubkey, UniqueID: uniqueID, Result: ResultUpdated}, Changed: changed}
+
+	if len(changed) == 0 {
+		auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Patch %s (%s) changed nothing", pubkey, uniqueID), r.Method)
+		respondJSON(w, r, http.StatusOK, result, result)
+		return
+	}
+
+	auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Patch %s (%s) changed %s", pubkey, uniqueID, strings.Join(changed, ",")), r.Method)
+
+	if verify && !h.VerifyCall(w, r, &data, pubkey, uniqueID) {
+		return
+	}
+
+	if approvalRequired {
+		h.submitChangeRequest(w, r, OperationPut, &data, uniqueID, verify)
+		return
+	}
+
+	// Verification is done without RecordMutex, the record must not have changed meanwhile
+	_, err = h.storeUnchanged(context.Background(), &data, uniqueID, base)
+	if errors.Is(err, errRecordChanged) {
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[Patch] %s (%s) changed while the patch was applied", pubkey, uniqueID), r.Method)
+		respondError(w, r, http.StatusConflict, CodeConflict, "Record changed while the request was processed, retry")
+		return
+	}
+	if err != nil {
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("AWS put secret failed with error %v", err), r.Method)
+		internalError(w, r)
+		return
+	}
+
+	respondJSON(w, r, http.StatusOK, result, result)
+}
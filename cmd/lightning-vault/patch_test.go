@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	entities "github.com/bolt-observer/go_common/entities"
+	local_utils "github.com/bolt-observer/lightning-vault/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyPatch(t *testing.T) {
+	orig := entities.Data{
+		PubKey:               "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7",
+		MacaroonHex:          testMacaroon,
+		CertificateBase64:    testCertificate,
+		Endpoint:             "192.168.192.168:10009",
+		ApiType:              intPtr(0),
+		CertVerificationType: intPtr(1),
+		Tags:                 "alice",
+	}
+
+	decode := func(s string) map[string]json.RawMessage {
+		var patch map[string]json.RawMessage
+		require.NoError(t, json.Unmarshal([]byte(s), &patch))
+		return patch
+	}
+
+	data := orig
+	changed, err := applyPatch(&data, decode(`{"endpoint": "10.0.0.1:10009", "tags": "alice", "cert_verification_type": null}`))
+	require.Nil(t, err)
+	assert.Equal(t, []string{FieldEndpoint, FieldCertVerificationType}, changed)
+	assert.Equal(t, "10.0.0.1:10009", data.Endpoint)
+	assert.Nil(t, data.CertVerificationType)
+	assert.Equal(t, testMacaroon, data.MacaroonHex)
+	assert.Equal(t, testCertificate, data.CertificateBase64)
+
+	data = orig
+	changed, err = applyPatch(&data, decode(`{"api_type": 1, "certificate_base64": null}`))
+	require.Nil(t, err)
+	assert.Equal(t, []string{FieldCertificate, FieldAPIType}, changed)
+	assert.Equal(t, 1, *data.ApiType)
+	assert.Equal(t, "", data.CertificateBase64)
+
+	data = orig
+	changed, err = applyPatch(&data, decode(`{}`))
+	require.Nil(t, err)
+	assert.Empty(t, changed)
+
+	for _, patch := range []string{`{"macaroon_hex": "00"}`, `{"pubkey": null}`, `{"endpoint": 5}`, `{"api_type": "x"}`} {
+		data = orig
+		_, err = applyPatch(&data, decode(patch))
+		assert.NotNil(t, err, patch)
+		assert.Equal(t, orig, data, patch)
+	}
+}
+
+func TestPatchHandler(t *testing.T) {
+	prometheusInit()
+	freshAuthThrottle(t)
+
+	pubkey := "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7"
+
+	h := MakeNewDummyHandlers()
+	verified := 0
+	h.VerifyCall = func(w http.ResponseWriter, r *http.Request, data *entities.Data, pubkey, uniqueID string) bool {
+		verified++
+		return true
+	}
+
+	stored := make(map[string]string)
+	mgr := h.SecretsManager.(*local_utils.TestSecretsManager)
+	mgr.InsertOrUpdateSecretFn = func(ctx context.Context, name, value string, metadata local_utils.Metadata) (string, local_utils.Change, error) {
+		stored[name] = value
+		return "", local_utils.Updated, nil
+	}
+
+	h.toLookup(entities.Data{PubKey: pubkey, MacaroonHex: testMacaroon, CertificateBase64: testCertificate, Endpoint: "192.168.192.168:10009", ApiType: intPtr(0)}, "id1")
+
+	router := v1Router(h)
+
+	w := call(router, http.MethodPatch, "/v1/put/id1/"+pubkey, "writer", `{"endpoint": "10.0.0.1:10009", "tags": "alice"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var result PatchResult
+	decodeEnvelope(t, w, &result)
+	assert.Equal(t, []string{FieldEndpoint, FieldTags}, result.Changed)
+	assert.Equal(t, ResultUpdated, result.Result)
+	assert.Equal(t, 0, verified)
+
+	var data entities.Data
+	require.NoError(t, json.Unmarshal([]byte(stored["_"+pubkey+"id1_"]), &data))
+	assert.Equal(t, "10.0.0.1:10009", data.Endpoint)
+	assert.Equal(t, testMacaroon, data.MacaroonHex)
+	assert.Equal(t, testCertificate, data.CertificateBase64)
+
+	// Verification is opt-in
+	w = call(router, http.MethodPatch, "/v1/put/id1/"+pubkey+"?verify=true", "writer", `{"cert_verification_type": 1}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, verified)
+
+	// Nothing changed, nothing stored
+	delete(stored, "_"+pubkey+"id1_")
+	w = call(router, http.MethodPatch, "/v1/put/id1/"+pubkey, "writer", `{"cert_verification_type": 1}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	result = PatchResult{}
+	decodeEnvelope(t, w, &result)
+	assert.Empty(t, result.Changed)
+	assert.Empty(t, stored)
+
+	// Resulting record must be valid
+	w = call(router, http.MethodPatch, "/v1/put/id1/"+pubkey, "writer", `{"endpoint": null}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = call(router, http.MethodPatch, "/v1/put/id1/"+pubkey, "writer", `{"certificate_base64": null}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	response := decodeEnvelope(t, w, nil)
+	assert.Equal(t, CodeCertificateInvalid, response.Error.Code)
+	w = call(router, http.MethodPatch, "/v1/put/id1/"+pubkey, "writer", `{"macaroon_hex": "00"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = call(router, http.MethodPatch, "/v1/put/id1/"+pubkey, "writer", `[]`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = call(router, http.MethodPatch, "/v1/put/"+pubkey, "writer", `{"tags": "x"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = call(router, http.MethodPatch, "/v1/put/id1/alice", "writer", `{"tags": "x"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = call(router, http.MethodPatch, "/v1/put/id1/"+pubkey, "reader", `{"tags": "x"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestWritesTakeRecordMutex(t *testing.T) {
+	prometheusInit()
+	freshAuthThrottle(t)
+
+	pubkey := "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7"
+
+	h := MakeNewDummyHandlers()
+	h.VerifyCall = func(w http.ResponseWriter, r *http.Request, data *entities.Data, pubkey, uniqueID string) bool {
+		return true
+	}
+	router := v1Router(h)
+
+	data := entities.Data{PubKey: pubkey, MacaroonHex: testMacaroon, CertificateBase64: testCertificate, Endpoint: "192.168.192.168:10009"}
+
+	writes := []struct {
+		name  string
+		write func()
+	}{
+		{"put", func() { call(router, http.MethodPost, "/v1/put/", "writer", testRecord(pubkey, "")) }},
+		{"bulk put", func() { call(router, http.MethodPost, "/v1/put/bulk", "writer", "["+testRecord(pubkey, "id1")+"]") }},
+		{"change request", func() {
+			h.applyChangeRequest(context.Background(), &ChangeRequest{Operation: OperationPut, PubKey: pubkey, UniqueID: "id2", Data: &data})
+		}},
+		{"delete", func() { call(router, http.MethodDelete, "/v1/delete/"+pubkey, "writer", "") }},
+	}
+
+	for _, one := range writes {
+		h.RecordMutex.Lock()
+		done := make(chan struct{})
+		go func(write func()) {
+			write()
+			close(done)
+		}(one.write)
+
+		select {
+		case <-done:
+			t.Errorf("%s did not wait for RecordMutex", one.name)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		h.RecordMutex.Unlock()
+		<-done
+	}
+
+	_, ok := h.lookup(pubkey)
+	assert.False(t, ok)
+	_, ok = h.lookup(pubkey + "id1")
+	assert.True(t, ok)
+	_, ok = h.lookup(pubkey + "id2")
+	assert.True(t, ok)
+}
+
+func TestVerifyOutsideRecordMutex(t *testing.T) {
+	prometheusInit()
+	freshAuthThrottle(t)
+
+	pubkey := "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7"
+
+	h := MakeNewDummyHandlers()
+	router := v1Router(h)
+	h.toLookup(entities.Data{PubKey: pubkey, MacaroonHex: testMacaroon, CertificateBase64: testCertificate, Endpoint: "192.168.192.168:10009", ApiType: intPtr(0)}, "")
+
+	// Another write lands while the node is checked
+	h.VerifyCall = func(w http.ResponseWriter, r *http.Request, data *entities.Data, pubkey, uniqueID string) bool {
+		if assert.True(t, h.RecordMutex.TryLock(), "RecordMutex is held during verification") {
+			h.RecordMutex.Unlock()
+		}
+
+		other, _ := h.lookup(pubkey + uniqueID)
+		other.Tags = other.Tags + "x"
+		h.toLookup(other, uniqueID)
+		return true
+	}
+
+	w := call(router, http.MethodPatch, "/v1/put/"+pubkey+"?verify=true", "writer", `{"endpoint": "192.168.192.168:10010"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = call(router, http.MethodPost, "/v1/put/", "writer", `{"pubkey": "`+pubkey+`", "endpoint": "192.168.192.168:10011"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	data, ok := h.lookup(pubkey)
+	require.True(t, ok)
+	assert.Equal(t, "192.168.192.168:10009", data.Endpoint)
+	assert.Equal(t, "xx", data.Tags)
+}
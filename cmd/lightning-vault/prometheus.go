@@ -34,15 +34,74 @@ type authLabels struct {
 	Success    bool   `label:"success"`
 }
 
+type throttleLabels struct {
+	Reason string `label:"reason"`
+	Method string `label:"method"`
+}
+
+type breakGlassLabels struct {
+	Stage string `label:"stage"`
+}
+
+type verifyLabels struct {
+	Result string `label:"result"`
+}
+
+type loadLabels struct {
+	State string `label:"state"`
+}
+
 var (
 	promInitialized = false
 	metrics         struct {
-		HTTPDuration func(labels) prometheus.Histogram   `name:"http_duration" help:"Duration of HTTP requests" buckets:""`
-		Reqs         func(labelsCode) prometheus.Counter `name:"requests_total" help:"How many HTTP requests processed"`
-		AuthReqs     func(authLabels) prometheus.Counter `name:"auth_requests_total" help:"How many HTTP requests processed per user"`
+		HTTPDuration func(labels) prometheus.Histogram         `name:"http_duration" help:"Duration of HTTP requests" buckets:""`
+		Reqs         func(labelsCode) prometheus.Counter       `name:"requests_total" help:"How many HTTP requests processed"`
+		AuthReqs     func(authLabels) prometheus.Counter       `name:"auth_requests_total" help:"How many HTTP requests processed per user"`
+		Throttled    func(throttleLabels) prometheus.Counter   `name:"throttled_requests_total" help:"How many HTTP requests were throttled"`
+		BreakGlass   func(breakGlassLabels) prometheus.Counter `name:"break_glass_total" help:"How many break-glass requests and retrievals happened"`
+		Secrets      func(loadLabels) prometheus.Gauge         `name:"initial_load_secrets" help:"How many secrets the initial load found per state (loaded, failed, ignored)"`
+		Verified     func(verifyLabels) prometheus.Counter     `name:"background_verifications_total" help:"How many background verifications succeeded, failed or were skipped"`
 	}
 )
 
+// pubkeyPrefixLen is how much of the pubkey is used as metric label
+const pubkeyPrefixLen = 16
+
+// certExpiry is registered by hand (not through gotoprom) so series of deleted records can be removed
+var certExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "macaroon",
+	Name:      "certificate_expiry_seconds",
+	Help:      "Seconds until the stored certificate of a node expires",
+}, []string{"pubkey_prefix", "unique_id"})
+
+// Per record verification gauges are registered by hand too
+var (
+	verifyLastTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "macaroon",
+		Name:      "verification_timestamp_seconds",
+		Help:      "When the stored credential of a node was last verified in the background",
+	}, []string{"pubkey_prefix", "unique_id"})
+	verifyLatency = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "macaroon",
+		Name:      "verification_latency_seconds",
+		Help:      "How long the last background verification of a node took",
+	}, []string{"pubkey_prefix", "unique_id"})
+	verifySuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "macaroon",
+		Name:      "verification_success",
+		Help:      "Whether the stored credential of a node worked at the last background verification (1) or not (0)",
+	}, []string{"pubkey_prefix", "unique_id"})
+)
+
+// nodeLabels returns labels of per record metrics
+func nodeLabels(pubkey, uniqueID string) prometheus.Labels {
+	if len(pubkey) > pubkeyPrefixLen {
+		pubkey = pubkey[:pubkeyPrefixLen]
+	}
+
+	return prometheus.Labels{"pubkey_prefix": pubkey, "unique_id": uniqueID}
+}
+
 // NewLoggingResponseWriter - constructs a new LoggingResponseWriter
 func NewLoggingResponseWriter(w http.ResponseWriter) *LoggingResponseWriter {
 	return &LoggingResponseWriter{w, http.StatusOK}
@@ -70,6 +129,7 @@ func prometheusMiddleware(next http.Handler) http.Handler {
 func prometheusInit() {
 	if !promInitialized {
 		gotoprom.MustInit(&metrics, "macaroon")
+		prometheus.MustRegister(certExpiry, verifyLastTimestamp, verifyLatency, verifySuccess)
 		promInitialized = true
 	}
 }
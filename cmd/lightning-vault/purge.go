@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	utils "github.com/bolt-observer/go_common/utils"
+	local_utils "github.com/bolt-observer/lightning-vault/utils"
+	"github.com/golang/glog"
+)
+
+// DeleteMode decides what a delete does with the stored secret
+type DeleteMode string
+
+// Delete modes
+const (
+	// DeleteModeTombstone - secret is overwritten with {} and stays in the secrets manager (see PurgeHandler)
+	DeleteModeTombstone DeleteMode = "tombstone"
+	// DeleteModeSchedule - secret is deleted by the secrets manager after the recovery window
+	DeleteModeSchedule DeleteMode = "schedule"
+)
+
+// DefaultRecoveryDays is how long a deleted secret can be restored (AWS allows 7 to 30 days or 0 for immediate deletion)
+const DefaultRecoveryDays = 30
+
+// DefaultPurgeMinAge is how long tombstones are kept before they can be purged
+const DefaultPurgeMinAge = 30 * 24 * time.Hour
+
+var (
+	deleteMode   = DeleteModeTombstone
+	recoveryDays = DefaultRecoveryDays
+	purgeMinAge  = DefaultPurgeMinAge
+)
+
+var errDeletionUnsupported = errors.New("scheduled deletion is not supported by the secrets manager")
+
+// DeleteOptions decide how a record is deleted
+type DeleteOptions struct {
+	Mode         DeleteMode `json:"mode"`
+	RecoveryDays int        `json:"recovery_days"`
+}
+
+// PurgedSecret is a tombstone found by the purge
+type PurgedSecret struct {
+	Name      string    `json:"name"`
+	ChangedAt time.Time `json:"changed_at"`
+	Result    string    `json:"result"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// PurgeResult is the result of the admin purge call
+type PurgeResult struct {
+	DryRun       bool           `json:"dry_run"`
+	OlderThan    string         `json:"older_than"`
+	RecoveryDays int            `json:"recovery_days"`
+	Secrets      []PurgedSecret `json:"secrets"`
+}
+
+func validRecoveryDays(days int) bool {
+	return days == 0 || (days >= 7 && days <= 30)
+}
+
+func parseDeleteMode(mode string) (DeleteMode, bool) {
+	switch DeleteMode(strings.ToLower(mode)) {
+	case DeleteModeTombstone:
+		return DeleteModeTombstone, true
+	case DeleteModeSchedule:
+		return DeleteModeSchedule, true
+	}
+
+	return "", false
+}
+
+func configureDeletion() {
+	mode, ok := parseDeleteMode(utils.GetEnvWithDefault("DELETE_MODE", string(DeleteModeTombstone)))
+	if !ok {
+		fatalError("DELETE_MODE is invalid (tombstone or schedule)", nil)
+	}
+	deleteMode = mode
+
+	days, err := strconv.Atoi(utils.GetEnvWithDefault("DELETE_RECOVERY_DAYS", strconv.Itoa(DefaultRecoveryDays)))
+	if err != nil || !validRecoveryDays(days) {
+		fatalError("DELETE_RECOVERY_DAYS is invalid (0 or 7 to 30)", err)
+	}
+	recoveryDays = days
+
+	minAge, err := time.ParseDuration(utils.GetEnvWithDefault("PURGE_MIN_AGE", DefaultPurgeMinAge.String()))
+	if err != nil {
+		fatalError("PURGE_MIN_AGE could not be parsed", err)
+	}
+	purgeMinAge = minAge
+}
+
+// deleteOptions returns how the delete request should be done (query parameters mode and recovery_days override the configuration)
+func deleteOptions(r *http.Request) (DeleteOptions, error) {
+	ret := DeleteOptions{Mode: deleteMode, RecoveryDays: recoveryDays}
+
+	query := r.URL.Query()
+	if query.Get("mode") != "" {
+		mode, ok := parseDeleteMode(query.Get("mode"))
+		if !ok {
+			return ret, fmt.Errorf("mode %q is invalid (tombstone or schedule)", query.Get("mode"))
+		}
+		ret.Mode = mode
+	}
+
+	days, err := recoveryDaysParam(r)
+	if err != nil {
+		return ret, err
+	}
+	ret.RecoveryDays = days
+
+	return ret, nil
+}
+
+// recoveryDaysParam returns query parameter recovery_days (default DELETE_RECOVERY_DAYS)
+func recoveryDaysParam(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("recovery_days")
+	if value == "" {
+		return recoveryDays, nil
+	}
+
+	days, err := strconv.Atoi(value)
+	if err != nil || !validRecoveryDays(days) {
+		return 0, fmt.Errorf("recovery_days %q is invalid (0 or 7 to 30)", value)
+	}
+
+	return days, nil
+}
+
+// deleteSecret removes secret name from the secrets manager as options say
+func (h *Handlers) deleteSecret(ctx context.Context, name string, options DeleteOptions) error {
+	if options.Mode != DeleteModeSchedule {
+		_, err := h.SecretsManager.DeleteSecret(ctx, name)
+		return err
+	}
+
+	purger, ok := h.SecretsManager.(local_utils.Purger)
+	if !ok {
+		return errDeletionUnsupported
+	}
+
+	_, err := purger.ScheduleDeletion(ctx, name, options.RecoveryDays)
+	return err
+}
+
+// PurgeHandler - deletes tombstones that are older than older_than (default PURGE_MIN_AGE)
+func (h *Handlers) PurgeHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	query := r.URL.Query()
+
+	purger, ok := h.SecretsManager.(local_utils.Purger)
+	if !ok {
+		h.badRequest(w, r, CodeBadRequest, errDeletionUnsupported.Error(), fmt.Sprintf("[Purge] %v", errDeletionUnsupported))
+		return
+	}
+
+	olderThan := purgeMinAge
+	if query.Get("older_than") != "" {
+		d, err := time.ParseDuration(query.Get("older_than"))
+		if err != nil || d < 0 {
+			h.badRequest(w, r, CodeBadRequest, "older_than is invalid", fmt.Sprintf("[Purge] older_than is invalid - %v", query.Get("older_than")))
+			return
+		}
+		olderThan = d
+	}
+
+	days, err := recoveryDaysParam(r)
+	if err != nil {
+		h.badRequest(w, r, CodeBadRequest, err.Error(), fmt.Sprintf("[Purge] %v", err))
+		return
+	}
+
+	dryRun, err := strconv.ParseBool(query.Get("dry_run"))
+	dryRun = err == nil && dryRun
+
+	auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Purge tombstones older than %v (recovery %d days, dry run %v)", olderThan, days, dryRun), r.Method)
+
+	tombstones, err := purger.ListTombstones(ctx, prefix+"_", time.Now().Add(-olderThan))
+	var loadErr *local_utils.LoadError
+	if errors.As(err, &loadErr) && loadErr.ListErr == nil {
+		// Secrets that could not be fetched are left alone
+		glog.Warningf("[Purge] not all secrets could be checked: %v", err)
+	} else if err != nil {
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[Purge] listing tombstones failed with error %v", err), r.Method)
+		internalError(w, r)
+		return
+	}
+
+	result := PurgeResult{DryRun: dryRun, OlderThan: olderThan.String(), RecoveryDays: days, Secrets: make([]PurgedSecret, 0, len(tombstones))}
+	for _, tombstone := range tombstones {
+		secret := PurgedSecret{Name: tombstone.Name, ChangedAt: tombstone.ChangedAt, Result: ResultScheduled}
+		if days == 0 {
+			secret.Result = ResultDeleted
+		}
+
+		if !dryRun {
+			h.purgeTombstone(ctx, purger, &secret, days)
+		} else if _, ok := h.lookup(lookupKey(tombstone.Name)); ok {
+			secret.Result = ResultSkipped
+			secret.Reason = "record exists"
+		}
+
+		result.Secrets = append(result.Secrets, secret)
+	}
+
+	respondJSON(w, r, http.StatusOK, result, result)
+}
+
+// lookupKey returns the Lookup key (pubkey + uniqueID) of secret name
+func lookupKey(name string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(name, prefix+"_"), "_")
+}
+
+// purgeTombstone deletes the tombstone unless the record was stored again since it was listed
+func (h *Handlers) purgeTombstone(ctx context.Context, purger local_utils.Purger, secret *PurgedSecret, days int) {
+	h.RecordMutex.Lock()
+	defer h.RecordMutex.Unlock()
+
+	if _, ok := h.lookup(lookupKey(secret.Name)); ok {
+		secret.Result = ResultSkipped
+		secret.Reason = "record exists"
+		return
+	}
+
+	values, err := h.SecretsManager.LoadSecrets(ctx, secret.Name)
+	if err != nil {
+		glog.Warningf("Could not check tombstone %s: %v", secret.Name, err)
+		secret.Result = ResultFailed
+		secret.Reason = err.Error()
+		return
+	}
+	if value, ok := values[secret.Name]; !ok || value != "{}" {
+		secret.Result = ResultSkipped
+		secret.Reason = "no longer a tombstone"
+		return
+	}
+
+	_, err = purger.ScheduleDeletion(ctx, secret.Name, days)
+	if err != nil {
+		glog.Warningf("Could not purge tombstone %s: %v", secret.Name, err)
+		secret.Result = ResultFailed
+		secret.Reason = err.Error()
+	}
+}
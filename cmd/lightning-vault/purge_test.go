@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	entities "github.com/bolt-observer/go_common/entities"
+	local_utils "github.com/bolt-observer/lightning-vault/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scheduledDeletions wires scheduled deletion and tombstone listing of a TestSecretsManager to store
+func scheduledDeletions(h *Handlers, store map[string]string, changedAt time.Time) map[string]int {
+	scheduled := make(map[string]int)
+	mgr := h.SecretsManager.(*local_utils.TestSecretsManager)
+
+	mgr.ScheduleDeletionFn = func(ctx context.Context, name string, recoveryDays int) (string, error) {
+		delete(store, name)
+		scheduled[name] = recoveryDays
+		return name, nil
+	}
+	mgr.ListTombstonesFn = func(ctx context.Context, prefix string, before time.Time) ([]local_utils.Tombstone, error) {
+		ret := make([]local_utils.Tombstone, 0)
+		for k, v := range store {
+			if strings.HasPrefix(k, prefix) && v == "{}" && changedAt.Before(before) {
+				ret = append(ret, local_utils.Tombstone{Name: k, ChangedAt: changedAt})
+			}
+		}
+		return ret, nil
+	}
+
+	return scheduled
+}
+
+func TestDeleteModes(t *testing.T) {
+	prometheusInit()
+	freshAuthThrottle(t)
+
+	pubkey := "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7"
+
+	h := MakeNewDummyHandlers()
+	store := memorySecrets(h)
+	scheduled := scheduledDeletions(h, store, time.Now())
+	router := v1Router(h)
+
+	for _, uniqueID := range []string{"a", "b", "c"} {
+		_, err := h.storeSecret(context.Background(), &entities.Data{PubKey: pubkey, MacaroonHex: testMacaroon, Endpoint: "127.0.0.1:10009"}, uniqueID)
+		require.NoError(t, err)
+	}
+
+	// Default is a tombstone
+	w := call(router, http.MethodDelete, "/v1/delete/a/"+pubkey, "writer", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "{}", store["_"+pubkey+"a_"])
+
+	w = call(router, http.MethodDelete, "/v1/delete/b/"+pubkey+"?mode=schedule&recovery_days=7", "writer", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	_, ok := store["_"+pubkey+"b_"]
+	assert.False(t, ok)
+	assert.Equal(t, 7, scheduled["_"+pubkey+"b_"])
+	_, ok = h.lookup(pubkey + "b")
+	assert.False(t, ok)
+
+	for _, query := range []string{"?mode=shred", "?mode=schedule&recovery_days=3", "?recovery_days=x"} {
+		w = call(router, http.MethodDelete, "/v1/delete/c/"+pubkey+query, "writer", "")
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+	_, ok = h.lookup(pubkey + "c")
+	assert.True(t, ok)
+
+	old := deleteMode
+	deleteMode = DeleteModeSchedule
+	t.Cleanup(func() { deleteMode = old })
+
+	w = call(router, http.MethodDelete, "/v1/delete/c/"+pubkey, "writer", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, DefaultRecoveryDays, scheduled["_"+pubkey+"c_"])
+}
+
+func TestPurgeHandler(t *testing.T) {
+	prometheusInit()
+	freshAuthThrottle(t)
+
+	h := MakeNewDummyHandlers()
+	store := memorySecrets(h)
+	scheduled := scheduledDeletions(h, store, time.Now().Add(-48*time.Hour))
+	router := v1Router(h)
+
+	store["_tombstone_"] = "{}"
+	store["_record_"] = `{"pubkey": "x"}`
+	store["otherenv_tombstone_"] = "{}"
+
+	// Not old enough
+	w := call(router, http.MethodPost, "/v1/admin/purge?older_than=72h", "admin", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var result PurgeResult
+	decodeEnvelope(t, w, &result)
+	assert.Empty(t, result.Secrets)
+
+	w = call(router, http.MethodPost, "/v1/admin/purge?older_than=24h&dry_run=true", "admin", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	decodeEnvelope(t, w, &result)
+	assert.True(t, result.DryRun)
+	require.Len(t, result.Secrets, 1)
+	assert.Equal(t, "_tombstone_", result.Secrets[0].Name)
+	assert.Equal(t, ResultScheduled, result.Secrets[0].Result)
+	assert.Empty(t, scheduled)
+
+	w = call(router, http.MethodPost, "/v1/admin/purge?older_than=24h&recovery_days=0", "admin", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	decodeEnvelope(t, w, &result)
+	assert.False(t, result.DryRun)
+	require.Len(t, result.Secrets, 1)
+	assert.Equal(t, ResultDeleted, result.Secrets[0].Result)
+	assert.Equal(t, map[string]int{"_tombstone_": 0}, scheduled)
+	assert.Len(t, store, 2)
+
+	for _, query := range []string{"?older_than=x", "?recovery_days=31"} {
+		w = call(router, http.MethodPost, "/v1/admin/purge"+query, "admin", "")
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func TestPurgeSkipsLiveRecords(t *testing.T) {
+	prometheusInit()
+	freshAuthThrottle(t)
+
+	h := MakeNewDummyHandlers()
+	store := memorySecrets(h)
+	scheduled := scheduledDeletions(h, store, time.Now().Add(-48*time.Hour))
+	router := v1Router(h)
+
+	store["_live_"] = "{}"
+	store["_rewritten_"] = "{}"
+	store["_tombstone_"] = "{}"
+	h.toLookup(entities.Data{PubKey: "live"}, "")
+
+	// Record is stored again after the tombstones were listed
+	mgr := h.SecretsManager.(*local_utils.TestSecretsManager)
+	list := mgr.ListTombstonesFn
+	mgr.ListTombstonesFn = func(ctx context.Context, prefix string, before time.Time) ([]local_utils.Tombstone, error) {
+		ret, err := list(ctx, prefix, before)
+		store["_rewritten_"] = `{"pubkey": "x"}`
+		return ret, err
+	}
+	schedule := mgr.ScheduleDeletionFn
+	mgr.ScheduleDeletionFn = func(ctx context.Context, name string, recoveryDays int) (string, error) {
+		assert.False(t, h.RecordMutex.TryLock(), "RecordMutex is not held")
+		return schedule(ctx, name, recoveryDays)
+	}
+
+	w := call(router, http.MethodPost, "/v1/admin/purge?older_than=24h", "admin", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var result PurgeResult
+	decodeEnvelope(t, w, &result)
+	require.Len(t, result.Secrets, 3)
+
+	results := make(map[string]string)
+	for _, secret := range result.Secrets {
+		results[secret.Name] = secret.Result
+	}
+	assert.Equal(t, map[string]string{"_live_": ResultSkipped, "_rewritten_": ResultSkipped, "_tombstone_": ResultScheduled}, results)
+	assert.Equal(t, map[string]int{"_tombstone_": DefaultRecoveryDays}, scheduled)
+	assert.Equal(t, `{"pubkey": "x"}`, store["_rewritten_"])
+}
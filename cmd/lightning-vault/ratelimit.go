@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	utils "github.com/bolt-observer/go_common/utils"
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// DefaultAuthFailureThreshold is the number of failed attempts tolerated before backoff kicks in
+	DefaultAuthFailureThreshold = 5
+	// DefaultAuthBackoffBase is the initial lockout after the threshold is reached
+	DefaultAuthBackoffBase = 1 * time.Second
+	// DefaultAuthBackoffMax is the longest lockout
+	DefaultAuthBackoffMax = 15 * time.Minute
+
+	// maxTrackedEntries is when we start pruning stale entries
+	maxTrackedEntries = 10000
+)
+
+type failureEntry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// FailureThrottle tracks failed authentication attempts per key (IP address or username)
+// and locks the key out with exponential backoff once the threshold is reached.
+type FailureThrottle struct {
+	Threshold int
+	Base      time.Duration
+	Max       time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]*failureEntry
+	now     func() time.Time
+}
+
+// NewFailureThrottle - creates a new FailureThrottle
+func NewFailureThrottle(threshold int, base, maxBackoff time.Duration) *FailureThrottle {
+	return &FailureThrottle{
+		Threshold: threshold,
+		Base:      base,
+		Max:       maxBackoff,
+		entries:   make(map[string]*failureEntry),
+		now:       time.Now,
+	}
+}
+
+// Blocked returns how long key is still locked out (zero when it is not)
+func (f *FailureThrottle) Blocked(key string) time.Duration {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	e, ok := f.entries[key]
+	if !ok {
+		return 0
+	}
+
+	remaining := e.lockedUntil.Sub(f.now())
+	if remaining < 0 {
+		return 0
+	}
+
+	return remaining
+}
+
+// Failure records a failed attempt for key
+func (f *FailureThrottle) Failure(key string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	now := f.now()
+
+	if len(f.entries) > maxTrackedEntries {
+		f.prune(now)
+	}
+
+	e, ok := f.entries[key]
+	if !ok {
+		e = &failureEntry{}
+		f.entries[key] = e
+	}
+
+	// Old failures are forgiven eventually
+	if now.Sub(e.lastFailure) > f.Max {
+		e.failures = 0
+	}
+
+	e.failures++
+	e.lastFailure = now
+
+	if f.Threshold <= 0 || e.failures < f.Threshold {
+		return
+	}
+
+	e.lockedUntil = now.Add(f.backoff(e.failures - f.Threshold))
+}
+
+// Success forgets about previous failures of key
+func (f *FailureThrottle) Success(key string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	delete(f.entries, key)
+}
+
+func (f *FailureThrottle) backoff(exponent int) time.Duration {
+	// Cap the exponent so we do not overflow
+	if exponent > 30 {
+		exponent = 30
+	}
+
+	d := time.Duration(float64(f.Base) * math.Pow(2, float64(exponent)))
+	if d > f.Max || d <= 0 {
+		d = f.Max
+	}
+
+	return d
+}
+
+func (f *FailureThrottle) prune(now time.Time) {
+	for k, v := range f.entries {
+		if now.After(v.lockedUntil) && now.Sub(v.lastFailure) > f.Max {
+			delete(f.entries, k)
+		}
+	}
+}
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+// PrincipalLimiter is a per-principal token bucket rate limiter
+type PrincipalLimiter struct {
+	Limit rate.Limit
+	Burst int
+
+	mutex    sync.Mutex
+	limiters map[string]*limiterEntry
+	now      func() time.Time
+}
+
+// NewPrincipalLimiter - creates a new PrincipalLimiter (limit is in requests per second)
+func NewPrincipalLimiter(limit float64, burst int) *PrincipalLimiter {
+	if burst <= 0 {
+		burst = 1
+	}
+
+	return &PrincipalLimiter{
+		Limit:    rate.Limit(limit),
+		Burst:    burst,
+		limiters: make(map[string]*limiterEntry),
+		now:      time.Now,
+	}
+}
+
+// Reserve checks whether principal may do a request now, when not it returns how long to wait
+func (p *PrincipalLimiter) Reserve(principal string) (bool, time.Duration) {
+	return p.ReserveN(principal, 1)
+}
+
+// ReserveN is Reserve for n requests at once (more than Burst are never allowed)
+func (p *PrincipalLimiter) ReserveN(principal string, n int) (bool, time.Duration) {
+	if p.Limit <= 0 || n <= 0 {
+		return true, 0
+	}
+
+	p.mutex.Lock()
+	now := p.now()
+
+	if len(p.limiters) > maxTrackedEntries {
+		p.prune(now)
+	}
+
+	e, ok := p.limiters[principal]
+	if !ok {
+		e = &limiterEntry{limiter: rate.NewLimiter(p.Limit, p.Burst)}
+		p.limiters[principal] = e
+	}
+	e.lastUsed = now
+	p.mutex.Unlock()
+
+	reservation := e.limiter.ReserveN(now, n)
+	if !reservation.OK() {
+		return false, rate.InfDuration
+	}
+	delay := reservation.DelayFrom(now)
+	if delay == 0 {
+		return true, 0
+	}
+
+	// Do not consume the token when we are rejecting the request
+	reservation.CancelAt(now)
+	return false, delay
+}
+
+// prune forgets limiters that have been idle long enough to refill completely (mutex must be held)
+func (p *PrincipalLimiter) prune(now time.Time) {
+	refill := time.Duration(float64(p.Burst) / float64(p.Limit) * float64(time.Second))
+	for k, v := range p.limiters {
+		if now.Sub(v.lastUsed) > refill {
+			delete(p.limiters, k)
+		}
+	}
+}
+
+var (
+	authThrottle = NewFailureThrottle(DefaultAuthFailureThreshold, DefaultAuthBackoffBase, DefaultAuthBackoffMax)
+	getLimiter   = NewPrincipalLimiter(0, 1)
+	// trustedProxies are peers whose X-Forwarded-For header is believed
+	trustedProxies []*net.IPNet
+)
+
+func configureThrottling() {
+	threshold, err := strconv.Atoi(utils.GetEnvWithDefault("AUTH_FAILURE_THRESHOLD", strconv.Itoa(DefaultAuthFailureThreshold)))
+	if err != nil {
+		fatalError("AUTH_FAILURE_THRESHOLD could not be parsed", err)
+	}
+	base, err := time.ParseDuration(utils.GetEnvWithDefault("AUTH_BACKOFF_BASE", DefaultAuthBackoffBase.String()))
+	if err != nil {
+		fatalError("AUTH_BACKOFF_BASE could not be parsed", err)
+	}
+	maxBackoff, err := time.ParseDuration(utils.GetEnvWithDefault("AUTH_BACKOFF_MAX", DefaultAuthBackoffMax.String()))
+	if err != nil {
+		fatalError("AUTH_BACKOFF_MAX could not be parsed", err)
+	}
+
+	authThrottle = NewFailureThrottle(threshold, base, maxBackoff)
+
+	limit, err := strconv.ParseFloat(utils.GetEnvWithDefault("GET_RATE_LIMIT", "0"), 64)
+	if err != nil {
+		fatalError("GET_RATE_LIMIT could not be parsed", err)
+	}
+	burst, err := strconv.Atoi(utils.GetEnvWithDefault("GET_RATE_BURST", "10"))
+	if err != nil {
+		fatalError("GET_RATE_BURST could not be parsed", err)
+	}
+
+	getLimiter = NewPrincipalLimiter(limit, burst)
+
+	trustedProxies, err = parseTrustedProxies(utils.GetEnvWithDefault("TRUSTED_PROXIES", ""))
+	if err != nil {
+		fatalError("TRUSTED_PROXIES could not be parsed", err)
+	}
+}
+
+// parseTrustedProxies parses a comma separated list of IP addresses and CIDR ranges
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	ret := make([]*net.IPNet, 0)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %s", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, network)
+	}
+
+	return ret, nil
+}
+
+func isTrustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// peerMiddleware remembers the address of the peer before handlers.ProxyHeaders replaces it with X-Forwarded-For
+func peerMiddleware() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), peerKey, r.RemoteAddr)))
+		})
+	}
+}
+
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
+
+// remoteIP returns the address of the client, X-Forwarded-For is only followed through trusted proxies
+func remoteIP(r *http.Request) string {
+	peer, ok := r.Context().Value(peerKey).(string)
+	if !ok {
+		peer = r.RemoteAddr
+	}
+
+	ip := hostOf(peer)
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+
+	// Rightmost entries were added by our proxies, anything left of the first untrusted one could be forged
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			continue
+		}
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+
+	return ip
+}
+
+func tooManyRequests(w http.ResponseWriter, r *http.Request, retryAfter time.Duration, reason string) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	metrics.Throttled(throttleLabels{Reason: reason, Method: r.Method}).Inc()
+	failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Throttled (%s) for %ds", reason, seconds), r.Method)
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	respondError(w, r, http.StatusTooManyRequests, CodeRateLimited, "Too many requests")
+}
+
+func rateLimitMiddleware(limiter *PrincipalLimiter) mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ok, delay := limiter.Reserve(getPrincipal(r))
+			if !ok {
+				tooManyRequests(w, r, delay, "rate_limit")
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailureThrottle(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	f := NewFailureThrottle(3, time.Second, time.Minute)
+	f.now = func() time.Time { return now }
+
+	f.Failure("a")
+	f.Failure("a")
+	assert.Equal(t, time.Duration(0), f.Blocked("a"))
+
+	f.Failure("a")
+	assert.Equal(t, time.Second, f.Blocked("a"))
+
+	f.Failure("a")
+	assert.Equal(t, 2*time.Second, f.Blocked("a"))
+
+	for i := 0; i < 20; i++ {
+		f.Failure("a")
+	}
+	assert.Equal(t, time.Minute, f.Blocked("a"))
+	assert.Equal(t, time.Duration(0), f.Blocked("b"))
+
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, time.Duration(0), f.Blocked("a"))
+
+	// Old failures are forgotten
+	f.Failure("a")
+	assert.Equal(t, time.Duration(0), f.Blocked("a"))
+
+	f.Failure("a")
+	f.Failure("a")
+	f.Success("a")
+	f.Failure("a")
+	assert.Equal(t, time.Duration(0), f.Blocked("a"))
+}
+
+func TestPrincipalLimiter(t *testing.T) {
+	unlimited := NewPrincipalLimiter(0, 0)
+	for i := 0; i < 100; i++ {
+		ok, _ := unlimited.Reserve("user")
+		assert.True(t, ok)
+	}
+
+	limiter := NewPrincipalLimiter(0.01, 2)
+
+	ok, _ := limiter.Reserve("user1")
+	assert.True(t, ok)
+	ok, _ = limiter.Reserve("user1")
+	assert.True(t, ok)
+	ok, delay := limiter.Reserve("user1")
+	assert.False(t, ok)
+	assert.Greater(t, delay, time.Duration(0))
+
+	ok, _ = limiter.Reserve("user2")
+	assert.True(t, ok)
+
+	// More than the burst never fits, a rejected reservation takes nothing
+	ok, _ = limiter.ReserveN("user3", 3)
+	assert.False(t, ok)
+	ok, _ = limiter.ReserveN("user3", 2)
+	assert.True(t, ok)
+	ok, _ = limiter.ReserveN("user3", 0)
+	assert.True(t, ok)
+}
+
+func TestPrincipalLimiterPrune(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	limiter := NewPrincipalLimiter(1, 2)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i <= maxTrackedEntries; i++ {
+		limiter.Reserve(fmt.Sprintf("user%d", i))
+	}
+	assert.Len(t, limiter.limiters, maxTrackedEntries+1)
+
+	now = now.Add(time.Second)
+	limiter.Reserve("active")
+	assert.Len(t, limiter.limiters, maxTrackedEntries+2)
+
+	// Idle limiters are full again and forgotten
+	now = now.Add(2 * time.Second)
+	limiter.Reserve("active")
+	assert.Len(t, limiter.limiters, 1)
+}
+
+func TestRemoteIP(t *testing.T) {
+	old := trustedProxies
+	defer func() { trustedProxies = old }()
+
+	var err error
+	trustedProxies, err = parseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	assert.NoError(t, err)
+
+	_, err = parseTrustedProxies("10.0.0.300")
+	assert.Error(t, err)
+
+	request := func(peer string, forwarded ...string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "https://localhost/", nil)
+		r.RemoteAddr = peer
+		for _, f := range forwarded {
+			r.Header.Add("X-Forwarded-For", f)
+		}
+
+		// Like in main ProxyHeaders runs after the peer is remembered
+		var ret *http.Request
+		peerMiddleware()(handlers.ProxyHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { ret = r }))).ServeHTTP(httptest.NewRecorder(), r)
+		return ret
+	}
+
+	assert.Equal(t, "1.2.3.4", remoteIP(request("1.2.3.4:1234")))
+	// Header is ignored when the peer is not a proxy
+	assert.Equal(t, "1.2.3.4", remoteIP(request("1.2.3.4:1234", "5.6.7.8")))
+	assert.Equal(t, "5.6.7.8", remoteIP(request("10.1.2.3:1234", "5.6.7.8")))
+	// Forged entries to the left are skipped
+	assert.Equal(t, "5.6.7.8", remoteIP(request("192.168.1.1:1234", "9.9.9.9, 5.6.7.8, 10.0.0.1")))
+	assert.Equal(t, "5.6.7.8", remoteIP(request("10.1.2.3:1234", "9.9.9.9", "5.6.7.8")))
+	assert.Equal(t, "10.1.2.3", remoteIP(request("10.1.2.3:1234")))
+	assert.Equal(t, "10.0.0.1", remoteIP(request("10.1.2.3:1234", "10.0.0.1")))
+}
+
+func TestAuthThrottle(t *testing.T) {
+	prometheusInit()
+
+	old := authThrottle
+	authThrottle = NewFailureThrottle(2, time.Minute, time.Hour)
+	defer func() { authThrottle = old }()
+
+	router := mux.NewRouter()
+	router.Use(authMiddleware(map[string]string{"user1": "pass1"}))
+	router.Path("/").Methods(http.MethodGet).HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+
+	auth("user1", "wrong", http.StatusUnauthorized, router, t)
+	auth("user1", "wrong", http.StatusUnauthorized, router, t)
+
+	r := httptest.NewRequest(http.MethodGet, "https://localhost/", nil)
+	w := httptest.NewRecorder()
+	r.SetBasicAuth("user1", "pass1")
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Result().StatusCode)
+	assert.Equal(t, "60", w.Result().Header.Get("Retry-After"))
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	prometheusInit()
+
+	router := mux.NewRouter()
+	router.Use(authMiddleware(map[string]string{"user1": "pass1", "user2": "pass2"}))
+	router.Use(rateLimitMiddleware(NewPrincipalLimiter(0.01, 1)))
+	router.Path("/").Methods(http.MethodGet).HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+
+	auth("user1", "pass1", http.StatusOK, router, t)
+	auth("user1", "pass1", http.StatusTooManyRequests, router, t)
+	auth("user2", "pass2", http.StatusOK, router, t)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	entities "github.com/bolt-observer/go_common/entities"
+	local_utils "github.com/bolt-observer/lightning-vault/utils"
+	sentry "github.com/getsentry/sentry-go"
+	"github.com/gorilla/mux"
+)
+
+// Routes under /v1/ respond with JSON (see APIResponse), the original routes keep their free-text responses.
+
+// APIVersion is the current versioned API prefix
+const APIVersion = "v1"
+
+// RequestIDHeader is the HTTP header carrying the request ID
+const RequestIDHeader = "X-Request-Id"
+
+// ErrorCode is a stable, machine readable error identifier
+type ErrorCode string
+
+// ErrorCode values
+const (
+	CodeBadRequest            ErrorCode = "bad_request"
+	CodeJSONInvalid           ErrorCode = "json_invalid"
+	CodePubkeyInvalid         ErrorCode = "pubkey_invalid"
+	CodeUniqueIDInvalid       ErrorCode = "unique_id_invalid"
+	CodeEndpointInvalid       ErrorCode = "endpoint_invalid"
+	CodeCertificateInvalid    ErrorCode = "certificate_invalid"
+	CodeAuthenticatorInvalid  ErrorCode = "authenticator_invalid"
+	CodeAPITypeInvalid        ErrorCode = "api_type_invalid"
+	CodeJustificationRequired ErrorCode = "justification_required"
+	CodeTagInvalid            ErrorCode = "tag_invalid"
+	CodeVerifyFailed          ErrorCode = "verify_failed"
+	CodeNotFound              ErrorCode = "not_found"
+	CodeConflict              ErrorCode = "conflict"
+	CodeForbidden             ErrorCode = "forbidden"
+	CodeGone                  ErrorCode = "gone"
+	CodeUnauthorized          ErrorCode = "unauthorized"
+	CodeRateLimited           ErrorCode = "rate_limited"
+	CodeUnavailable           ErrorCode = "unavailable"
+	CodeInternal              ErrorCode = "internal_error"
+)
+
+// Result values of OperationResult
+const (
+	ResultCreated         = "created"
+	ResultUpdated         = "updated"
+	ResultDeleted         = "deleted"
+	ResultExists          = "exists"
+	ResultVerified        = "verified"
+	ResultPendingApproval = "pending_approval"
+	ResultApproved        = "approved"
+	ResultRejected        = "rejected"
+	ResultMoved           = "moved"
+	ResultCopied          = "copied"
+	ResultUnchanged       = "unchanged"
+	ResultScheduled       = "scheduled"
+	ResultSkipped         = "skipped"
+)
+
+// APIError struct
+type APIError struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+// APIResponse is the envelope of every /v1/ response
+type APIResponse struct {
+	RequestID string      `json:"request_id"`
+	Result    interface{} `json:"result,omitempty"`
+	Error     *APIError   `json:"error,omitempty"`
+}
+
+// OperationResult is the result of put, delete, query, verify and approval calls
+type OperationResult struct {
+	PubKey          string `json:"pubkey"`
+	UniqueID        string `json:"unique_id,omitempty"`
+	Result          string `json:"result"`
+	ChangeRequestID string `json:"change_request_id,omitempty"`
+}
+
+// GetResult is the result of a get call
+type GetResult struct {
+	entities.Data
+	local_utils.CredentialInfo
+	UniqueID string `json:"unique_id,omitempty"`
+}
+
+const (
+	requestIDKey  contextKey = "requestID"
+	apiVersionKey contextKey = "apiVersion"
+)
+
+// randomID returns a short random identifier (used for request and issuance IDs)
+func randomID() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// getRequestID returns the ID assigned to the request by requestIDMiddleware
+func getRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// isV1 returns whether the request came through the versioned API
+func isV1(r *http.Request) bool {
+	version, _ := r.Context().Value(apiVersionKey).(string)
+	return version == APIVersion
+}
+
+func requestIDMiddleware() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := randomID()
+			w.Header().Set(RequestIDHeader, id)
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+		})
+	}
+}
+
+func versionMiddleware(version string) mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey, version)))
+		})
+	}
+}
+
+func writeEnvelope(w http.ResponseWriter, r *http.Request, status int, response APIResponse) {
+	response.RequestID = getRequestID(r)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	err := encoder.Encode(&response)
+	if err != nil {
+		sentry.CaptureException(err)
+	}
+}
+
+// respondError writes an error, message is used as-is for the old routes
+func respondError(w http.ResponseWriter, r *http.Request, status int, code ErrorCode, message string) {
+	if isV1(r) {
+		writeEnvelope(w, r, status, APIResponse{Error: &APIError{Code: code, Message: message}})
+		return
+	}
+
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s\n", message)
+}
+
+// respond writes result, the old routes get the legacy text instead
+func respond(w http.ResponseWriter, r *http.Request, status int, result interface{}, legacy string) {
+	if isV1(r) {
+		writeEnvelope(w, r, status, APIResponse{Result: result})
+		return
+	}
+
+	w.WriteHeader(status)
+	fmt.Fprint(w, legacy)
+}
+
+// respondJSON writes result, the old routes get legacy encoded as bare JSON
+func respondJSON(w http.ResponseWriter, r *http.Request, status int, result interface{}, legacy interface{}) {
+	if isV1(r) {
+		writeEnvelope(w, r, status, APIResponse{Result: result})
+		return
+	}
+
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	err := encoder.Encode(legacy)
+	if err != nil {
+		sentry.CaptureException(err)
+	}
+}
+
+func notFound(w http.ResponseWriter, r *http.Request) {
+	respondError(w, r, http.StatusNotFound, CodeNotFound, "Not found")
+}
+
+func internalError(w http.ResponseWriter, r *http.Request) {
+	respondError(w, r, http.StatusInternalServerError, CodeInternal, "Internal error")
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	entities "github.com/bolt-observer/go_common/entities"
+	local_utils "github.com/bolt-observer/lightning-vault/utils"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func v1Router(h *Handlers) *mux.Router {
+	router := mux.NewRouter()
+	router.Use(requestIDMiddleware())
+
+	read := map[string]string{"reader": "pass"}
+	write := map[string]string{"writer": "pass"}
+	query := map[string]string{"reader": "pass", "writer": "pass"}
+
+	credentials := RouteCredentials{Read: read, Write: write, Query: query, BreakGlass: map[string]string{"breakglass": "pass"}, Admin: map[string]string{"admin": "pass"}}
+
+	h.registerRoutes(router, credentials)
+	v1 := router.PathPrefix("/" + APIVersion).Subrouter()
+	v1.Use(versionMiddleware(APIVersion))
+	h.registerRoutes(v1, credentials)
+
+	return router
+}
+
+// freshAuthThrottle isolates failed authentication attempts of a test (all requests come from the same address)
+func freshAuthThrottle(t *testing.T) {
+	old := authThrottle
+	authThrottle = NewFailureThrottle(DefaultAuthFailureThreshold, DefaultAuthBackoffBase, DefaultAuthBackoffMax)
+	t.Cleanup(func() { authThrottle = old })
+}
+
+func call(router *mux.Router, method, path, user, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "https://localhost"+path, strings.NewReader(body))
+	r.SetBasicAuth(user, "pass")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func decodeEnvelope(t *testing.T, w *httptest.ResponseRecorder, result interface{}) APIResponse {
+	var response APIResponse
+	if result != nil {
+		response.Result = result
+	}
+
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, w.Header().Get(RequestIDHeader), response.RequestID)
+	assert.NotEmpty(t, response.RequestID)
+
+	return response
+}
+
+func TestV1Responses(t *testing.T) {
+	prometheusInit()
+	freshAuthThrottle(t)
+
+	old := readDurations
+	readDurations = map[string]time.Duration{"reader|pass": time.Hour}
+	defer func() { readDurations = old }()
+
+	h := MakeNewDummyHandlers()
+	h.VerifyCall = func(w http.ResponseWriter, r *http.Request, data *entities.Data, pubkey, uniqueID string) bool {
+		return true
+	}
+	mgr := h.SecretsManager.(*local_utils.TestSecretsManager)
+	mgr.InsertOrUpdateSecretFn = func(ctx context.Context, name, value string, metadata local_utils.Metadata) (string, local_utils.Change, error) {
+		return "", local_utils.Inserted, nil
+	}
+	mgr.DeleteSecretFn = func(ctx context.Context, name string) (string, error) {
+		return name, nil
+	}
+
+	router := v1Router(h)
+	pubkey := "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7"
+
+	valid := `{
+		"pubkey": "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7",
+		"macaroon_hex": "0201036c6e640224030a10b493608461fb6e64810053fa31ef27991201301a0c0a04696e666f120472656164000216697061646472203139322e3136382e3139322e3136380000062072ea006233da839ce6e9f4721331a12041b228d36c0fdad552680f615766d2f4",
+		"certificate_base64": "LS0tLS1CRUdJTiBDRVJUSUZJQ0FURS0tLS0tCk1JSUNKakNDQWN5Z0F3SUJBZ0lRUmU4QzhCcURubEF3b0VxRjdMRTVGREFLQmdncWhrak9QUVFEQWpBeE1SOHcKSFFZRFZRUUtFeFpzYm1RZ1lYVjBiMmRsYm1WeVlYUmxaQ0JqWlhKME1RNHdEQVlEVlFRREV3VmhiR2xqWlRBZQpGdzB5TXpBeE1ESXhOVE0xTXpsYUZ3MHlOREF5TWpjeE5UTTFNemxhTURFeEh6QWRCZ05WQkFvVEZteHVaQ0JoCmRYUnZaMlZ1WlhKaGRHVmtJR05sY25ReERqQU1CZ05WQkFNVEJXRnNhV05sTUZrd0V3WUhLb1pJemowQ0FRWUkKS29aSXpqMERBUWNEUWdBRXlKaHRYWk1NT0NQYzYxWmlISmVyKzdHUm9HalFzcWtNcjdvQVVjNnZsZC9JNDl2SwpHR01mRjhMcDhTSm1jNlJVOHQxN3FEZFhyUmZMbTdLSjB0eDBkcU9CeFRDQndqQU9CZ05WSFE4QkFmOEVCQU1DCkFxUXdFd1lEVlIwbEJBd3dDZ1lJS3dZQkJRVUhBd0V3RHdZRFZSMFRBUUgvQkFVd0F3RUIvekFkQmdOVkhRNEUKRmdRVU5BUW5BYVBNOStrZEpxMXdud2FtbldpY1d1SXdhd1lEVlIwUkJHUXdZb0lGWVd4cFkyV0NDV3h2WTJGcwphRzl6ZElJRllXeHBZMldDRG5CdmJHRnlMVzQyTFdGc2FXTmxnZ1IxYm1sNGdncDFibWw0Y0dGamEyVjBnZ2RpCmRXWmpiMjV1aHdSL0FBQUJoeEFBQUFBQUFBQUFBQUFBQUFBQUFBQUJod1NzR0FBQ01Bb0dDQ3FHU000OUJBTUMKQTBnQU1FVUNJUUQ2dElDMVdTWFRWNkpuSzVlN3FkdDRBVHp2Q0ZHUldPTmp2T29tUUdScXB3SWdiR1ZJWFVPbgpHamlUdTZ5MXVMT1pRS0VPTnB1MXZkYUNKejVpanNRdlVndz0KLS0tLS1FTkQgQ0VSVElGSUNBVEUtLS0tLQo=",
+		"endpoint": "192.168.192.168:10009"
+	  }
+	`
+
+	// Put
+	w := call(router, http.MethodPost, "/v1/put/", "writer", valid)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	put := &OperationResult{}
+	decodeEnvelope(t, w, put)
+	assert.Equal(t, OperationResult{PubKey: pubkey, Result: ResultCreated}, *put)
+
+	// Old routes are unchanged
+	w = call(router, http.MethodPost, "/put/", "writer", valid)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "Inserted secret "+pubkey, w.Body.String())
+
+	w = call(router, http.MethodGet, "/query/"+pubkey, "reader", "")
+	assert.Equal(t, "Macaroon exists\n", w.Body.String())
+
+	// Get
+	w = call(router, http.MethodGet, "/v1/get/"+pubkey, "reader", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	get := &GetResult{}
+	decodeEnvelope(t, w, get)
+	assert.Equal(t, pubkey, get.PubKey)
+	assert.NotEmpty(t, get.MacaroonHex)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), get.ExpiresAt, 5*time.Second)
+	assert.Equal(t, "macaroon", get.AuthenticatorType)
+	assert.Len(t, get.Caveats, 1)
+	assert.NotEmpty(t, get.IssuanceID)
+	assert.Equal(t, get.IssuanceID, w.Header().Get(local_utils.IssuanceIDHeader))
+
+	// Old route gets the same info in headers
+	w = call(router, http.MethodGet, "/get/"+pubkey, "reader", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	info, err := local_utils.CredentialInfoFromHeaders(w.Header())
+	require.NoError(t, err)
+	require.NotNil(t, info)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), info.ExpiresAt, 5*time.Second)
+	assert.Equal(t, "macaroon", info.AuthenticatorType)
+
+	// Query
+	w = call(router, http.MethodGet, "/v1/query/"+pubkey, "reader", "")
+	query := &OperationResult{}
+	decodeEnvelope(t, w, query)
+	assert.Equal(t, ResultExists, query.Result)
+
+	// Errors
+	w = call(router, http.MethodGet, "/v1/query/nonexisting", "reader", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	response := decodeEnvelope(t, w, nil)
+	require.NotNil(t, response.Error)
+	assert.Equal(t, CodeNotFound, response.Error.Code)
+	assert.Nil(t, response.Result)
+
+	w = call(router, http.MethodPost, "/v1/put/", "writer", strings.Replace(valid, pubkey, "invalid", 1))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	response = decodeEnvelope(t, w, nil)
+	assert.Equal(t, CodePubkeyInvalid, response.Error.Code)
+	assert.Equal(t, "pubkey validation failed", response.Error.Message)
+
+	w = call(router, http.MethodPost, "/put/", "writer", strings.Replace(valid, pubkey, "invalid", 1))
+	assert.Equal(t, "Bad request - pubkey validation failed\n", w.Body.String())
+
+	w = call(router, http.MethodGet, "/v1/get/"+pubkey, "writer", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	response = decodeEnvelope(t, w, nil)
+	assert.Equal(t, CodeUnauthorized, response.Error.Code)
+
+	h.VerifyCall = func(w http.ResponseWriter, r *http.Request, data *entities.Data, pubkey, uniqueID string) bool {
+		h.badRequest(w, r, CodeVerifyFailed, "invalid credentials - check failed", "test")
+		return false
+	}
+	w = call(router, http.MethodGet, "/v1/verify/"+pubkey, "writer", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	response = decodeEnvelope(t, w, nil)
+	assert.Equal(t, CodeVerifyFailed, response.Error.Code)
+
+	// Delete
+	w = call(router, http.MethodDelete, "/v1/delete/"+pubkey, "writer", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	del := &OperationResult{}
+	decodeEnvelope(t, w, del)
+	assert.Equal(t, ResultDeleted, del.Result)
+}
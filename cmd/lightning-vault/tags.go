@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	entities "github.com/bolt-observer/go_common/entities"
+	utils "github.com/bolt-observer/go_common/utils"
+	local_utils "github.com/bolt-observer/lightning-vault/utils"
+	"github.com/gorilla/mux"
+)
+
+// Alphanumeric tags that are not pubkeys double as aliases, /get/alice works instead of /get/<pubkey> when alice is a tag of
+// exactly one node (per uniqueId).
+
+// aliasKey identifies an alias, aliases are separate per uniqueId
+type aliasKey struct {
+	Alias    string
+	UniqueID string
+}
+
+// TagsPayload is the payload for adding or removing tags
+type TagsPayload struct {
+	Tags []string `json:"tags"`
+}
+
+// TagsResult is the result of tag calls
+type TagsResult struct {
+	PubKey   string   `json:"pubkey"`
+	UniqueID string   `json:"unique_id,omitempty"`
+	Tags     []string `json:"tags"`
+}
+
+// AliasResult is the result of an alias resolution
+type AliasResult struct {
+	Alias    string `json:"alias"`
+	UniqueID string `json:"unique_id,omitempty"`
+	PubKey   string `json:"pubkey"`
+}
+
+func isAlias(tag string) bool {
+	return tag != "" && utils.AlphaNumeric.MatchString(tag) && !utils.ValidatePubkey(tag)
+}
+
+func splitTags(tags string) []string {
+	ret := make([]string, 0)
+	if tags == "" {
+		return ret
+	}
+
+	for _, tag := range strings.Split(tags, local_utils.Delimiter) {
+		if tag != "" {
+			ret = append(ret, tag)
+		}
+	}
+
+	return ret
+}
+
+// aliasesOf returns the tags of data that are used as aliases
+func aliasesOf(data entities.Data) []string {
+	ret := make([]string, 0)
+	for _, tag := range splitTags(data.Tags) {
+		if isAlias(tag) {
+			ret = append(ret, tag)
+		}
+	}
+
+	return ret
+}
+
+// dropAliases removes aliases pointing to data, LookupMutex must be held
+func (h *Handlers) dropAliases(data entities.Data, uniqueID string) {
+	for _, alias := range aliasesOf(data) {
+		key := aliasKey{Alias: alias, UniqueID: uniqueID}
+		if h.aliases[key] == data.PubKey {
+			delete(h.aliases, key)
+		}
+	}
+}
+
+// resolveAlias returns the pubkey alias points to
+func (h *Handlers) resolveAlias(alias, uniqueID string) (string, bool) {
+	h.LookupMutex.RLock()
+	defer h.LookupMutex.RUnlock()
+
+	pubkey, ok := h.aliases[aliasKey{Alias: alias, UniqueID: uniqueID}]
+	return pubkey, ok
+}
+
+// resolve returns the record for name (pubkey or alias) + uniqueID, alias lookups are written to the audit log
+func (h *Handlers) resolve(r *http.Request, name, uniqueID string) (entities.Data, bool) {
+	if !isAlias(name) {
+		return h.lookup(name + uniqueID)
+	}
+
+	pubkey, ok := h.resolveAlias(name, uniqueID)
+	if !ok {
+		return entities.Data{}, false
+	}
+
+	auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Alias %s (%s) resolved to %s", name, uniqueID, pubkey), r.Method)
+
+	return h.lookup(pubkey + uniqueID)
+}
+
+// aliasConflict checks whether any alias of data is already used by another node
+func (h *Handlers) aliasConflict(data entities.Data, uniqueID string) *requestError {
+	h.LookupMutex.RLock()
+	defer h.LookupMutex.RUnlock()
+
+	for _, alias := range aliasesOf(data) {
+		pubkey, exists := h.aliases[aliasKey{Alias: alias, UniqueID: uniqueID}]
+		if exists && pubkey != data.PubKey {
+			return &requestError{
+				Code:      CodeConflict,
+				Reason:    fmt.Sprintf("alias %s is already used by %s", alias, pubkey),
+				LogReason: fmt.Sprintf("alias %s (%s) of %s is already used by %s", alias, uniqueID, data.PubKey, pubkey),
+			}
+		}
+	}
+
+	return nil
+}
+
+// obtainPubkey returns the pubkey route parameter, it has to be an actual pubkey (no alias)
+func (h *Handlers) obtainPubkey(w http.ResponseWriter, r *http.Request) (string, error) {
+	pubkey := mux.Vars(r)["pubkey"]
+	if !utils.ValidatePubkey(pubkey) {
+		h.badRequest(w, r, CodePubkeyInvalid, "pubkey validation failed", fmt.Sprintf("pubkey validation failed: %v", pubkey))
+		return "", fmt.Errorf("invalid parameter")
+	}
+
+	return pubkey, nil
+}
+
+// ListTagsHandler - lists tags of a node
+func (h *Handlers) ListTagsHandler(w http.ResponseWriter, r *http.Request) {
+	pubkey, err := h.obtainPubkey(w, r)
+	if err != nil {
+		return
+	}
+
+	uniqueID, err := h.obtainUniqueID(w, r)
+	if err != nil {
+		return
+	}
+
+	auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("List tags %s (%s)", pubkey, uniqueID), r.Method)
+
+	data, ok := h.lookup(pubkey + uniqueID)
+	if !ok {
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[Tags] Secret %s not found", pubkey), r.Method)
+		notFound(w, r)
+		return
+	}
+
+	result := TagsResult{PubKey: pubkey, UniqueID: uniqueID, Tags: splitTags(data.Tags)}
+	respondJSON(w, r, http.StatusOK, result, result)
+}
+
+// AddTagsHandler - adds tags to a node without touching the secret
+func (h *Handlers) AddTagsHandler(w http.ResponseWriter, r *http.Request) {
+	h.modifyTags(w, r, true)
+}
+
+// RemoveTagsHandler - removes tags from a node without touching the secret
+func (h *Handlers) RemoveTagsHandler(w http.ResponseWriter, r *http.Request) {
+	h.modifyTags(w, r, false)
+}
+
+func (h *Handlers) modifyTags(w http.ResponseWriter, r *http.Request, add bool) {
+	var payload TagsPayload
+
+	pubkey, err := h.obtainPubkey(w, r)
+	if err != nil {
+		return
+	}
+
+	uniqueID, err := h.obtainUniqueID(w, r)
+	if err != nil {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&payload)
+	if err != nil {
+		h.badRequest(w, r, CodeJSONInvalid, "json decoding failed", fmt.Sprintf("[Tags] json decoding failed: %v", err))
+		return
+	}
+
+	if len(payload.Tags) == 0 {
+		h.badRequest(w, r, CodeTagInvalid, "no tags given", "[Tags] no tags given")
+		return
+	}
+
+	for _, tag := range payload.Tags {
+		if tag == "" || strings.Contains(tag, local_utils.Delimiter) {
+			h.badRequest(w, r, CodeTagInvalid, fmt.Sprintf("invalid tag %q", tag), fmt.Sprintf("[Tags] invalid tag %q", tag))
+			return
+		}
+	}
+
+	operation := "Remove"
+	if add {
+		operation = "Add"
+	}
+
+	auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("%s tags %v to %s (%s)", operation, payload.Tags, pubkey, uniqueID), r.Method)
+
+	// Serialize read-modify-write of records
+	h.RecordMutex.Lock()
+	defer h.RecordMutex.Unlock()
+
+	data, ok := h.lookup(pubkey + uniqueID)
+	if !ok {
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[Tags] Secret %s not found", pubkey), r.Method)
+		notFound(w, r)
+		return
+	}
+
+	tags := splitTags(data.Tags)
+	if add {
+		tags = appendTags(tags, payload.Tags)
+	} else {
+		tags = removeTags(tags, payload.Tags)
+	}
+
+	result := TagsResult{PubKey: pubkey, UniqueID: uniqueID, Tags: tags}
+
+	newTags := strings.Join(tags, local_utils.Delimiter)
+	if newTags == data.Tags {
+		respondJSON(w, r, http.StatusOK, result, result)
+		return
+	}
+	data.Tags = newTags
+
+	if reqErr := h.aliasConflict(data, uniqueID); reqErr != nil {
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[Tags] %s", reqErr.LogReason), r.Method)
+		respondError(w, r, http.StatusConflict, reqErr.Code, reqErr.Reason)
+		return
+	}
+
+	if approvalRequired {
+		h.submitChangeRequest(w, r, OperationPut, &data, uniqueID, false)
+		return
+	}
+
+	_, err = h.storeSecret(context.Background(), &data, uniqueID)
+	if err != nil {
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("AWS put secret failed with error %v", err), r.Method)
+		internalError(w, r)
+		return
+	}
+
+	respondJSON(w, r, http.StatusOK, result, result)
+}
+
+func appendTags(tags, add []string) []string {
+	for _, tag := range add {
+		if !containsTag(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
+
+func removeTags(tags, remove []string) []string {
+	ret := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if !containsTag(remove, tag) {
+			ret = append(ret, tag)
+		}
+	}
+
+	return ret
+}
+
+func containsTag(tags []string, tag string) bool {
+	for _, one := range tags {
+		if one == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AliasHandler - resolves an alias to its pubkey
+func (h *Handlers) AliasHandler(w http.ResponseWriter, r *http.Request) {
+	alias := mux.Vars(r)["alias"]
+
+	uniqueID, err := h.obtainUniqueID(w, r)
+	if err != nil {
+		return
+	}
+
+	auditLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("Resolve alias %s (%s)", alias, uniqueID), r.Method)
+
+	pubkey, ok := h.resolveAlias(alias, uniqueID)
+	if !ok {
+		failureLog(r.Header.Get("Authorization"), r.RemoteAddr, fmt.Sprintf("[Alias] Alias %s not found", alias), r.Method)
+		notFound(w, r)
+		return
+	}
+
+	result := AliasResult{Alias: alias, UniqueID: uniqueID, PubKey: pubkey}
+	respondJSON(w, r, http.StatusOK, result, result)
+}
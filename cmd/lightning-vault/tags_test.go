@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	entities "github.com/bolt-observer/go_common/entities"
+	local_utils "github.com/bolt-observer/lightning-vault/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAliasLookup(t *testing.T) {
+	pubkey := "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7"
+	other := "02aa0a3b1d4d46d7fe7ab57b07f8ac6eac11c8d1dbaaf2d6c4f51bbd0dc8ae2c6e"
+
+	h := MakeNewDummyHandlers()
+	r := httptest.NewRequest(http.MethodGet, "https://localhost/get/alice", nil)
+
+	h.toLookup(entities.Data{PubKey: pubkey, Tags: "alice,bob,not valid!"}, "")
+	// bob is already taken, only carol is used
+	h.toLookup(entities.Data{PubKey: other, Tags: "bob,carol"}, "")
+	// Same alias for a different uniqueId is fine
+	h.toLookup(entities.Data{PubKey: other, Tags: "alice"}, "id1")
+
+	data, ok := h.resolve(r, "alice", "")
+	assert.True(t, ok)
+	assert.Equal(t, pubkey, data.PubKey)
+	data, ok = h.resolve(r, "alice", "id1")
+	assert.True(t, ok)
+	assert.Equal(t, other, data.PubKey)
+	data, ok = h.resolve(r, "bob", "")
+	assert.True(t, ok)
+	assert.Equal(t, pubkey, data.PubKey)
+	data, ok = h.resolve(r, other, "")
+	assert.True(t, ok)
+	assert.Equal(t, other, data.PubKey)
+	_, ok = h.resolve(r, "not valid!", "")
+	assert.False(t, ok)
+
+	// Aliases are not part of the lookup table
+	_, ok = h.lookup("alice")
+	assert.False(t, ok)
+
+	err := h.aliasConflict(entities.Data{PubKey: other, Tags: "carol,alice"}, "")
+	require.NotNil(t, err)
+	assert.Equal(t, CodeConflict, err.Code)
+	assert.Contains(t, err.Reason, "alice")
+	assert.Nil(t, h.aliasConflict(entities.Data{PubKey: pubkey, Tags: "alice,dave"}, ""))
+
+	// Updating tags drops old aliases (but not the ones of other nodes)
+	h.toLookup(entities.Data{PubKey: pubkey, Tags: "dave"}, "")
+	_, ok = h.resolve(r, "alice", "")
+	assert.False(t, ok)
+	_, ok = h.resolve(r, "bob", "")
+	assert.False(t, ok)
+	data, ok = h.resolve(r, "dave", "")
+	assert.True(t, ok)
+	assert.Equal(t, pubkey, data.PubKey)
+
+	h.deleteLookup(entities.Data{PubKey: other, Tags: "bob,carol"}, "")
+	_, ok = h.resolve(r, "carol", "")
+	assert.False(t, ok)
+	data, ok = h.resolve(r, "dave", "")
+	assert.True(t, ok)
+	assert.Equal(t, pubkey, data.PubKey)
+}
+
+func TestTagHandlers(t *testing.T) {
+	prometheusInit()
+	freshAuthThrottle(t)
+
+	pubkey := "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7"
+	other := "02aa0a3b1d4d46d7fe7ab57b07f8ac6eac11c8d1dbaaf2d6c4f51bbd0dc8ae2c6e"
+
+	h := MakeNewDummyHandlers()
+	stored := make(map[string]string)
+	mgr := h.SecretsManager.(*local_utils.TestSecretsManager)
+	mgr.InsertOrUpdateSecretFn = func(ctx context.Context, name, value string, metadata local_utils.Metadata) (string, local_utils.Change, error) {
+		stored[name] = value
+		return "", local_utils.Updated, nil
+	}
+
+	h.toLookup(entities.Data{PubKey: pubkey, MacaroonHex: testMacaroon, Tags: "alice"}, "")
+	h.toLookup(entities.Data{PubKey: other, MacaroonHex: testMacaroon, Tags: "bob"}, "")
+
+	router := v1Router(h)
+
+	w := call(router, http.MethodGet, "/v1/tags/"+pubkey, "writer", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var result TagsResult
+	decodeEnvelope(t, w, &result)
+	assert.Equal(t, []string{"alice"}, result.Tags)
+
+	w = call(router, http.MethodPost, "/v1/tags/"+pubkey, "writer", `{"tags": ["prod", "alice", "carol"]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	result = TagsResult{}
+	decodeEnvelope(t, w, &result)
+	assert.Equal(t, []string{"alice", "prod", "carol"}, result.Tags)
+
+	// Secret itself is kept
+	var data entities.Data
+	require.NoError(t, json.Unmarshal([]byte(stored["_"+pubkey+"_"]), &data))
+	assert.Equal(t, testMacaroon, data.MacaroonHex)
+	assert.Equal(t, "alice,prod,carol", data.Tags)
+
+	w = call(router, http.MethodGet, "/v1/alias/carol", "reader", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var alias AliasResult
+	decodeEnvelope(t, w, &alias)
+	assert.Equal(t, pubkey, alias.PubKey)
+
+	w = call(router, http.MethodDelete, "/v1/tags/"+pubkey, "writer", `{"tags": ["alice"]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	result = TagsResult{}
+	decodeEnvelope(t, w, &result)
+	assert.Equal(t, []string{"prod", "carol"}, result.Tags)
+
+	w = call(router, http.MethodGet, "/v1/alias/alice", "reader", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Conflicting alias is rejected
+	w = call(router, http.MethodPost, "/v1/tags/"+pubkey, "writer", `{"tags": ["bob"]}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	response := decodeEnvelope(t, w, nil)
+	assert.Equal(t, CodeConflict, response.Error.Code)
+	assert.Contains(t, response.Error.Message, other)
+
+	// So is a put with a conflicting alias
+	r := httptest.NewRequest(http.MethodPost, "https://localhost/put/", strings.NewReader(`{"pubkey": "`+pubkey+`", "tags": "bob"}`))
+	w = httptest.NewRecorder()
+	h.PutHandler(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "alias bob is already used")
+
+	for _, body := range []string{`{"tags": []}`, `{"tags": ["a,b"]}`, `{"tags": [""]}`, `nonsense`} {
+		w = call(router, http.MethodPost, "/v1/tags/"+pubkey, "writer", body)
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+
+	// Only real pubkeys, no aliases
+	w = call(router, http.MethodPost, "/v1/tags/carol", "writer", `{"tags": ["x"]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = call(router, http.MethodPost, "/v1/tags/id1/"+pubkey, "writer", `{"tags": ["x"]}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Readers can not change tags
+	w = call(router, http.MethodPost, "/v1/tags/"+pubkey, "reader", `{"tags": ["x"]}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Legacy route returns bare JSON
+	w = call(router, http.MethodGet, "/alias/bob", "reader", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	alias = AliasResult{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &alias))
+	assert.Equal(t, other, alias.PubKey)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	utils "github.com/bolt-observer/go_common/utils"
+	sentry "github.com/getsentry/sentry-go"
+	"github.com/golang/glog"
+)
+
+// DefaultVerifyConcurrency is how many nodes are verified at the same time in the background
+const DefaultVerifyConcurrency = 4
+
+// DefaultVerifyJitter is the longest random delay before a node is verified in the background
+const DefaultVerifyJitter = 5 * time.Second
+
+// DefaultVerifyTimeout is how long a background verification of a node may take
+const DefaultVerifyTimeout = 10 * time.Second
+
+var (
+	// verifyInterval is how often all nodes are verified in the background (0 disables it)
+	verifyInterval    time.Duration
+	verifyConcurrency = DefaultVerifyConcurrency
+	verifyJitter      = DefaultVerifyJitter
+	verifyTimeout     = DefaultVerifyTimeout
+)
+
+// VerificationState is the outcome of the last background verification of a record
+type VerificationState struct {
+	PubKey       string     `json:"pubkey"`
+	UniqueID     string     `json:"unique_id,omitempty"`
+	LastVerified *time.Time `json:"last_verified,omitempty"`
+	LastSuccess  *time.Time `json:"last_success,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	LatencyMs    int64      `json:"latency_ms"`
+	Failing      bool       `json:"failing"`
+	Skipped      bool       `json:"skipped,omitempty"`
+}
+
+// VerificationsResult is the result of the admin verifications call
+type VerificationsResult struct {
+	Interval string              `json:"interval"`
+	Nodes    []VerificationState `json:"nodes"`
+}
+
+// Verifications keeps the background verification state of every record
+type Verifications struct {
+	Mutex sync.Mutex
+	Nodes map[string]VerificationState
+}
+
+// NewVerifications - creates new Verifications
+func NewVerifications() *Verifications {
+	return &Verifications{Nodes: make(map[string]VerificationState)}
+}
+
+func configureVerification() {
+	interval, err := time.ParseDuration(utils.GetEnvWithDefault("VERIFY_INTERVAL", "0s"))
+	if err != nil || interval < 0 {
+		fatalError("VERIFY_INTERVAL could not be parsed", err)
+	}
+	verifyInterval = interval
+
+	concurrency, err := strconv.Atoi(utils.GetEnvWithDefault("VERIFY_CONCURRENCY", strconv.Itoa(DefaultVerifyConcurrency)))
+	if err != nil || concurrency < 1 {
+		fatalError("VERIFY_CONCURRENCY could not be parsed", err)
+	}
+	verifyConcurrency = concurrency
+
+	jitter, err := time.ParseDuration(utils.GetEnvWithDefault("VERIFY_JITTER", DefaultVerifyJitter.String()))
+	if err != nil || jitter < 0 {
+		fatalError("VERIFY_JITTER could not be parsed", err)
+	}
+	verifyJitter = jitter
+
+	timeout, err := time.ParseDuration(utils.GetEnvWithDefault("VERIFY_TIMEOUT", DefaultVerifyTimeout.String()))
+	if err != nil || timeout <= 0 {
+		fatalError("VERIFY_TIMEOUT could not be parsed", err)
+	}
+	verifyTimeout = timeout
+}
+
+// verifyAll verifies every record with at most verifyConcurrency checks in flight
+func (h *Handlers) verifyAll(ctx context.Context) {
+	jobs := make(chan NodeData)
+	seen := make(map[string]struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < verifyConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for node := range jobs {
+				// Spread the load on nodes (and instances of Vault) a bit
+				if verifyJitter > 0 {
+					select {
+					case <-time.After(time.Duration(rand.Int63n(int64(verifyJitter)))):
+					case <-ctx.Done():
+						continue
+					}
+				}
+				h.verifyNode(ctx, node)
+			}
+		}()
+	}
+
+	for node := range h.allNodes() {
+		seen[node.Data.PubKey+node.UniqueID] = struct{}{}
+		jobs <- node
+	}
+	close(jobs)
+	wg.Wait()
+
+	// Deleted records disappear from the state and metrics
+	h.Verifications.Mutex.Lock()
+	defer h.Verifications.Mutex.Unlock()
+
+	for key, state := range h.Verifications.Nodes {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+
+		delete(h.Verifications.Nodes, key)
+		labels := nodeLabels(state.PubKey, state.UniqueID)
+		verifyLastTimestamp.Delete(labels)
+		verifyLatency.Delete(labels)
+		verifySuccess.Delete(labels)
+	}
+}
+
+// verifyNode verifies one record, records the outcome and alerts when its credential stops working
+func (h *Handlers) verifyNode(ctx context.Context, node NodeData) {
+	ctx, cancel := context.WithTimeout(ctx, verifyTimeout)
+	defer cancel()
+
+	data := node.Data
+	start := time.Now()
+	err := h.CheckCall(ctx, &data, data.PubKey)
+	now := time.Now()
+	latency := now.Sub(start)
+
+	labels := nodeLabels(data.PubKey, node.UniqueID)
+	verifyLastTimestamp.With(labels).Set(float64(now.Unix()))
+	verifyLatency.With(labels).Set(latency.Seconds())
+
+	h.Verifications.Mutex.Lock()
+	defer h.Verifications.Mutex.Unlock()
+
+	key := data.PubKey + node.UniqueID
+	state := h.Verifications.Nodes[key]
+	wasFailing := state.Failing
+
+	state.PubKey = data.PubKey
+	state.UniqueID = node.UniqueID
+	state.LastVerified = &now
+	state.LatencyMs = latency.Milliseconds()
+	state.Failing = err != nil
+	state.Skipped = false
+	state.LastError = ""
+
+	if errors.Is(err, errUnsupportedAPIType) {
+		// Records that cannot be checked are reported but neither failing nor alerted
+		state.Failing = false
+		state.Skipped = true
+		state.LastError = err.Error()
+		verifySuccess.Delete(labels)
+		metrics.Verified(verifyLabels{Result: "skipped"}).Inc()
+	} else if err != nil {
+		state.LastError = err.Error()
+		verifySuccess.With(labels).Set(0)
+		metrics.Verified(verifyLabels{Result: "failed"}).Inc()
+
+		// Only the transition is alerted, a node that keeps failing is not reported again
+		if !wasFailing {
+			msg := fmt.Sprintf("Credential of %s (%s) stopped working: %v", data.PubKey, node.UniqueID, err)
+			glog.Warning(msg)
+			sentry.CaptureMessage(msg)
+		}
+	} else {
+		state.LastSuccess = &now
+		verifySuccess.With(labels).Set(1)
+		metrics.Verified(verifyLabels{Result: "verified"}).Inc()
+
+		if wasFailing {
+			glog.Infof("Credential of %s (%s) works again", data.PubKey, node.UniqueID)
+		}
+	}
+
+	h.Verifications.Nodes[key] = state
+}
+
+// monitorVerification verifies all records every verifyInterval (unless it is 0)
+func (h *Handlers) monitorVerification() {
+	if verifyInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(verifyInterval)
+	defer ticker.Stop()
+
+	for {
+		h.verifyAll(context.Background())
+		<-ticker.C
+	}
+}
+
+// verificationStates returns the verification state of every record (records not verified yet have no last_verified)
+func (h *Handlers) verificationStates() []VerificationState {
+	h.Verifications.Mutex.Lock()
+	defer h.Verifications.Mutex.Unlock()
+
+	ret := make([]VerificationState, 0)
+	for node := range h.allNodes() {
+		state, ok := h.Verifications.Nodes[node.Data.PubKey+node.UniqueID]
+		if !ok {
+			state = VerificationState{PubKey: node.Data.PubKey, UniqueID: node.UniqueID}
+		}
+		ret = append(ret, state)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].PubKey+ret[i].UniqueID < ret[j].PubKey+ret[j].UniqueID
+	})
+
+	return ret
+}
+
+// VerificationsHandler - lists background verification state of all records (only failing ones with failing=true)
+func (h *Handlers) VerificationsHandler(w http.ResponseWriter, r *http.Request) {
+	failing := false
+	if value := r.URL.Query().Get("failing"); value != "" {
+		var err error
+		failing, err = strconv.ParseBool(value)
+		if err != nil {
+			h.badRequest(w, r, CodeBadRequest, "failing is invalid", fmt.Sprintf("[Verifications] failing is invalid - %v", value))
+			return
+		}
+	}
+
+	auditLog(r.Header.Get("Authorization"), r.RemoteAddr, "Verifications", r.Method)
+
+	result := VerificationsResult{Interval: verifyInterval.String(), Nodes: make([]VerificationState, 0)}
+	for _, state := range h.verificationStates() {
+		if failing && !state.Failing {
+			continue
+		}
+		result.Nodes = append(result.Nodes, state)
+	}
+
+	respondJSON(w, r, http.StatusOK, result, result)
+}
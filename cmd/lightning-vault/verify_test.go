@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	entities "github.com/bolt-observer/go_common/entities"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withVerification sets background verification settings for the duration of the test
+func withVerification(t *testing.T, concurrency int) {
+	oldConcurrency, oldJitter := verifyConcurrency, verifyJitter
+	verifyConcurrency, verifyJitter = concurrency, 0
+	t.Cleanup(func() { verifyConcurrency, verifyJitter = oldConcurrency, oldJitter })
+}
+
+// verifySuccessMetric returns the values of the verification success gauge by pubkey prefix and uniqueId
+func verifySuccessMetric(t *testing.T) map[string]float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+
+	ret := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != "macaroon_verification_success" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			key := ""
+			for _, label := range metric.GetLabel() {
+				key += label.GetValue() + "/"
+			}
+			ret[key] = metric.GetGauge().GetValue()
+		}
+	}
+
+	return ret
+}
+
+func TestVerifyAll(t *testing.T) {
+	prometheusInit()
+	withVerification(t, 2)
+
+	pubkey := "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7"
+	record := entities.Data{PubKey: pubkey, MacaroonHex: testMacaroon, Endpoint: "127.0.0.1:10009"}
+
+	h := MakeNewDummyHandlers()
+	var mutex sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	broken := map[string]bool{"b": true}
+	h.CheckCall = func(ctx context.Context, data *entities.Data, pubkey string) error {
+		mutex.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		fail := broken[data.Endpoint]
+		mutex.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		inFlight--
+		if fail {
+			return errors.New("verification failed, invalid macaroon root key")
+		}
+		return nil
+	}
+
+	// Endpoint tells the fake which record is checked
+	for _, uniqueID := range []string{"a", "b", "c", "d", "e"} {
+		data := record
+		data.Endpoint = uniqueID
+		h.toLookup(data, uniqueID)
+	}
+
+	h.verifyAll(context.Background())
+	assert.LessOrEqual(t, maxInFlight, 2)
+
+	states := h.verificationStates()
+	require.Len(t, states, 5)
+	for _, state := range states {
+		require.NotNil(t, state.LastVerified, state.UniqueID)
+		assert.Equal(t, state.UniqueID == "b", state.Failing, state.UniqueID)
+	}
+	assert.Equal(t, "verification failed, invalid macaroon root key", states[1].LastError)
+	assert.Nil(t, states[1].LastSuccess)
+	assert.Equal(t, float64(0), verifySuccessMetric(t)[pubkey[:pubkeyPrefixLen]+"/b/"])
+	assert.Equal(t, float64(1), verifySuccessMetric(t)[pubkey[:pubkeyPrefixLen]+"/a/"])
+
+	// Credential stops working and is fixed later
+	mutex.Lock()
+	broken = map[string]bool{"c": true}
+	mutex.Unlock()
+	h.deleteLookup(record, "e")
+
+	h.verifyAll(context.Background())
+	states = h.verificationStates()
+	require.Len(t, states, 4)
+	assert.False(t, states[1].Failing)
+	assert.Empty(t, states[1].LastError)
+	assert.NotNil(t, states[1].LastSuccess)
+	assert.True(t, states[2].Failing)
+	assert.NotNil(t, states[2].LastSuccess)
+
+	_, ok := verifySuccessMetric(t)[pubkey[:pubkeyPrefixLen]+"/e/"]
+	assert.False(t, ok)
+	h.Verifications.Mutex.Lock()
+	assert.Len(t, h.Verifications.Nodes, 4)
+	h.Verifications.Mutex.Unlock()
+}
+
+func TestVerifyUnsupportedAPIType(t *testing.T) {
+	prometheusInit()
+	withVerification(t, 1)
+
+	pubkey := "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7"
+	data := entities.Data{PubKey: pubkey, MacaroonHex: testMacaroon, Endpoint: "127.0.0.1:10009", ApiType: intPtr(42)}
+
+	err := checkCredentials(context.Background(), &data, pubkey)
+	assert.ErrorIs(t, err, errUnsupportedAPIType)
+
+	h := MakeNewDummyHandlers()
+	h.toLookup(data, "unknown")
+
+	h.verifyAll(context.Background())
+	states := h.verificationStates()
+	require.Len(t, states, 1)
+	assert.False(t, states[0].Failing)
+	assert.True(t, states[0].Skipped)
+	assert.NotEmpty(t, states[0].LastError)
+	assert.Nil(t, states[0].LastSuccess)
+
+	_, ok := verifySuccessMetric(t)[pubkey[:pubkeyPrefixLen]+"/unknown/"]
+	assert.False(t, ok)
+}
+
+func TestVerificationsHandler(t *testing.T) {
+	prometheusInit()
+	freshAuthThrottle(t)
+	withVerification(t, 1)
+
+	pubkey := "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7"
+
+	h := MakeNewDummyHandlers()
+	h.toLookup(entities.Data{PubKey: pubkey, MacaroonHex: testMacaroon, Endpoint: "127.0.0.1:10009"}, "good")
+	h.toLookup(entities.Data{PubKey: pubkey, MacaroonHex: testMacaroon, Endpoint: "127.0.0.1:10010"}, "bad")
+	h.CheckCall = func(ctx context.Context, data *entities.Data, pubkey string) error {
+		if data.Endpoint == "127.0.0.1:10010" {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+	router := v1Router(h)
+
+	// Records that were not verified yet are listed too
+	w := call(router, http.MethodGet, "/v1/admin/verifications", "admin", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var result VerificationsResult
+	decodeEnvelope(t, w, &result)
+	require.Len(t, result.Nodes, 2)
+	assert.Nil(t, result.Nodes[0].LastVerified)
+
+	h.verifyAll(context.Background())
+
+	w = call(router, http.MethodGet, "/v1/admin/verifications?failing=true", "admin", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	decodeEnvelope(t, w, &result)
+	require.Len(t, result.Nodes, 1)
+	assert.Equal(t, "bad", result.Nodes[0].UniqueID)
+	assert.Equal(t, "connection refused", result.Nodes[0].LastError)
+
+	w = call(router, http.MethodGet, "/v1/admin/verifications?failing=maybe", "admin", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = call(router, http.MethodGet, "/v1/admin/verifications", "writer", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Verify endpoint uses the same check
+	w = call(router, http.MethodGet, "/v1/verify/bad/"+pubkey, "writer", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = call(router, http.MethodGet, "/v1/verify/good/"+pubkey, "writer", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
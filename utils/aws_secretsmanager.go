@@ -2,13 +2,19 @@ package utils
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/aws/smithy-go"
 	"github.com/getsentry/sentry-go"
 
 	"github.com/golang/glog"
@@ -21,36 +27,185 @@ const MaxRetryTime = 30 * time.Second
 
 // AwsSecretsManager struct.
 type AwsSecretsManager struct {
+	config SecretsManagerConfig
+
+	mutex  sync.Mutex
+	client awsAPI
 }
 
-// NewAwsSecretsManager creates a new AwsSecretsManager
+// NewAwsSecretsManager creates a new AwsSecretsManager (configured through AWS_SECRETSMANAGER_ENDPOINT, AWS_KMS_KEY_ID and SECRETS_TIMEOUT)
 func NewAwsSecretsManager() *AwsSecretsManager {
-	return &AwsSecretsManager{}
+	return NewAwsSecretsManagerWithConfig(secretsManagerConfigFromEnv("AWS_SECRETSMANAGER_ENDPOINT"))
+}
+
+// NewAwsSecretsManagerWithConfig creates a new AwsSecretsManager
+func NewAwsSecretsManagerWithConfig(config SecretsManagerConfig) *AwsSecretsManager {
+	return &AwsSecretsManager{config: config}
+}
+
+// awsLoadAPI is the part of the secrets manager client used for loading secrets
+type awsLoadAPI interface {
+	ListSecrets(ctx context.Context, params *secretsmanager.ListSecretsInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.ListSecretsOutput, error)
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+	BatchGetSecretValue(ctx context.Context, params *secretsmanager.BatchGetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.BatchGetSecretValueOutput, error)
+}
+
+// awsAPI is the part of the secrets manager client we use
+type awsAPI interface {
+	awsLoadAPI
+	CreateSecret(ctx context.Context, params *secretsmanager.CreateSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.CreateSecretOutput, error)
+	UpdateSecret(ctx context.Context, params *secretsmanager.UpdateSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.UpdateSecretOutput, error)
+	DeleteSecret(ctx context.Context, params *secretsmanager.DeleteSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.DeleteSecretOutput, error)
+	RestoreSecret(ctx context.Context, params *secretsmanager.RestoreSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.RestoreSecretOutput, error)
+	TagResource(ctx context.Context, params *secretsmanager.TagResourceInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.TagResourceOutput, error)
+}
+
+// getClient returns the long-lived client, it is created on first use (the SDK refreshes credentials by itself)
+func (s *AwsSecretsManager) getClient(ctx context.Context) (awsAPI, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	httpClient := awshttp.NewBuildableClient()
+	if s.config.Timeout > 0 {
+		httpClient = httpClient.WithTimeout(s.config.Timeout)
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithHTTPClient(httpClient))
+	if err != nil {
+		sentry.CaptureException(err)
+		glog.Errorf("unable to load sdk: %v", err)
+		return nil, err
+	}
+
+	s.client = secretsmanager.NewFromConfig(cfg, func(o *secretsmanager.Options) {
+		if s.config.Endpoint != "" {
+			o.BaseEndpoint = aws.String(s.config.Endpoint)
+		}
+	})
+
+	return s.client, nil
 }
 
 // LoadSecrets - loads all secrets (used at startup)
-func (s *AwsSecretsManager) LoadSecrets(ctx context.Context, prefix string) map[string]string {
+func (s *AwsSecretsManager) LoadSecrets(ctx context.Context, prefix string) (map[string]string, error) {
+	svc, err := s.getClient(ctx)
+	if err != nil {
+		return make(map[string]string), &LoadError{ListErr: err}
+	}
+
+	return loadSecretsAws(ctx, svc, prefix, loadConcurrency())
+}
+
+// loadSecretsAws loads secrets with BatchGetSecretValue and falls back to fetching them concurrently one by one
+func loadSecretsAws(ctx context.Context, svc awsLoadAPI, prefix string, concurrency int) (map[string]string, error) {
+	ret, loadErr, ok := batchGetSecretsAws(ctx, svc, prefix)
+	if ok {
+		return ret, loadErr.OrNil()
+	}
+
+	loadErr = &LoadError{}
+
+	names, err := listSecretsAws(ctx, svc, prefix)
+	if err != nil {
+		loadErr.ListErr = err
+	}
+
+	ret, loadErr.Secrets = fetchConcurrently(ctx, names, concurrency, isThrottledAws, func(ctx context.Context, name string) (string, string, error) {
+		return getSecretAws(ctx, svc, name)
+	})
+
+	return ret, loadErr.OrNil()
+}
+
+// batchGetSecretsAws lists and fetches secrets at the same time, returns false when BatchGetSecretValue cannot be used
+func batchGetSecretsAws(ctx context.Context, svc awsLoadAPI, prefix string) (map[string]string, *LoadError, bool) {
 	ret := make(map[string]string)
-	for _, arn := range listSecretsAws(ctx, prefix) {
-		key, value, err := getSecretAws(ctx, arn)
+	loadErr := &LoadError{}
+
+	var token *string
+	for page := 0; ; page++ {
+		input := &secretsmanager.BatchGetSecretValueInput{
+			MaxResults: aws.Int32(20),
+			NextToken:  token,
+			Filters:    []types.Filter{{Key: types.FilterNameStringTypeName, Values: []string{prefix}}},
+		}
+
+		result, err := withRetry(ctx, "batch fetching secrets", isThrottledAws, func() (*secretsmanager.BatchGetSecretValueOutput, error) {
+			return svc.BatchGetSecretValue(ctx, input)
+		})
 		if err != nil {
-			glog.Errorf("Could not get secret: %v", err)
+			if page == 0 {
+				// Not supported by the endpoint or not allowed by the policy
+				glog.Warningf("BatchGetSecretValue not available, fetching secrets one by one: %v", err)
+				return nil, nil, false
+			}
+
 			sentry.CaptureException(err)
-			continue
+			glog.Errorf("Could not batch fetch secrets: %v", err)
+			loadErr.ListErr = err
+			return ret, loadErr, true
+		}
+
+		for _, v := range result.SecretValues {
+			// The name filter also matches words in the middle of names
+			if v.Name == nil || v.SecretString == nil || !strings.HasPrefix(*v.Name, prefix) {
+				continue
+			}
+			ret[*v.Name] = *v.SecretString
+		}
+
+		for _, e := range result.Errors {
+			if !strings.HasPrefix(aws.ToString(e.SecretId), prefix) {
+				continue
+			}
+			err := fmt.Errorf("%s: %s", aws.ToString(e.ErrorCode), aws.ToString(e.Message))
+			glog.Errorf("Could not get secret %s: %v", aws.ToString(e.SecretId), err)
+			loadErr.Add(aws.ToString(e.SecretId), err)
+		}
+
+		token = result.NextToken
+		if token == nil {
+			break
 		}
-		ret[key] = value
 	}
 
-	return ret
+	return ret, loadErr, true
+}
+
+// isThrottledAws returns true for errors that mean we should slow down
+func isThrottledAws(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	switch apiErr.ErrorCode() {
+	case "ThrottlingException", "TooManyRequestsException", "RequestLimitExceeded":
+		return true
+	}
+
+	return false
 }
 
 // InsertOrUpdateSecret - inserts or updates a secret
-func (s *AwsSecretsManager) InsertOrUpdateSecret(ctx context.Context, name, value string) (string, Change, error) {
+func (s *AwsSecretsManager) InsertOrUpdateSecret(ctx context.Context, name, value string, metadata Metadata) (string, Change, error) {
 	back := backoff.NewExponentialBackOff()
 	back.MaxElapsedTime = MaxRetryTime
 
+	svc, err := s.getClient(ctx)
+	if err != nil {
+		return "", Undefined, err
+	}
+
 	x, err := backoff.RetryNotifyWithData(func() (InsertOrUpdateSecretData, error) {
-		arn, change, err := insertOrUpdateSecret(ctx, name, value)
+		arn, change, err := insertOrUpdateSecret(ctx, svc, name, value, metadata, s.config.KmsKeyID)
+		if isPermanentAws(err) {
+			err = backoff.Permanent(err)
+		}
 		return InsertOrUpdateSecretData{
 			Arn:    arn,
 			Change: change,
@@ -67,8 +222,17 @@ func (s *AwsSecretsManager) DeleteSecret(ctx context.Context, name string) (stri
 	back := backoff.NewExponentialBackOff()
 	back.MaxElapsedTime = MaxRetryTime
 
+	svc, err := s.getClient(ctx)
+	if err != nil {
+		return "", err
+	}
+
 	resp, err := backoff.RetryNotifyWithData(func() (string, error) {
-		return invalidateSecret(ctx, name)
+		arn, err := invalidateSecret(ctx, svc, name)
+		if isPermanentAws(err) {
+			return arn, backoff.Permanent(err)
+		}
+		return arn, err
 	}, back, func(err error, d time.Duration) {
 		glog.Warningf("Error invalidating secret")
 	})
@@ -76,17 +240,66 @@ func (s *AwsSecretsManager) DeleteSecret(ctx context.Context, name string) (stri
 	return resp, err
 }
 
-func deleteSecret(ctx context.Context, name string) (string, error) {
-	cfg, err := config.LoadDefaultConfig(ctx)
+// ScheduleDeletion - deletes a secret after the recovery window (immediately when recoveryDays is 0)
+func (s *AwsSecretsManager) ScheduleDeletion(ctx context.Context, name string, recoveryDays int) (string, error) {
+	back := backoff.NewExponentialBackOff()
+	back.MaxElapsedTime = MaxRetryTime
+
+	svc, err := s.getClient(ctx)
 	if err != nil {
-		sentry.CaptureException(err)
 		return "", err
 	}
 
-	svc := secretsmanager.NewFromConfig(cfg)
-	resp, err := svc.DeleteSecret(ctx, &secretsmanager.DeleteSecretInput{SecretId: &name})
+	resp, err := backoff.RetryNotifyWithData(func() (string, error) {
+		arn, err := deleteSecret(ctx, svc, name, recoveryDays)
+		if isPermanentAws(err) {
+			return arn, backoff.Permanent(err)
+		}
+		return arn, err
+	}, back, func(err error, d time.Duration) {
+		glog.Warningf("Error deleting secret")
+	})
+
+	return resp, err
+}
+
+// ListTombstones - lists tombstones that have not changed since before
+func (s *AwsSecretsManager) ListTombstones(ctx context.Context, prefix string, before time.Time) ([]Tombstone, error) {
+	svc, err := s.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return listTombstonesAws(ctx, svc, prefix, before, loadConcurrency())
+}
 
+// Ping - checks whether secrets manager is reachable
+func (s *AwsSecretsManager) Ping(ctx context.Context) error {
+	svc, err := s.getClient(ctx)
 	if err != nil {
+		return err
+	}
+
+	_, err = svc.ListSecrets(ctx, &secretsmanager.ListSecretsInput{MaxResults: aws.Int32(1)})
+
+	return err
+}
+
+func deleteSecret(ctx context.Context, svc awsAPI, name string, recoveryDays int) (string, error) {
+	input := &secretsmanager.DeleteSecretInput{SecretId: &name}
+	if recoveryDays > 0 {
+		input.RecoveryWindowInDays = aws.Int64(int64(recoveryDays))
+	} else {
+		input.ForceDeleteWithoutRecovery = aws.Bool(true)
+	}
+
+	resp, err := svc.DeleteSecret(ctx, input)
+	if isNotFoundAws(err) {
+		return "", fmt.Errorf("cannot delete secret %s: %w", name, ErrSecretNotFound)
+	}
+
+	if err != nil {
+		glog.Errorf("Could not delete secret %s: %v", name, err)
 		sentry.CaptureException(err)
 		return "", err
 	}
@@ -94,33 +307,144 @@ func deleteSecret(ctx context.Context, name string) (string, error) {
 	return *resp.ARN, nil
 }
 
-func invalidateSecret(ctx context.Context, name string) (string, error) {
-	arn := ""
-	cfg, err := config.LoadDefaultConfig(ctx)
+// isPermanentAws returns true for errors that retrying will not fix
+func isPermanentAws(err error) bool {
+	if errors.Is(err, ErrSecretNotFound) {
+		return true
+	}
+
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	switch apiErr.ErrorCode() {
+	case "AccessDeniedException", "UnrecognizedClientException", "ValidationException", "InvalidParameterException", "InvalidRequestException",
+		"ResourceNotFoundException", "EncryptionFailure", "DecryptionFailure":
+		return true
+	}
+
+	return false
+}
+
+// findSecretAws returns secret name (nil when it does not exist)
+func findSecretAws(ctx context.Context, svc awsLoadAPI, name string) (*types.SecretListEntry, error) {
+	entries, err := listSecretEntriesAws(ctx, svc, name)
 	if err != nil {
-		sentry.CaptureException(err)
-		return "", err
+		return nil, err
+	}
+
+	// The name filter does not match exactly
+	for i := range entries {
+		if aws.ToString(entries[i].Name) == name {
+			return &entries[i], nil
+		}
 	}
 
-	svc := secretsmanager.NewFromConfig(cfg)
+	return nil, nil
+}
 
-	listInput := &secretsmanager.ListSecretsInput{
-		MaxResults: aws.Int32(1),
-		Filters:    []types.Filter{{Key: types.FilterNameStringTypeName, Values: []string{name}}},
+// awsTags returns metadata as tags (sorted by key)
+func awsTags(metadata Metadata) []types.Tag {
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
 
-	list, err := svc.ListSecrets(ctx, listInput)
+	ret := make([]types.Tag, 0, len(keys))
+	for _, k := range keys {
+		ret = append(ret, types.Tag{Key: aws.String(k), Value: aws.String(metadata[k])})
+	}
+
+	return ret
+}
+
+// tagSecretAws adds metadata missing from existing tags to secret id
+func tagSecretAws(ctx context.Context, svc awsAPI, id string, existing []types.Tag, metadata Metadata) {
+	current := make(map[string]string, len(existing))
+	for _, tag := range existing {
+		current[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+
+	missing := make(Metadata)
+	for k, v := range metadata {
+		if value, ok := current[k]; !ok || value != v {
+			missing[k] = v
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+
+	// The value is already stored, so failing to tag is not fatal
+	_, err := svc.TagResource(ctx, &secretsmanager.TagResourceInput{SecretId: &id, Tags: awsTags(missing)})
 	if err != nil {
-		glog.Errorf("Could not list secrets: %v", err)
+		glog.Warningf("Could not tag secret %s: %v", id, err)
 		sentry.CaptureException(err)
-		return "", err
+	}
+}
+
+// isNotFoundAws returns true when the secret does not exist
+func isNotFoundAws(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "ResourceNotFoundException"
+}
+
+// isScheduledForDeletionAws returns true when the secret cannot be created because a deleted secret with the same name is in its recovery window
+func isScheduledForDeletionAws(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidRequestException" && strings.Contains(apiErr.ErrorMessage(), "scheduled for deletion")
+}
+
+// listTombstonesAws returns tombstones starting with prefix that have not changed since before
+func listTombstonesAws(ctx context.Context, svc awsLoadAPI, prefix string, before time.Time, concurrency int) ([]Tombstone, error) {
+	entries, err := listSecretEntriesAws(ctx, svc, prefix)
+	if err != nil {
+		return nil, err
 	}
 
-	if len(list.SecretList) == 1 {
-		arn = *list.SecretList[0].ARN
+	changed := make(map[string]time.Time)
+	names := make([]string, 0)
+	for _, entry := range entries {
+		changedAt := aws.ToTime(entry.LastChangedDate)
+		if changedAt.IsZero() {
+			changedAt = aws.ToTime(entry.CreatedDate)
+		}
+		if !changedAt.Before(before) {
+			continue
+		}
+
+		changed[aws.ToString(entry.Name)] = changedAt
+		names = append(names, aws.ToString(entry.Name))
 	}
 
-	if arn != "" {
+	secrets, errs := fetchConcurrently(ctx, names, concurrency, isThrottledAws, func(ctx context.Context, name string) (string, string, error) {
+		return getSecretAws(ctx, svc, name)
+	})
+
+	ret := make([]Tombstone, 0)
+	for name, value := range secrets {
+		if value == "{}" {
+			ret = append(ret, Tombstone{Name: name, ChangedAt: changed[name]})
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+
+	return ret, (&LoadError{Secrets: errs}).OrNil()
+}
+
+func invalidateSecret(ctx context.Context, svc awsAPI, name string) (string, error) {
+	entry, err := findSecretAws(ctx, svc, name)
+	if err != nil {
+		return "", err
+	}
+
+	if entry != nil {
+		arn := aws.ToString(entry.ARN)
 		value := "{}"
 
 		updateInput := &secretsmanager.UpdateSecretInput{
@@ -141,7 +465,7 @@ func invalidateSecret(ctx context.Context, name string) (string, error) {
 
 	glog.Errorf("Could not invalidate secret that does not exist: %s", name)
 	sentry.CaptureMessage(fmt.Sprintf("Could not invalidate secret that does not exist: %s", name))
-	return "", fmt.Errorf("cannot invalidate secret that does not exist: %s", name)
+	return "", fmt.Errorf("cannot invalidate secret %s: %w", name, ErrSecretNotFound)
 }
 
 // InsertOrUpdateSecretData struct
@@ -151,39 +475,28 @@ type InsertOrUpdateSecretData struct {
 }
 
 // InsertOrUpdateSecret - inserts or updates a secret
-func insertOrUpdateSecret(ctx context.Context, name, value string) (string, Change, error) {
-	arn := ""
-	cfg, err := config.LoadDefaultConfig(ctx)
-	if err != nil {
-		sentry.CaptureException(err)
-		return "", Undefined, err
-	}
-
-	svc := secretsmanager.NewFromConfig(cfg)
-
-	listInput := &secretsmanager.ListSecretsInput{
-		MaxResults: aws.Int32(1),
-		Filters:    []types.Filter{{Key: types.FilterNameStringTypeName, Values: []string{name}}},
-	}
-
-	list, err := svc.ListSecrets(ctx, listInput)
+func insertOrUpdateSecret(ctx context.Context, svc awsAPI, name, value string, metadata Metadata, kmsKeyID string) (string, Change, error) {
+	entry, err := findSecretAws(ctx, svc, name)
 	if err != nil {
-		glog.Errorf("Could not list secrets: %v", err)
-		sentry.CaptureException(err)
 		return "", Undefined, err
 	}
 
-	if len(list.SecretList) == 1 {
-		arn = *list.SecretList[0].ARN
-	}
-
-	if arn == "" {
+	if entry == nil {
 		createInput := &secretsmanager.CreateSecretInput{
 			Name:         &name,
 			SecretString: &value,
 		}
+		if len(metadata) > 0 {
+			createInput.Tags = awsTags(metadata)
+		}
+		if kmsKeyID != "" {
+			createInput.KmsKeyId = &kmsKeyID
+		}
 
 		resp, err := svc.CreateSecret(ctx, createInput)
+		if isScheduledForDeletionAws(err) {
+			return restoreSecret(ctx, svc, name, value, metadata)
+		}
 
 		if err != nil {
 			glog.Errorf("Could not create secret: %v", err)
@@ -193,6 +506,8 @@ func insertOrUpdateSecret(ctx context.Context, name, value string) (string, Chan
 
 		return *resp.ARN, Inserted, nil
 	}
+	arn := aws.ToString(entry.ARN)
+
 	/* Due to tombstones */
 	change := Updated
 
@@ -227,20 +542,37 @@ func insertOrUpdateSecret(ctx context.Context, name, value string) (string, Chan
 		return "", Undefined, err
 	}
 
+	tagSecretAws(ctx, svc, arn, entry.Tags, metadata)
+
 	return *resp.ARN, change, nil
 }
 
-func getSecretAws(ctx context.Context, arn string) (string, string, error) {
-	cfg, err := config.LoadDefaultConfig(context.Background())
+// restoreSecret cancels the scheduled deletion of secret name and stores value
+func restoreSecret(ctx context.Context, svc awsAPI, name, value string, metadata Metadata) (string, Change, error) {
+	glog.Infof("Secret %s is scheduled for deletion, restoring it", name)
+
+	_, err := svc.RestoreSecret(ctx, &secretsmanager.RestoreSecretInput{SecretId: &name})
 	if err != nil {
+		glog.Errorf("Could not restore secret: %v", err)
 		sentry.CaptureException(err)
-		return "", "", err
+		return "", Undefined, err
+	}
+
+	resp, err := svc.UpdateSecret(ctx, &secretsmanager.UpdateSecretInput{SecretId: &name, SecretString: &value})
+	if err != nil {
+		glog.Errorf("Could not update secret: %v", err)
+		sentry.CaptureException(err)
+		return "", Undefined, err
 	}
 
-	svc := secretsmanager.NewFromConfig(cfg)
+	tagSecretAws(ctx, svc, *resp.ARN, nil, metadata)
+
+	return *resp.ARN, Inserted, nil
+}
 
+func getSecretAws(ctx context.Context, svc awsLoadAPI, id string) (string, string, error) {
 	input := &secretsmanager.GetSecretValueInput{
-		SecretId: &arn,
+		SecretId: &id,
 	}
 
 	result, err := svc.GetSecretValue(ctx, input)
@@ -251,17 +583,21 @@ func getSecretAws(ctx context.Context, arn string) (string, string, error) {
 	return *result.Name, *result.SecretString, nil
 }
 
-func listSecretsAws(ctx context.Context, prefix string) []string {
+func listSecretsAws(ctx context.Context, svc awsLoadAPI, prefix string) ([]string, error) {
 	ret := make([]string, 0)
-	cfg, err := config.LoadDefaultConfig(ctx)
-	if err != nil {
-		sentry.CaptureException(err)
-		glog.Errorf("unable to load sdk: %v", err)
-		return ret
+
+	entries, err := listSecretEntriesAws(ctx, svc, prefix)
+	for _, v := range entries {
+		ret = append(ret, *v.Name)
 	}
 
-	svc := secretsmanager.NewFromConfig(cfg)
+	return ret, err
+}
 
+func listSecretEntriesAws(ctx context.Context, svc awsLoadAPI, prefix string) ([]types.SecretListEntry, error) {
+	ret := make([]types.SecretListEntry, 0)
+
+	var err error
 	result := &secretsmanager.ListSecretsOutput{
 		NextToken: nil,
 	}
@@ -273,15 +609,20 @@ func listSecretsAws(ctx context.Context, prefix string) []string {
 			Filters:    []types.Filter{{Key: types.FilterNameStringTypeName, Values: []string{prefix}}},
 		}
 
-		result, err = svc.ListSecrets(ctx, input)
+		result, err = withRetry(ctx, "listing secrets", isThrottledAws, func() (*secretsmanager.ListSecretsOutput, error) {
+			return svc.ListSecrets(ctx, input)
+		})
 		if err != nil {
 			sentry.CaptureException(err)
 			glog.Errorf("Could not list secrets: %v", err)
-			return ret
+			return ret, err
 		}
 
 		for _, v := range result.SecretList {
-			ret = append(ret, *v.ARN)
+			// The name filter also matches words in the middle of names
+			if strings.HasPrefix(aws.ToString(v.Name), prefix) {
+				ret = append(ret, v)
+			}
 		}
 
 		if result.NextToken == nil {
@@ -289,5 +630,5 @@ func listSecretsAws(ctx context.Context, prefix string) []string {
 		}
 	}
 
-	return ret
+	return ret, nil
 }
@@ -21,6 +21,18 @@ const (
 	Rune
 )
 
+// String returns the name of the authenticator type
+func (a AuthenticatorType) String() string {
+	switch a {
+	case Macaroon:
+		return "macaroon"
+	case Rune:
+		return "rune"
+	}
+
+	return "unknown"
+}
+
 // DetectAuthenticatorType detects what kind of authenticator is used
 func DetectAuthenticatorType(str string, whenMultipleMatch *api.APIType) AuthenticatorType {
 	matches := 0
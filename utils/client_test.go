@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func fakeAwsCredentials(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_REGION", "us-east-1")
+}
+
+func TestAwsSecretsManagerEndpoint(t *testing.T) {
+	fakeAwsCredentials(t)
+
+	calls := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		require.Equal(t, "secretsmanager.ListSecrets", r.Header.Get("X-Amz-Target"))
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.Write([]byte(`{"SecretList": []}`))
+	}))
+	defer server.Close()
+
+	s := NewAwsSecretsManagerWithConfig(SecretsManagerConfig{Endpoint: server.URL, Timeout: time.Second})
+	require.NoError(t, s.Ping(context.Background()))
+	require.NoError(t, s.Ping(context.Background()))
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// Client is created once
+	first, err := s.getClient(context.Background())
+	require.NoError(t, err)
+	second, err := s.getClient(context.Background())
+	require.NoError(t, err)
+	require.True(t, first == second)
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	s = NewAwsSecretsManagerWithConfig(SecretsManagerConfig{Endpoint: slow.URL, Timeout: 50 * time.Millisecond})
+	require.Error(t, s.Ping(context.Background()))
+}
+
+func TestGcpSecretsManagerEndpoint(t *testing.T) {
+	backend := newFakeGcpBackend()
+	s := newFakeGcp(t, backend, SecretsManagerConfig{Timeout: time.Second})
+
+	require.NoError(t, s.Ping(context.Background()))
+	require.NoError(t, s.Ping(context.Background()))
+	require.Equal(t, int32(2), atomic.LoadInt32(&backend.calls))
+}
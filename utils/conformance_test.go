@@ -0,0 +1,364 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"github.com/stretchr/testify/require"
+)
+
+// conformanceBackend is a secrets manager under test together with ways to make its API fail
+type conformanceBackend struct {
+	manager SecretsManager
+	// failList makes listing secrets fail
+	failList func()
+	// failSecret makes fetching secret name fail
+	failSecret func(name string)
+	// failWrites makes all changes fail
+	failWrites func()
+}
+
+// backendFactory returns a backend without any secrets
+type backendFactory func(t *testing.T) conformanceBackend
+
+func awsConformanceBackend(batch bool) backendFactory {
+	return func(t *testing.T) conformanceBackend {
+		backend := newFakeAwsBackend(0, 0, batch)
+		locked := func(fn func()) {
+			backend.mutex.Lock()
+			defer backend.mutex.Unlock()
+			fn()
+		}
+
+		return conformanceBackend{
+			manager:    newFakeAws(backend),
+			failList:   func() { locked(func() { backend.failList = accessDenied() }) },
+			failSecret: func(name string) { locked(func() { backend.failSecrets[name] = accessDenied() }) },
+			failWrites: func() { locked(func() { backend.failWrites = accessDenied() }) },
+		}
+	}
+}
+
+func gcpConformanceBackend(t *testing.T) conformanceBackend {
+	backend := newFakeGcpBackend()
+	locked := func(fn func()) {
+		backend.mutex.Lock()
+		defer backend.mutex.Unlock()
+		fn()
+	}
+
+	return conformanceBackend{
+		manager:    newFakeGcp(t, backend, SecretsManagerConfig{KeepVersions: DefaultKeepVersions}),
+		failList:   func() { locked(func() { backend.failList = permissionDenied() }) },
+		failSecret: func(name string) { locked(func() { backend.failSecrets[name] = permissionDenied() }) },
+		failWrites: func() { locked(func() { backend.failWrites = permissionDenied() }) },
+	}
+}
+
+func dummyConformanceBackend(t *testing.T) conformanceBackend {
+	return conformanceBackend{manager: NewDummySecretsManager()}
+}
+
+func dummyFileConformanceBackend(t *testing.T) conformanceBackend {
+	dir := t.TempDir()
+	s, err := NewDummySecretsManagerWithFile(filepath.Join(dir, "secrets.json"))
+	require.NoError(t, err)
+
+	return conformanceBackend{
+		manager: s,
+		// Directory does not exist so persisting fails
+		failWrites: func() { s.File = filepath.Join(dir, "missing", "secrets.json") },
+	}
+}
+
+func conformanceBackends() map[string]backendFactory {
+	return map[string]backendFactory{
+		"aws":        awsConformanceBackend(true),
+		"aws_list":   awsConformanceBackend(false),
+		"gcp":        gcpConformanceBackend,
+		"dummy":      dummyConformanceBackend,
+		"dummy_file": dummyFileConformanceBackend,
+	}
+}
+
+func loadOne(t *testing.T, s SecretsManager, name string) (string, bool) {
+	secrets, err := s.LoadSecrets(context.Background(), name)
+	require.NoError(t, err)
+
+	value, ok := secrets[name]
+	return value, ok
+}
+
+func insert(t *testing.T, s SecretsManager, name, value string) Change {
+	_, change, err := s.InsertOrUpdateSecret(context.Background(), name, value, nil)
+	require.NoError(t, err)
+	return change
+}
+
+func TestConformance(t *testing.T) {
+	for name, factory := range conformanceBackends() {
+		t.Run(name, func(t *testing.T) {
+			runConformance(t, factory)
+		})
+	}
+}
+
+// runConformance checks the behaviour every SecretsManager must have
+func runConformance(t *testing.T, factory backendFactory) {
+	t.Run("InsertOrUpdate", func(t *testing.T) {
+		s := factory(t).manager
+
+		require.Equal(t, Inserted, insert(t, s, "env_a_", "1"))
+		require.Equal(t, Updated, insert(t, s, "env_a_", "2"))
+		require.Equal(t, Updated, insert(t, s, "env_a_", "2"))
+
+		value, ok := loadOne(t, s, "env_a_")
+		require.True(t, ok)
+		require.Equal(t, "2", value)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		ctx := context.Background()
+		s := factory(t).manager
+		purger, ok := s.(Purger)
+		require.True(t, ok)
+
+		insert(t, s, "env_a_", "1")
+
+		// Deleting leaves a tombstone
+		_, err := s.DeleteSecret(ctx, "env_a_")
+		require.NoError(t, err)
+		value, ok := loadOne(t, s, "env_a_")
+		require.True(t, ok)
+		require.Equal(t, "{}", value)
+
+		tombstones, err := purger.ListTombstones(ctx, "env_", time.Now().Add(time.Minute))
+		require.NoError(t, err)
+		require.Len(t, tombstones, 1)
+		require.Equal(t, "env_a_", tombstones[0].Name)
+
+		tombstones, err = purger.ListTombstones(ctx, "env_", time.Now().Add(-time.Minute))
+		require.NoError(t, err)
+		require.Empty(t, tombstones)
+
+		// Storing it again counts as an insert
+		require.Equal(t, Inserted, insert(t, s, "env_a_", "3"))
+		value, _ = loadOne(t, s, "env_a_")
+		require.Equal(t, "3", value)
+
+		_, err = s.DeleteSecret(ctx, "env_missing_")
+		require.ErrorIs(t, err, ErrSecretNotFound)
+
+		// Scheduled deletion hides the secret right away
+		_, err = purger.ScheduleDeletion(ctx, "env_a_", 7)
+		require.NoError(t, err)
+		_, ok = loadOne(t, s, "env_a_")
+		require.False(t, ok)
+
+		_, err = s.DeleteSecret(ctx, "env_a_")
+		require.ErrorIs(t, err, ErrSecretNotFound)
+
+		tombstones, err = purger.ListTombstones(ctx, "env_", time.Now().Add(time.Minute))
+		require.NoError(t, err)
+		require.Empty(t, tombstones)
+
+		// Storing it within the recovery window restores it
+		require.Equal(t, Inserted, insert(t, s, "env_a_", "4"))
+		value, _ = loadOne(t, s, "env_a_")
+		require.Equal(t, "4", value)
+
+		// Immediate deletion
+		_, err = purger.ScheduleDeletion(ctx, "env_a_", 0)
+		require.NoError(t, err)
+		_, ok = loadOne(t, s, "env_a_")
+		require.False(t, ok)
+
+		_, err = purger.ScheduleDeletion(ctx, "env_a_", 0)
+		require.ErrorIs(t, err, ErrSecretNotFound)
+
+		require.Equal(t, Inserted, insert(t, s, "env_a_", "5"))
+	})
+
+	t.Run("PrefixIsolation", func(t *testing.T) {
+		ctx := context.Background()
+		s := factory(t).manager
+
+		// Environment prefixes contain each other
+		require.Equal(t, Inserted, insert(t, s, "stagingmacaroon_a_", "staging"))
+		require.Equal(t, Inserted, insert(t, s, "macaroon_a_", "default"))
+		require.Equal(t, Inserted, insert(t, s, "prodmacaroon_a_", "prod"))
+		require.Equal(t, Inserted, insert(t, s, "prodmacaroon_b_", "prod"))
+
+		for prefix, expected := range map[string]map[string]string{
+			"macaroon_":        {"macaroon_a_": "default"},
+			"stagingmacaroon_": {"stagingmacaroon_a_": "staging"},
+			"prodmacaroon_":    {"prodmacaroon_a_": "prod", "prodmacaroon_b_": "prod"},
+		} {
+			secrets, err := s.LoadSecrets(ctx, prefix)
+			require.NoError(t, err)
+			require.Equal(t, expected, secrets, prefix)
+		}
+
+		for _, name := range []string{"macaroon_a_", "stagingmacaroon_a_", "prodmacaroon_a_"} {
+			_, err := s.DeleteSecret(ctx, name)
+			require.NoError(t, err)
+		}
+
+		tombstones, err := s.(Purger).ListTombstones(ctx, "macaroon_", time.Now().Add(time.Minute))
+		require.NoError(t, err)
+		require.Len(t, tombstones, 1)
+		require.Equal(t, "macaroon_a_", tombstones[0].Name)
+
+		value, _ := loadOne(t, s, "prodmacaroon_b_")
+		require.Equal(t, "prod", value)
+	})
+
+	t.Run("Pagination", func(t *testing.T) {
+		ctx := context.Background()
+		s := factory(t).manager
+
+		expected := make(map[string]string)
+		for i := 0; i < 250; i++ {
+			name := fmt.Sprintf("env_%03d_", i)
+			expected[name] = strconv.Itoa(i)
+			insert(t, s, name, expected[name])
+		}
+
+		secrets, err := s.LoadSecrets(ctx, "env_")
+		require.NoError(t, err)
+		require.Equal(t, expected, secrets)
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		ctx := context.Background()
+		backend := factory(t)
+		s := backend.manager
+
+		insert(t, s, "env_a_", "a")
+		insert(t, s, "env_b_", "b")
+		insert(t, s, "env_c_", "c")
+
+		var loadErr *LoadError
+		if backend.failSecret != nil {
+			// Other secrets still load
+			backend.failSecret("env_b_")
+			secrets, err := s.LoadSecrets(ctx, "env_")
+			require.ErrorAs(t, err, &loadErr)
+			require.NoError(t, loadErr.ListErr)
+			require.Len(t, loadErr.Secrets, 1)
+			require.Equal(t, "env_b_", loadErr.Secrets[0].Name)
+			require.Equal(t, map[string]string{"env_a_": "a", "env_c_": "c"}, secrets)
+		}
+
+		if backend.failWrites != nil {
+			// Writes are not retried when retrying cannot help
+			backend.failWrites()
+			start := time.Now()
+			_, _, err := s.InsertOrUpdateSecret(ctx, "env_a_", "x", nil)
+			require.Error(t, err)
+			_, _, err = s.InsertOrUpdateSecret(ctx, "env_d_", "x", nil)
+			require.Error(t, err)
+			_, err = s.DeleteSecret(ctx, "env_a_")
+			require.Error(t, err)
+			require.Less(t, time.Since(start), MaxRetryTime/2)
+
+			// Failed writes change nothing
+			_, ok := loadOne(t, s, "env_d_")
+			require.False(t, ok)
+		}
+
+		if backend.failList != nil {
+			backend.failList()
+			_, err := s.LoadSecrets(ctx, "env_")
+			require.ErrorAs(t, err, &loadErr)
+			require.Error(t, loadErr.ListErr)
+		}
+	})
+}
+
+func TestPruneVersionsGcp(t *testing.T) {
+	ctx := context.Background()
+
+	backend := newFakeGcpBackend()
+	s := newFakeGcp(t, backend, SecretsManagerConfig{KeepVersions: 2})
+
+	for _, value := range []string{"1", "2", "3", "4"} {
+		_, _, err := s.InsertOrUpdateSecret(ctx, "env_a_", value, nil)
+		require.NoError(t, err)
+	}
+
+	destroyed, enabled := secretmanagerpb.SecretVersion_DESTROYED, secretmanagerpb.SecretVersion_ENABLED
+	require.Equal(t, []secretmanagerpb.SecretVersion_State{destroyed, destroyed, enabled, enabled}, backend.states("env_a_"))
+
+	// Deleted secrets do not keep older versions around
+	_, err := s.DeleteSecret(ctx, "env_a_")
+	require.NoError(t, err)
+	require.Equal(t, []secretmanagerpb.SecretVersion_State{destroyed, destroyed, destroyed, destroyed, enabled}, backend.states("env_a_"))
+
+	// 0 keeps everything
+	s = newFakeGcp(t, backend, SecretsManagerConfig{})
+	_, _, err = s.InsertOrUpdateSecret(ctx, "env_b_", "1", nil)
+	require.NoError(t, err)
+	_, _, err = s.InsertOrUpdateSecret(ctx, "env_b_", "2", nil)
+	require.NoError(t, err)
+	require.Equal(t, []secretmanagerpb.SecretVersion_State{enabled, enabled}, backend.states("env_b_"))
+}
+
+func TestMetadataAws(t *testing.T) {
+	ctx := context.Background()
+
+	backend := newFakeAwsBackend(0, 0, true)
+	s := newFakeAws(backend)
+	s.config.KmsKeyID = "alias/vault"
+
+	_, _, err := s.InsertOrUpdateSecret(ctx, "env_a_", "1", Metadata{MetadataPubKey: "02abc", MetadataManagedBy: ManagedBy})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"pubkey": "02abc", "managed-by": "lightning-vault"}, backend.tags["env_a_"])
+	require.Equal(t, "alias/vault", backend.kmsKeys["env_a_"])
+
+	// Metadata is added to existing tags
+	_, _, err = s.InsertOrUpdateSecret(ctx, "env_a_", "2", Metadata{MetadataUniqueID: "x"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"pubkey": "02abc", "managed-by": "lightning-vault", "unique-id": "x"}, backend.tags["env_a_"])
+
+	_, _, err = s.InsertOrUpdateSecret(ctx, "env_a_", "3", nil)
+	require.NoError(t, err)
+	require.Len(t, backend.tags["env_a_"], 3)
+
+	_, _, err = s.InsertOrUpdateSecret(ctx, "env_b_", "1", nil)
+	require.NoError(t, err)
+	require.Empty(t, backend.tags["env_b_"])
+}
+
+func TestMetadataGcp(t *testing.T) {
+	ctx := context.Background()
+
+	backend := newFakeGcpBackend()
+	s := newFakeGcp(t, backend, SecretsManagerConfig{ReplicaLocations: []string{"europe-west1", "europe-west4"}})
+	pubkey := "0367fa307a6e0ce29efadc4f7c4d1109ee689aa1e7bd442afd7270919f9e28c3b7"
+
+	_, _, err := s.InsertOrUpdateSecret(ctx, "env_a_", "1", Metadata{MetadataPubKey: pubkey, MetadataEnv: "Staging.1"})
+	require.NoError(t, err)
+
+	secret := backend.secrets["projects/test/secrets/env_a_"].secret
+	require.Equal(t, map[string]string{"pubkey": pubkey[:63], "env": "staging_1"}, secret.Labels)
+	replicas := secret.GetReplication().GetUserManaged().GetReplicas()
+	require.Len(t, replicas, 2)
+	require.Equal(t, "europe-west4", replicas[1].Location)
+
+	// Metadata is added to existing labels
+	_, _, err = s.InsertOrUpdateSecret(ctx, "env_a_", "2", Metadata{MetadataUniqueID: "x"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"pubkey": pubkey[:63], "env": "staging_1", "unique-id": "x"}, backend.secrets["projects/test/secrets/env_a_"].secret.Labels)
+
+	// Default is automatic replication
+	s = newFakeGcp(t, backend, SecretsManagerConfig{})
+	_, _, err = s.InsertOrUpdateSecret(ctx, "env_b_", "1", nil)
+	require.NoError(t, err)
+	require.NotNil(t, backend.secrets["projects/test/secrets/env_b_"].secret.GetReplication().GetAutomatic())
+}
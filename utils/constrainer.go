@@ -17,17 +17,26 @@ import (
 // ConstrainFunc is the method signature
 type ConstrainFunc func(string, time.Duration) (string, error)
 
+// ConstrainWithCaveatsFunc is the method signature (returns constrained authenticator and the applied caveats)
+type ConstrainWithCaveatsFunc func(string, time.Duration) (string, []string, error)
+
 var (
-	mapping = map[AuthenticatorType]ConstrainFunc{
-		Macaroon: ConstrainFunc(macaroonConstrainer),
-		Rune:     ConstrainFunc(runeConstrainer),
+	mapping = map[AuthenticatorType]ConstrainWithCaveatsFunc{
+		Macaroon: ConstrainWithCaveatsFunc(macaroonConstrainer),
+		Rune:     ConstrainWithCaveatsFunc(runeConstrainer),
 	}
 )
 
 // Constrain constrains a given authenticator
 func Constrain(original string, duration time.Duration, defaultAPIType *api.APIType) (string, error) {
+	result, _, err := ConstrainWithCaveats(original, duration, defaultAPIType)
+	return result, err
+}
+
+// ConstrainWithCaveats constrains a given authenticator and also returns the caveats (restrictions) that were added
+func ConstrainWithCaveats(original string, duration time.Duration, defaultAPIType *api.APIType) (string, []string, error) {
 	if duration > time.Hour*24 {
-		return "", fmt.Errorf("duration too long")
+		return "", nil, fmt.Errorf("duration too long")
 	}
 
 	classification := DetectAuthenticatorType(original, defaultAPIType)
@@ -37,17 +46,17 @@ func Constrain(original string, duration time.Duration, defaultAPIType *api.APIT
 	return unknownConstrainer(original, duration)
 }
 
-func macaroonConstrainer(original string, duration time.Duration) (string, error) {
+func macaroonConstrainer(original string, duration time.Duration) (string, []string, error) {
 	macBytes, err := hex.DecodeString(original)
 	if err != nil {
 		glog.Errorf("Could not decode macaroon: %v", err)
-		return "", err
+		return "", nil, err
 	}
 
 	mac := &macaroon.Macaroon{}
 	if err = mac.UnmarshalBinary(macBytes); err != nil {
 		glog.Errorf("Could not decode macaroon: %v", err)
-		return "", err
+		return "", nil, err
 	}
 
 	macConstraints := []macaroons.Constraint{
@@ -57,38 +66,45 @@ func macaroonConstrainer(original string, duration time.Duration) (string, error
 	constrainedMac, err := macaroons.AddConstraints(mac, macConstraints...)
 	if err != nil {
 		glog.Errorf("Could not decode macaroon: %v", err)
-		return "", err
+		return "", nil, err
 	}
 	result, err := constrainedMac.MarshalBinary()
 	if err != nil {
 		glog.Errorf("Could not decode macaroon: %v", err)
-		return "", err
+		return "", nil, err
+	}
+
+	// AddConstraints works on a clone, so everything after the original caveats was added by us
+	caveats := make([]string, 0)
+	for _, caveat := range constrainedMac.Caveats()[len(mac.Caveats()):] {
+		caveats = append(caveats, string(caveat.Id))
 	}
 
-	return hex.EncodeToString(result), nil
+	return hex.EncodeToString(result), caveats, nil
 }
 
-func runeConstrainer(original string, duration time.Duration) (string, error) {
+func runeConstrainer(original string, duration time.Duration) (string, []string, error) {
 	r, err := runes.FromBase64(original)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
 	limit := time.Now().Add(duration).Unix()
-	rest, _, err := runes.MakeRestrictionFromString(fmt.Sprintf("time<%d", limit), false)
+	restriction := fmt.Sprintf("time<%d", limit)
+	rest, _, err := runes.MakeRestrictionFromString(restriction, false)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
 	result, err := r.GetRestricted(*rest)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
-	return result.ToBase64(), nil
+	return result.ToBase64(), []string{restriction}, nil
 }
 
-func unknownConstrainer(original string, duration time.Duration) (string, error) {
+func unknownConstrainer(original string, duration time.Duration) (string, []string, error) {
 	glog.Warningf("Trying to constrain unknown authenticator for %v", duration) // do not log original on purpose since it is sensitive
-	return "", nil
+	return "", nil, nil
 }
@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -33,3 +35,23 @@ func TestRuneConstrainer(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotEqual(t, constrainedRune, rune, "contained macaroon should be different than original")
 }
+
+func TestConstrainWithCaveats(t *testing.T) {
+	mac := "0201036c6e640224030a10b493608461fb6e64810053fa31ef27991201301a0c0a04696e666f120472656164000216697061646472203139322e3136382e3139322e3136380000062072ea006233da839ce6e9f4721331a12041b228d36c0fdad552680f615766d2f4"
+
+	_, caveats, err := ConstrainWithCaveats(mac, time.Hour, nil)
+	assert.NoError(t, err)
+	assert.Len(t, caveats, 1)
+	assert.True(t, strings.HasPrefix(caveats[0], "time-before "), caveats[0])
+
+	rune := "y3niiNN_cNeIP_SPeoxzXSQMZnqkieqvtABj37rH_UQ9MA=="
+
+	_, caveats, err = ConstrainWithCaveats(rune, time.Hour, nil)
+	assert.NoError(t, err)
+	assert.Len(t, caveats, 1)
+
+	var limit int64
+	_, err = fmt.Sscanf(caveats[0], "time<%d", &limit)
+	assert.NoError(t, err)
+	assert.InDelta(t, time.Now().Add(time.Hour).Unix(), limit, 2)
+}
@@ -14,8 +14,59 @@ import (
 	"github.com/getsentry/sentry-go"
 )
 
+// Headers describing the credential returned by /get/
+const (
+	ExpiresAtHeader         = "X-Credential-Expires-At"
+	CaveatHeader            = "X-Credential-Caveat"
+	AuthenticatorTypeHeader = "X-Credential-Authenticator-Type"
+	IssuanceIDHeader        = "X-Credential-Issuance-Id"
+)
+
+// SetHeaders - writes credential info to HTTP headers
+func (c *CredentialInfo) SetHeaders(h http.Header) {
+	h.Set(ExpiresAtHeader, c.ExpiresAt.UTC().Format(time.RFC3339))
+	for _, caveat := range c.Caveats {
+		h.Add(CaveatHeader, caveat)
+	}
+	h.Set(AuthenticatorTypeHeader, c.AuthenticatorType)
+	if c.IssuanceID != "" {
+		h.Set(IssuanceIDHeader, c.IssuanceID)
+	}
+}
+
+// CredentialInfoFromHeaders - reads credential info from HTTP headers, returns nil when vault did not send it
+func CredentialInfoFromHeaders(h http.Header) (*CredentialInfo, error) {
+	expires := h.Get(ExpiresAtHeader)
+	if expires == "" {
+		return nil, nil
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, expires)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s header %v", ExpiresAtHeader, err)
+	}
+
+	caveats := h.Values(CaveatHeader)
+	if caveats == nil {
+		caveats = make([]string, 0)
+	}
+
+	return &CredentialInfo{
+		ExpiresAt:         expiresAt,
+		Caveats:           caveats,
+		AuthenticatorType: h.Get(AuthenticatorTypeHeader),
+		IssuanceID:        h.Get(IssuanceIDHeader),
+	}, nil
+}
+
 // GetData - obtain data from vault
 func GetData(name string, uniqueID string) (*entities.Data, error) {
+	data, _, err := GetDataWithInfo(name, uniqueID)
+	return data, err
+}
+
+// GetDataWithInfo - obtain data from vault together with info about the credential (nil when vault is too old to send it)
+func GetDataWithInfo(name string, uniqueID string) (*entities.Data, *CredentialInfo, error) {
 	var (
 		data entities.Data
 	)
@@ -28,7 +79,7 @@ func GetData(name string, uniqueID string) (*entities.Data, error) {
 	timeoutInt, err := strconv.Atoi(timeout)
 	if err != nil {
 		sentry.CaptureException(err)
-		return nil, fmt.Errorf("invalid timeout %s", timeout)
+		return nil, nil, fmt.Errorf("invalid timeout %s", timeout)
 	}
 
 	client := &http.Client{
@@ -42,20 +93,20 @@ func GetData(name string, uniqueID string) (*entities.Data, error) {
 
 	req, err := http.NewRequest(http.MethodGet, prettyURL, nil)
 	if err != nil {
-		return nil, fmt.Errorf("http request failed %v", err)
+		return nil, nil, fmt.Errorf("http request failed %v", err)
 	}
 
 	if token != "" {
 		auth := strings.Split(token, UserPassSeparator)
 		if len(auth) != 2 {
-			return nil, fmt.Errorf("invalid token")
+			return nil, nil, fmt.Errorf("invalid token")
 		}
 		req.SetBasicAuth(auth[0], auth[1])
 	} else {
 		presign, err := PresignGetCallerIdentity(5 * time.Minute)
 		if err != nil {
 			sentry.CaptureException(err)
-			return nil, fmt.Errorf("cannot use presign %v", err)
+			return nil, nil, fmt.Errorf("cannot use presign %v", err)
 		}
 
 		req.Header.Add(PresignHeader, presign)
@@ -63,17 +114,22 @@ func GetData(name string, uniqueID string) (*entities.Data, error) {
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("http request got error %v", err)
+		return nil, nil, fmt.Errorf("http request got error %v", err)
 	}
 	if resp.StatusCode == 401 || resp.StatusCode == 403 {
-		return nil, fmt.Errorf("authentication failed: %v", resp.StatusCode)
+		return nil, nil, fmt.Errorf("authentication failed: %v", resp.StatusCode)
 	}
 	if resp.StatusCode == 400 || resp.StatusCode == 404 {
-		return nil, fmt.Errorf("not found: %v", resp.StatusCode)
+		return nil, nil, fmt.Errorf("not found: %v", resp.StatusCode)
 	}
 
 	defer resp.Body.Close()
 
+	info, err := CredentialInfoFromHeaders(resp.Header)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	b, _ := io.ReadAll(resp.Body)
 	s := string(b)
 
@@ -81,8 +137,8 @@ func GetData(name string, uniqueID string) (*entities.Data, error) {
 
 	err = decoder.Decode(&data)
 	if err != nil {
-		return nil, fmt.Errorf("could not decode %v (%s)", err, s)
+		return nil, nil, fmt.Errorf("could not decode %v (%s)", err, s)
 	}
 
-	return &data, nil
+	return &data, info, nil
 }
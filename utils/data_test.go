@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	entities "github.com/bolt-observer/go_common/entities"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetDataWithInfo(t *testing.T) {
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	sent := CredentialInfo{
+		ExpiresAt:         expires,
+		Caveats:           []string{"time-before " + expires.Format(time.RFC3339Nano)},
+		AuthenticatorType: Macaroon.String(),
+		IssuanceID:        "abcd",
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "user" || pass != "pass" || r.URL.Path != "/get/id1/node" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		sent.SetHeaders(w.Header())
+		json.NewEncoder(w).Encode(&entities.Data{PubKey: "node", MacaroonHex: "beef"})
+	}))
+	defer server.Close()
+
+	t.Setenv("MACAROON_STORAGE_URL", server.URL)
+	t.Setenv("READ_TOKEN", "user|pass")
+
+	data, info, err := GetDataWithInfo("node", "id1")
+	require.NoError(t, err)
+	assert.Equal(t, "beef", data.MacaroonHex)
+	require.NotNil(t, info)
+	assert.Equal(t, sent, *info)
+
+	data, err = GetData("node", "id1")
+	require.NoError(t, err)
+	assert.Equal(t, "node", data.PubKey)
+}
+
+func TestCredentialInfoFromHeaders(t *testing.T) {
+	info, err := CredentialInfoFromHeaders(http.Header{})
+	assert.NoError(t, err)
+	assert.Nil(t, info)
+
+	h := http.Header{}
+	h.Set(ExpiresAtHeader, "invalid")
+	_, err = CredentialInfoFromHeaders(h)
+	assert.Error(t, err)
+}
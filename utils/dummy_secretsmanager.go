@@ -2,49 +2,208 @@ package utils
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 // DummySecretsManager struct.
 type DummySecretsManager struct {
 	// Mutex is used for mutual exclusion
 	Mutex sync.Mutex
-	// Names contains all the secrets
-	Names map[string]struct{}
+	// Secrets contains all the secrets (deleted ones are tombstones "{}")
+	Secrets map[string]DummySecret
+	// File is where secrets are persisted (empty means only in memory)
+	File string
+}
+
+// DummySecret is a secret kept by DummySecretsManager
+type DummySecret struct {
+	Value     string    `json:"value"`
+	ChangedAt time.Time `json:"changed_at"`
+	Metadata  Metadata  `json:"metadata,omitempty"`
 }
 
 // NewDummySecretsManager creates a new DummySecretsManager
 func NewDummySecretsManager() *DummySecretsManager {
 	return &DummySecretsManager{
-		Names: make(map[string]struct{}),
+		Secrets: make(map[string]DummySecret),
+	}
+}
+
+// NewDummySecretsManagerWithFile creates a new DummySecretsManager persisted to file (secrets already in file are loaded)
+func NewDummySecretsManagerWithFile(file string) (*DummySecretsManager, error) {
+	s := NewDummySecretsManager()
+	s.File = file
+
+	contents, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(contents, &s.Secrets); err != nil {
+		return nil, fmt.Errorf("invalid secrets file %s: %w", file, err)
+	}
+	if s.Secrets == nil {
+		s.Secrets = make(map[string]DummySecret)
+	}
+
+	return s, nil
+}
+
+// persist writes all secrets to the file (mutex must be held)
+func (s *DummySecretsManager) persist() error {
+	if s.File == "" {
+		return nil
+	}
+
+	contents, err := json.MarshalIndent(s.Secrets, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write and rename so a crash never leaves a truncated file behind
+	tmp, err := os.CreateTemp(filepath.Dir(s.File), filepath.Base(s.File)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(contents)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
 	}
+
+	return os.Rename(tmp.Name(), s.File)
+}
+
+// change sets (or removes when value is nil) secret name, adds metadata and persists the result (mutex must be held)
+func (s *DummySecretsManager) change(name string, value *string, metadata Metadata) error {
+	old, existed := s.Secrets[name]
+	if value == nil {
+		delete(s.Secrets, name)
+	} else {
+		merged := make(Metadata, len(old.Metadata)+len(metadata))
+		for k, v := range old.Metadata {
+			merged[k] = v
+		}
+		for k, v := range metadata {
+			merged[k] = v
+		}
+		s.Secrets[name] = DummySecret{Value: *value, ChangedAt: time.Now(), Metadata: merged}
+	}
+
+	err := s.persist()
+	if err != nil {
+		// Memory and file stay the same
+		if existed {
+			s.Secrets[name] = old
+		} else {
+			delete(s.Secrets, name)
+		}
+	}
+
+	return err
 }
 
 // InsertOrUpdateSecret - inserts or updates a secret
-func (s *DummySecretsManager) InsertOrUpdateSecret(ctx context.Context, name, value string) (string, Change, error) {
+func (s *DummySecretsManager) InsertOrUpdateSecret(ctx context.Context, name, value string, metadata Metadata) (string, Change, error) {
 	s.Mutex.Lock()
 	defer s.Mutex.Unlock()
 
 	change := Updated
-	_, ok := s.Names[name]
-	if !ok {
-		s.Names[name] = struct{}{}
+	// Like other backends storing a deleted secret again is an insert
+	if old, ok := s.Secrets[name]; !ok || old.Value == "{}" {
 		change = Inserted
 	}
 
+	if err := s.change(name, &value, metadata); err != nil {
+		return "", Undefined, err
+	}
+
 	return name, change, nil
 }
 
-// DeleteSecret - deletes a secret
+// DeleteSecret - invalidates a secret (overwrites it with {})
 func (s *DummySecretsManager) DeleteSecret(ctx context.Context, name string) (string, error) {
 	s.Mutex.Lock()
 	defer s.Mutex.Unlock()
 
-	delete(s.Names, name)
+	if _, ok := s.Secrets[name]; !ok {
+		return "", fmt.Errorf("cannot invalidate secret %s: %w", name, ErrSecretNotFound)
+	}
+
+	tombstone := "{}"
+	if err := s.change(name, &tombstone, nil); err != nil {
+		return "", err
+	}
+
 	return name, nil
 }
 
+// ScheduleDeletion - deletes a secret (there is no recovery window)
+func (s *DummySecretsManager) ScheduleDeletion(ctx context.Context, name string, recoveryDays int) (string, error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	if _, ok := s.Secrets[name]; !ok {
+		return "", fmt.Errorf("cannot delete secret %s: %w", name, ErrSecretNotFound)
+	}
+
+	if err := s.change(name, nil, nil); err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// ListTombstones - lists tombstones that have not changed since before
+func (s *DummySecretsManager) ListTombstones(ctx context.Context, prefix string, before time.Time) ([]Tombstone, error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	ret := make([]Tombstone, 0)
+	for name, secret := range s.Secrets {
+		if strings.HasPrefix(name, prefix) && secret.Value == "{}" && secret.ChangedAt.Before(before) {
+			ret = append(ret, Tombstone{Name: name, ChangedAt: secret.ChangedAt})
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+
+	return ret, nil
+}
+
+// Ping - dummy backend is always reachable
+func (s *DummySecretsManager) Ping(ctx context.Context) error {
+	return nil
+}
+
 // LoadSecrets - loads all secrets (used at startup)
-func (s *DummySecretsManager) LoadSecrets(ctx context.Context, prefix string) map[string]string {
-	return make(map[string]string)
+func (s *DummySecretsManager) LoadSecrets(ctx context.Context, prefix string) (map[string]string, error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	ret := make(map[string]string)
+	for name, secret := range s.Secrets {
+		if strings.HasPrefix(name, prefix) {
+			ret[name] = secret.Value
+		}
+	}
+
+	return ret, nil
 }
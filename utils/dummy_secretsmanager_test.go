@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDummySecretsManagerFile(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "secrets.json")
+
+	s, err := NewDummySecretsManagerWithFile(file)
+	require.NoError(t, err)
+	insert(t, s, "env_a_", "a")
+	insert(t, s, "env_b_", "b")
+	_, err = s.DeleteSecret(ctx, "env_b_")
+	require.NoError(t, err)
+
+	// Secrets survive a restart
+	s, err = NewDummySecretsManagerWithFile(file)
+	require.NoError(t, err)
+	secrets, err := s.LoadSecrets(ctx, "env_")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"env_a_": "a", "env_b_": "{}"}, secrets)
+
+	require.NoError(t, os.WriteFile(file, []byte("{"), 0o600))
+	_, err = NewDummySecretsManagerWithFile(file)
+	require.Error(t, err)
+}
@@ -0,0 +1,639 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// fakeAwsBackend is an in-memory stand-in for AWS secrets manager
+type fakeAwsBackend struct {
+	mutex   sync.Mutex
+	secrets map[string]string
+	changed map[string]time.Time
+	// deleted are secrets scheduled for deletion
+	deleted map[string]struct{}
+	tags    map[string]map[string]string
+	kmsKeys map[string]string
+	latency time.Duration
+	batch   bool
+	// throttle is how many calls get ThrottlingException
+	throttle    int32
+	inFlight    int32
+	maxInFlight int32
+	// Injected failures (mutex must be held)
+	failList    error
+	failSecrets map[string]error
+	failWrites  error
+}
+
+func newFakeAwsBackend(n int, latency time.Duration, batch bool) *fakeAwsBackend {
+	f := &fakeAwsBackend{secrets: make(map[string]string), changed: make(map[string]time.Time), deleted: make(map[string]struct{}), tags: make(map[string]map[string]string), kmsKeys: make(map[string]string), failSecrets: make(map[string]error), latency: latency, batch: batch}
+	for i := 0; i < n; i++ {
+		f.secrets[fmt.Sprintf("macaroon_%05d_", i)] = strconv.Itoa(i)
+	}
+	return f
+}
+
+func (f *fakeAwsBackend) call() error {
+	inFlight := atomic.AddInt32(&f.inFlight, 1)
+	defer atomic.AddInt32(&f.inFlight, -1)
+
+	for {
+		highest := atomic.LoadInt32(&f.maxInFlight)
+		if inFlight <= highest || atomic.CompareAndSwapInt32(&f.maxInFlight, highest, inFlight) {
+			break
+		}
+	}
+
+	time.Sleep(f.latency)
+
+	if atomic.AddInt32(&f.throttle, -1) >= 0 {
+		return &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}
+	}
+	return nil
+}
+
+// accessDenied returns the error AWS returns when the policy does not allow the call
+func accessDenied() error {
+	return &smithy.GenericAPIError{Code: "AccessDeniedException", Message: "User is not authorized to perform this operation"}
+}
+
+// names returns secrets matching filters (mutex must be held)
+func (f *fakeAwsBackend) names(filters []types.Filter) []string {
+	ret := make([]string, 0)
+	for name := range f.secrets {
+		if _, deleted := f.deleted[name]; deleted {
+			continue
+		}
+		// AWS matches the name filter case-insensitively and also at word boundaries inside the name,
+		// the fake is even looser so callers must not trust the filter
+		if len(filters) == 0 || strings.Contains(strings.ToLower(name), strings.ToLower(filters[0].Values[0])) {
+			ret = append(ret, name)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// secret resolves a name or ARN (mutex must be held)
+func (f *fakeAwsBackend) secret(id *string) (string, error) {
+	name := strings.TrimPrefix(aws.ToString(id), "arn:")
+	if _, ok := f.secrets[name]; !ok {
+		return "", &smithy.GenericAPIError{Code: "ResourceNotFoundException", Message: "Secrets Manager can't find the specified secret."}
+	}
+	if _, deleted := f.deleted[name]; deleted {
+		return "", &smithy.GenericAPIError{Code: "InvalidRequestException", Message: "You can't perform this operation on the secret because it was marked for deletion."}
+	}
+	return name, nil
+}
+
+func page(names []string, token *string, size int32) ([]string, *string) {
+	start, _ := strconv.Atoi(aws.ToString(token))
+	end := start + int(size)
+	if end >= len(names) {
+		return names[start:], nil
+	}
+	return names[start:end], aws.String(strconv.Itoa(end))
+}
+
+func (f *fakeAwsBackend) ListSecrets(ctx context.Context, params *secretsmanager.ListSecretsInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.ListSecretsOutput, error) {
+	if err := f.call(); err != nil {
+		return nil, err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.failList != nil {
+		return nil, f.failList
+	}
+
+	names, next := page(f.names(params.Filters), params.NextToken, aws.ToInt32(params.MaxResults))
+	ret := &secretsmanager.ListSecretsOutput{NextToken: next}
+	for _, name := range names {
+		entry := types.SecretListEntry{ARN: aws.String("arn:" + name), Name: aws.String(name)}
+		for k, v := range f.tags[name] {
+			entry.Tags = append(entry.Tags, types.Tag{Key: aws.String(k), Value: aws.String(v)})
+		}
+		if changed, ok := f.changed[name]; ok {
+			entry.LastChangedDate = aws.Time(changed)
+		}
+		ret.SecretList = append(ret.SecretList, entry)
+	}
+	return ret, nil
+}
+
+func (f *fakeAwsBackend) GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	if err := f.call(); err != nil {
+		return nil, err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	name, err := f.secret(params.SecretId)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.failSecrets[name]; err != nil {
+		return nil, err
+	}
+	return &secretsmanager.GetSecretValueOutput{ARN: aws.String("arn:" + name), Name: aws.String(name), SecretString: aws.String(f.secrets[name])}, nil
+}
+
+func (f *fakeAwsBackend) BatchGetSecretValue(ctx context.Context, params *secretsmanager.BatchGetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.BatchGetSecretValueOutput, error) {
+	if !f.batch {
+		return nil, &smithy.GenericAPIError{Code: "AccessDeniedException"}
+	}
+	if err := f.call(); err != nil {
+		return nil, err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.failList != nil {
+		return nil, f.failList
+	}
+
+	names, next := page(f.names(params.Filters), params.NextToken, aws.ToInt32(params.MaxResults))
+	ret := &secretsmanager.BatchGetSecretValueOutput{NextToken: next}
+	for _, name := range names {
+		if err, ok := f.failSecrets[name]; ok {
+			ret.Errors = append(ret.Errors, types.APIErrorType{SecretId: aws.String(name), ErrorCode: aws.String("AccessDeniedException"), Message: aws.String(err.Error())})
+			continue
+		}
+		ret.SecretValues = append(ret.SecretValues, types.SecretValueEntry{Name: aws.String(name), SecretString: aws.String(f.secrets[name])})
+	}
+	return ret, nil
+}
+
+func (f *fakeAwsBackend) CreateSecret(ctx context.Context, params *secretsmanager.CreateSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.CreateSecretOutput, error) {
+	if err := f.call(); err != nil {
+		return nil, err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.failWrites != nil {
+		return nil, f.failWrites
+	}
+
+	name := aws.ToString(params.Name)
+	if _, deleted := f.deleted[name]; deleted {
+		return nil, &smithy.GenericAPIError{Code: "InvalidRequestException", Message: "You can't create this secret because a secret with this name is already scheduled for deletion."}
+	}
+	if _, ok := f.secrets[name]; ok {
+		return nil, &smithy.GenericAPIError{Code: "ResourceExistsException", Message: "The operation failed because the secret " + name + " already exists."}
+	}
+
+	f.secrets[name] = aws.ToString(params.SecretString)
+	f.changed[name] = time.Now()
+	f.tags[name] = make(map[string]string)
+	for _, tag := range params.Tags {
+		f.tags[name][aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	if params.KmsKeyId != nil {
+		f.kmsKeys[name] = *params.KmsKeyId
+	}
+	return &secretsmanager.CreateSecretOutput{ARN: aws.String("arn:" + name), Name: aws.String(name)}, nil
+}
+
+func (f *fakeAwsBackend) UpdateSecret(ctx context.Context, params *secretsmanager.UpdateSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.UpdateSecretOutput, error) {
+	if err := f.call(); err != nil {
+		return nil, err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.failWrites != nil {
+		return nil, f.failWrites
+	}
+
+	name, err := f.secret(params.SecretId)
+	if err != nil {
+		return nil, err
+	}
+
+	f.secrets[name] = aws.ToString(params.SecretString)
+	f.changed[name] = time.Now()
+	return &secretsmanager.UpdateSecretOutput{ARN: aws.String("arn:" + name), Name: aws.String(name)}, nil
+}
+
+func (f *fakeAwsBackend) DeleteSecret(ctx context.Context, params *secretsmanager.DeleteSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.DeleteSecretOutput, error) {
+	if err := f.call(); err != nil {
+		return nil, err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.failWrites != nil {
+		return nil, f.failWrites
+	}
+
+	name, err := f.secret(params.SecretId)
+	if err != nil {
+		return nil, err
+	}
+
+	if aws.ToBool(params.ForceDeleteWithoutRecovery) {
+		delete(f.secrets, name)
+		delete(f.changed, name)
+		delete(f.tags, name)
+		delete(f.kmsKeys, name)
+	} else {
+		f.deleted[name] = struct{}{}
+	}
+	return &secretsmanager.DeleteSecretOutput{ARN: aws.String("arn:" + name), Name: aws.String(name)}, nil
+}
+
+func (f *fakeAwsBackend) RestoreSecret(ctx context.Context, params *secretsmanager.RestoreSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.RestoreSecretOutput, error) {
+	if err := f.call(); err != nil {
+		return nil, err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.failWrites != nil {
+		return nil, f.failWrites
+	}
+
+	name := strings.TrimPrefix(aws.ToString(params.SecretId), "arn:")
+	if _, ok := f.secrets[name]; !ok {
+		return nil, &smithy.GenericAPIError{Code: "ResourceNotFoundException"}
+	}
+
+	delete(f.deleted, name)
+	return &secretsmanager.RestoreSecretOutput{ARN: aws.String("arn:" + name), Name: aws.String(name)}, nil
+}
+
+func (f *fakeAwsBackend) TagResource(ctx context.Context, params *secretsmanager.TagResourceInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.TagResourceOutput, error) {
+	if err := f.call(); err != nil {
+		return nil, err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.failWrites != nil {
+		return nil, f.failWrites
+	}
+
+	name, err := f.secret(params.SecretId)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.tags[name] == nil {
+		f.tags[name] = make(map[string]string)
+	}
+	for _, tag := range params.Tags {
+		f.tags[name][aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return &secretsmanager.TagResourceOutput{}, nil
+}
+
+// newFakeAws returns an AwsSecretsManager backed by backend
+func newFakeAws(backend *fakeAwsBackend) *AwsSecretsManager {
+	s := NewAwsSecretsManagerWithConfig(SecretsManagerConfig{})
+	s.client = backend
+	return s
+}
+
+type fakeGcpVersion struct {
+	data    []byte
+	state   secretmanagerpb.SecretVersion_State
+	created time.Time
+}
+
+type fakeGcpSecret struct {
+	secret   *secretmanagerpb.Secret
+	versions []*fakeGcpVersion
+}
+
+// fakeGcpBackend is an in-memory stand-in for GCP secret manager (served over gRPC)
+type fakeGcpBackend struct {
+	secretmanagerpb.UnimplementedSecretManagerServiceServer
+
+	mutex   sync.Mutex
+	secrets map[string]*fakeGcpSecret
+	calls   int32
+	// Injected failures (mutex must be held)
+	failList    error
+	failSecrets map[string]error
+	failWrites  error
+}
+
+func newFakeGcpBackend() *fakeGcpBackend {
+	return &fakeGcpBackend{secrets: make(map[string]*fakeGcpSecret), failSecrets: make(map[string]error)}
+}
+
+// permissionDenied returns the error GCP returns when the service account lacks a role
+func permissionDenied() error {
+	return status.Errorf(codes.PermissionDenied, "Permission denied on resource (or it might not exist).")
+}
+
+// lookup returns the secret projects/*/secrets/{id} (mutex must be held)
+func (f *fakeGcpBackend) lookup(name string) (*fakeGcpSecret, error) {
+	secret, ok := f.secrets[name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Secret [%s] not found or has no versions.", name)
+	}
+	return secret, nil
+}
+
+// version returns version projects/*/secrets/*/versions/{n|latest} (mutex must be held)
+func (f *fakeGcpBackend) version(name string) (*secretmanagerpb.SecretVersion, *fakeGcpVersion, error) {
+	i := strings.LastIndex(name, "/versions/")
+	if i < 0 {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "invalid version %s", name)
+	}
+
+	secret, err := f.lookup(name[:i])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	number := 0
+	if id := name[i+len("/versions/"):]; id == "latest" {
+		for n := len(secret.versions); n > 0; n-- {
+			if secret.versions[n-1].state == secretmanagerpb.SecretVersion_ENABLED {
+				number = n
+				break
+			}
+		}
+	} else {
+		number, _ = strconv.Atoi(id)
+	}
+	if number < 1 || number > len(secret.versions) {
+		return nil, nil, status.Errorf(codes.NotFound, "Secret Version [%s] not found.", name)
+	}
+
+	v := secret.versions[number-1]
+	return &secretmanagerpb.SecretVersion{Name: fmt.Sprintf("%s/versions/%d", name[:i], number), State: v.state, CreateTime: timestamppb.New(v.created)}, v, nil
+}
+
+func (f *fakeGcpBackend) GetSecret(ctx context.Context, req *secretmanagerpb.GetSecretRequest) (*secretmanagerpb.Secret, error) {
+	atomic.AddInt32(&f.calls, 1)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	secret, err := f.lookup(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	return secret.secret, nil
+}
+
+func (f *fakeGcpBackend) CreateSecret(ctx context.Context, req *secretmanagerpb.CreateSecretRequest) (*secretmanagerpb.Secret, error) {
+	atomic.AddInt32(&f.calls, 1)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.failWrites != nil {
+		return nil, f.failWrites
+	}
+
+	name := req.Parent + "/secrets/" + req.SecretId
+	if _, ok := f.secrets[name]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "Secret [%s] already exists.", name)
+	}
+
+	secret := &secretmanagerpb.Secret{Name: name, Replication: req.Secret.GetReplication(), CreateTime: timestamppb.Now(), Labels: req.Secret.GetLabels()}
+	f.secrets[name] = &fakeGcpSecret{secret: secret}
+	return secret, nil
+}
+
+func (f *fakeGcpBackend) UpdateSecret(ctx context.Context, req *secretmanagerpb.UpdateSecretRequest) (*secretmanagerpb.Secret, error) {
+	atomic.AddInt32(&f.calls, 1)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.failWrites != nil {
+		return nil, f.failWrites
+	}
+
+	secret, err := f.lookup(req.Secret.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range req.UpdateMask.GetPaths() {
+		switch path {
+		case "expire_time":
+			secret.secret.Expiration = nil
+			if req.Secret.GetExpireTime() != nil {
+				secret.secret.Expiration = &secretmanagerpb.Secret_ExpireTime{ExpireTime: req.Secret.GetExpireTime()}
+			}
+		case "labels":
+			secret.secret.Labels = req.Secret.GetLabels()
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "unsupported update mask %s", path)
+		}
+	}
+	return secret.secret, nil
+}
+
+func (f *fakeGcpBackend) DeleteSecret(ctx context.Context, req *secretmanagerpb.DeleteSecretRequest) (*emptypb.Empty, error) {
+	atomic.AddInt32(&f.calls, 1)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.failWrites != nil {
+		return nil, f.failWrites
+	}
+
+	if _, err := f.lookup(req.Name); err != nil {
+		return nil, err
+	}
+	delete(f.secrets, req.Name)
+	return &emptypb.Empty{}, nil
+}
+
+// fakeGcpPage returns the page of items starting at token
+func fakeGcpPage(count int, token string, size int32) (int, int, string) {
+	if size <= 0 {
+		size = 25
+	}
+	start, _ := strconv.Atoi(token)
+	end := start + int(size)
+	if end >= count {
+		return start, count, ""
+	}
+	return start, end, strconv.Itoa(end)
+}
+
+func (f *fakeGcpBackend) ListSecrets(ctx context.Context, req *secretmanagerpb.ListSecretsRequest) (*secretmanagerpb.ListSecretsResponse, error) {
+	atomic.AddInt32(&f.calls, 1)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.failList != nil {
+		return nil, f.failList
+	}
+
+	// Like GCP the name filter matches anywhere in the name
+	filter := strings.TrimPrefix(req.Filter, "name:")
+	names := make([]string, 0)
+	for name := range f.secrets {
+		if strings.HasPrefix(name, req.Parent+"/secrets/") && strings.Contains(getLastSegment(name), filter) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	start, end, next := fakeGcpPage(len(names), req.PageToken, req.PageSize)
+	ret := &secretmanagerpb.ListSecretsResponse{NextPageToken: next, TotalSize: int32(len(names))}
+	for _, name := range names[start:end] {
+		ret.Secrets = append(ret.Secrets, f.secrets[name].secret)
+	}
+	return ret, nil
+}
+
+func (f *fakeGcpBackend) AddSecretVersion(ctx context.Context, req *secretmanagerpb.AddSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	atomic.AddInt32(&f.calls, 1)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.failWrites != nil {
+		return nil, f.failWrites
+	}
+
+	secret, err := f.lookup(req.Parent)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &fakeGcpVersion{data: req.Payload.GetData(), state: secretmanagerpb.SecretVersion_ENABLED, created: time.Now()}
+	secret.versions = append(secret.versions, v)
+	return &secretmanagerpb.SecretVersion{Name: fmt.Sprintf("%s/versions/%d", req.Parent, len(secret.versions)), State: v.state, CreateTime: timestamppb.New(v.created)}, nil
+}
+
+func (f *fakeGcpBackend) GetSecretVersion(ctx context.Context, req *secretmanagerpb.GetSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	atomic.AddInt32(&f.calls, 1)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	version, _, err := f.version(req.Name)
+	return version, err
+}
+
+func (f *fakeGcpBackend) AccessSecretVersion(ctx context.Context, req *secretmanagerpb.AccessSecretVersionRequest) (*secretmanagerpb.AccessSecretVersionResponse, error) {
+	atomic.AddInt32(&f.calls, 1)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	version, v, err := f.version(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.failSecrets[getLastSegment(req.Name[:strings.LastIndex(req.Name, "/versions/")])]; err != nil {
+		return nil, err
+	}
+	if v.state != secretmanagerpb.SecretVersion_ENABLED {
+		return nil, status.Errorf(codes.FailedPrecondition, "Secret Version [%s] is in %s state.", version.Name, v.state)
+	}
+	return &secretmanagerpb.AccessSecretVersionResponse{Name: version.Name, Payload: &secretmanagerpb.SecretPayload{Data: v.data}}, nil
+}
+
+func (f *fakeGcpBackend) ListSecretVersions(ctx context.Context, req *secretmanagerpb.ListSecretVersionsRequest) (*secretmanagerpb.ListSecretVersionsResponse, error) {
+	atomic.AddInt32(&f.calls, 1)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	secret, err := f.lookup(req.Parent)
+	if err != nil {
+		return nil, err
+	}
+
+	// Newest first
+	start, end, next := fakeGcpPage(len(secret.versions), req.PageToken, req.PageSize)
+	ret := &secretmanagerpb.ListSecretVersionsResponse{NextPageToken: next, TotalSize: int32(len(secret.versions))}
+	for i := start; i < end; i++ {
+		number := len(secret.versions) - i
+		v := secret.versions[number-1]
+		ret.Versions = append(ret.Versions, &secretmanagerpb.SecretVersion{Name: fmt.Sprintf("%s/versions/%d", req.Parent, number), State: v.state, CreateTime: timestamppb.New(v.created)})
+	}
+	return ret, nil
+}
+
+func (f *fakeGcpBackend) DestroySecretVersion(ctx context.Context, req *secretmanagerpb.DestroySecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	atomic.AddInt32(&f.calls, 1)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.failWrites != nil {
+		return nil, f.failWrites
+	}
+
+	version, v, err := f.version(req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	v.data = nil
+	v.state = secretmanagerpb.SecretVersion_DESTROYED
+	version.State = v.state
+	return version, nil
+}
+
+// states returns the states of all versions of secret id (oldest first)
+func (f *fakeGcpBackend) states(id string) []secretmanagerpb.SecretVersion_State {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	ret := make([]secretmanagerpb.SecretVersion_State, 0)
+	if secret, ok := f.secrets["projects/test/secrets/"+id]; ok {
+		for _, v := range secret.versions {
+			ret = append(ret, v.state)
+		}
+	}
+	return ret
+}
+
+// newFakeGcp serves backend over gRPC and returns a GcpSecretsManager connected to it
+func newFakeGcp(t *testing.T, backend *fakeGcpBackend, config SecretsManagerConfig) *GcpSecretsManager {
+	t.Setenv("GCP_PROJECT_ID", "test")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := grpc.NewServer()
+	secretmanagerpb.RegisterSecretManagerServiceServer(server, backend)
+	go server.Serve(listener)
+
+	config.Endpoint = listener.Addr().String()
+	config.Insecure = true
+	s := NewGcpSecretsManagerWithConfig(config)
+
+	t.Cleanup(func() {
+		s.Close()
+		server.Stop()
+	})
+
+	return s
+}
@@ -2,9 +2,13 @@ package utils
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"hash/crc32"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"path/filepath"
@@ -14,41 +18,173 @@ import (
 	backoff "github.com/cenkalti/backoff/v4"
 	"github.com/getsentry/sentry-go"
 	"github.com/golang/glog"
+	gax "github.com/googleapis/gax-go/v2"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // GcpSecretsManager struct.
 type GcpSecretsManager struct {
+	config SecretsManagerConfig
+
+	mutex   sync.Mutex
+	client  *sapi.Client
+	project string
 }
 
-// NewGcpSecretsManager creates a new GcpSecretsManager
+// ErrInsecureWithoutEndpoint is returned when a plaintext connection would go to Google itself
+var ErrInsecureWithoutEndpoint = errors.New("SECRETS_ENDPOINT_INSECURE requires GCP_SECRETMANAGER_ENDPOINT")
+
+// NewGcpSecretsManager creates a new GcpSecretsManager (configured through GCP_SECRETMANAGER_ENDPOINT, SECRETS_ENDPOINT_INSECURE, GCP_REPLICATION_LOCATIONS, GCP_KEEP_VERSIONS and SECRETS_TIMEOUT)
 func NewGcpSecretsManager() *GcpSecretsManager {
-	return &GcpSecretsManager{}
+	return NewGcpSecretsManagerWithConfig(secretsManagerConfigFromEnv("GCP_SECRETMANAGER_ENDPOINT"))
 }
 
-// LoadSecrets - loads all secrets (used at startup)
-func (s *GcpSecretsManager) LoadSecrets(ctx context.Context, prefix string) map[string]string {
-	ret := make(map[string]string)
-	for _, name := range listSecretsGcp(ctx, prefix) {
-		key, value, err := getSecretGcp(ctx, name)
-		if err != nil {
-			glog.Errorf("Could not get secret: %v", err)
-			sentry.CaptureException(err)
-			continue
+// NewGcpSecretsManagerWithConfig creates a new GcpSecretsManager
+func NewGcpSecretsManagerWithConfig(config SecretsManagerConfig) *GcpSecretsManager {
+	return &GcpSecretsManager{config: config}
+}
+
+// getClient returns the long-lived client and the project, they are obtained on first use (the client refreshes credentials by itself)
+func (s *GcpSecretsManager) getClient(ctx context.Context) (*sapi.Client, string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.client != nil {
+		return s.client, s.project, nil
+	}
+
+	if s.config.Insecure && s.config.Endpoint == "" {
+		sentry.CaptureException(ErrInsecureWithoutEndpoint)
+		glog.Errorf("refusing to connect: %v", ErrInsecureWithoutEndpoint)
+		return nil, "", ErrInsecureWithoutEndpoint
+	}
+
+	project, err := GetGCPProjectID()
+	if err != nil {
+		sentry.CaptureException(err)
+		glog.Errorf("unable to load project: %v", err)
+		return nil, "", err
+	}
+
+	opts := make([]option.ClientOption, 0)
+	if s.config.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(s.config.Endpoint))
+	}
+	if s.config.Insecure {
+		opts = append(opts, option.WithoutAuthentication(), option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())))
+	}
+
+	// The client must outlive ctx
+	client, err := sapi.NewClient(context.Background(), opts...)
+	if err != nil {
+		sentry.CaptureException(err)
+		glog.Errorf("unable to load sdk: %v", err)
+		return nil, "", err
+	}
+
+	if s.config.Timeout > 0 {
+		timeout := gax.WithTimeout(s.config.Timeout)
+		o := client.CallOptions
+		for _, call := range []*[]gax.CallOption{&o.ListSecrets, &o.CreateSecret, &o.AddSecretVersion, &o.GetSecret, &o.UpdateSecret, &o.DeleteSecret,
+			&o.ListSecretVersions, &o.GetSecretVersion, &o.AccessSecretVersion, &o.DisableSecretVersion, &o.EnableSecretVersion, &o.DestroySecretVersion} {
+			*call = append(*call, timeout)
 		}
-		ret[key] = value
 	}
 
-	return ret
+	s.client = client
+	s.project = project
+
+	return s.client, s.project, nil
+}
+
+// Close releases the client
+func (s *GcpSecretsManager) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.client == nil {
+		return nil
+	}
+
+	err := s.client.Close()
+	s.client = nil
+
+	return err
+}
+
+// LoadSecrets - loads all secrets (used at startup)
+func (s *GcpSecretsManager) LoadSecrets(ctx context.Context, prefix string) (map[string]string, error) {
+	client, project, err := s.getClient(ctx)
+	if err != nil {
+		return make(map[string]string), &LoadError{ListErr: err}
+	}
+
+	loadErr := &LoadError{}
+
+	names, err := listSecretsGcp(ctx, client, project, prefix)
+	if err != nil {
+		loadErr.ListErr = err
+	}
+
+	var ret map[string]string
+	ret, loadErr.Secrets = fetchConcurrently(ctx, names, loadConcurrency(), isThrottledGcp, func(ctx context.Context, name string) (string, string, error) {
+		return getSecretGcp(ctx, client, project, name)
+	})
+
+	return ret, loadErr.OrNil()
+}
+
+// isThrottledGcp returns true for errors that mean we should slow down
+func isThrottledGcp(err error) bool {
+	switch status.Code(err) {
+	case codes.ResourceExhausted, codes.Unavailable:
+		return true
+	}
+
+	return false
+}
+
+// isNotFoundGcp returns true when the secret does not exist
+func isNotFoundGcp(err error) bool {
+	return status.Code(err) == codes.NotFound
+}
+
+// isPermanentGcp returns true for errors that retrying will not fix
+func isPermanentGcp(err error) bool {
+	if errors.Is(err, ErrSecretNotFound) || errors.Is(err, ErrInsecureWithoutEndpoint) {
+		return true
+	}
+
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.PermissionDenied, codes.Unauthenticated, codes.FailedPrecondition:
+		return true
+	}
+
+	return false
 }
 
 // InsertOrUpdateSecret - inserts or updates a secret
-func (s *GcpSecretsManager) InsertOrUpdateSecret(ctx context.Context, name, value string) (string, Change, error) {
+func (s *GcpSecretsManager) InsertOrUpdateSecret(ctx context.Context, name, value string, metadata Metadata) (string, Change, error) {
 	back := backoff.NewExponentialBackOff()
 	back.MaxElapsedTime = MaxRetryTime
 
+	client, project, err := s.getClient(ctx)
+	if err != nil {
+		return "", Undefined, err
+	}
+
 	x, err := backoff.RetryNotifyWithData(func() (InsertOrUpdateSecretData, error) {
-		arn, change, err := insertOrUpdateSecretGcp(ctx, name, value)
+		arn, change, err := insertOrUpdateSecretGcp(ctx, client, project, name, value, metadata, s.config)
+		if isPermanentGcp(err) {
+			err = backoff.Permanent(err)
+		}
 		return InsertOrUpdateSecretData{
 			Arn:    arn,
 			Change: change,
@@ -65,8 +201,17 @@ func (s *GcpSecretsManager) DeleteSecret(ctx context.Context, name string) (stri
 	back := backoff.NewExponentialBackOff()
 	back.MaxElapsedTime = MaxRetryTime
 
+	client, project, err := s.getClient(ctx)
+	if err != nil {
+		return "", err
+	}
+
 	resp, err := backoff.RetryNotifyWithData(func() (string, error) {
-		return deleteSecretGcp(ctx, name)
+		ret, err := invalidateSecretGcp(ctx, client, project, name, s.config.KeepVersions)
+		if isPermanentGcp(err) {
+			return ret, backoff.Permanent(err)
+		}
+		return ret, err
 	}, back, func(err error, d time.Duration) {
 		glog.Warningf("Error invalidating secret")
 	})
@@ -74,30 +219,60 @@ func (s *GcpSecretsManager) DeleteSecret(ctx context.Context, name string) (stri
 	return resp, err
 }
 
-func insertOrUpdateSecretGcp(ctx context.Context, name, value string) (string, Change, error) {
-	ch := Inserted
-	project, err := GetGCPProjectID()
+// ScheduleDeletion - invalidates a secret and lets it expire after the recovery window (deletes it immediately when recoveryDays is 0)
+func (s *GcpSecretsManager) ScheduleDeletion(ctx context.Context, name string, recoveryDays int) (string, error) {
+	back := backoff.NewExponentialBackOff()
+	back.MaxElapsedTime = MaxRetryTime
+
+	client, project, err := s.getClient(ctx)
 	if err != nil {
-		sentry.CaptureException(err)
-		glog.Errorf("unable to load project: %v", err)
-		return "", ch, err
+		return "", err
 	}
-	client, err := sapi.NewClient(ctx)
+
+	resp, err := backoff.RetryNotifyWithData(func() (string, error) {
+		ret, err := scheduleDeletionGcp(ctx, client, project, name, recoveryDays)
+		if isPermanentGcp(err) {
+			return ret, backoff.Permanent(err)
+		}
+		return ret, err
+	}, back, func(err error, d time.Duration) {
+		glog.Warningf("Error deleting secret")
+	})
+
+	return resp, err
+}
+
+// ListTombstones - lists tombstones that have not changed since before
+func (s *GcpSecretsManager) ListTombstones(ctx context.Context, prefix string, before time.Time) ([]Tombstone, error) {
+	client, project, err := s.getClient(ctx)
 	if err != nil {
-		sentry.CaptureException(err)
-		glog.Errorf("unable to load sdk: %v", err)
-		return "", ch, err
+		return nil, err
 	}
 
-	defer client.Close()
+	return listTombstonesGcp(ctx, client, project, prefix, before, loadConcurrency())
+}
 
-	secretName := fmt.Sprintf("projects/%s/secrets/%s", project, name)
-	payload := []byte(value)
-	crc32c := crc32.MakeTable(crc32.Castagnoli)
-	checksum := int64(crc32.Checksum(payload, crc32c))
+// Ping - checks whether secret manager is reachable
+func (s *GcpSecretsManager) Ping(ctx context.Context) error {
+	client, project, err := s.getClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.ListSecrets(ctx, &secretmanagerpb.ListSecretsRequest{Parent: fmt.Sprintf("projects/%s", project), PageSize: 1}).Next()
+	if err == iterator.Done {
+		return nil
+	}
+
+	return err
+}
+
+func insertOrUpdateSecretGcp(ctx context.Context, client *sapi.Client, project, name, value string, metadata Metadata, config SecretsManagerConfig) (string, Change, error) {
+	var err error
+	ch := Inserted
 
 	get := &secretmanagerpb.GetSecretRequest{
-		Name: secretName,
+		Name: fmt.Sprintf("projects/%s/secrets/%s", project, name),
 	}
 
 	var secret *secretmanagerpb.Secret
@@ -105,6 +280,25 @@ func insertOrUpdateSecretGcp(ctx context.Context, name, value string) (string, C
 	secret, err = client.GetSecret(ctx, get)
 	if err == nil {
 		ch = Updated
+
+		/* Due to tombstones */
+		_, current, err := getSecretGcp(ctx, client, project, name)
+		if err == nil && current == "{}" {
+			ch = Inserted
+		}
+		/* Due to tombstones */
+
+		if secret.GetExpireTime() != nil {
+			glog.Infof("Secret %s is scheduled for deletion, restoring it", name)
+			ch = Inserted
+
+			err = cancelExpirationGcp(ctx, client, secret.Name)
+			if err != nil {
+				return "", Undefined, err
+			}
+		}
+
+		labelSecretGcp(ctx, client, secret, metadata)
 	} else {
 		ch = Inserted
 
@@ -112,11 +306,8 @@ func insertOrUpdateSecretGcp(ctx context.Context, name, value string) (string, C
 			Parent:   fmt.Sprintf("projects/%s", project),
 			SecretId: name,
 			Secret: &secretmanagerpb.Secret{
-				Replication: &secretmanagerpb.Replication{
-					Replication: &secretmanagerpb.Replication_Automatic_{
-						Automatic: &secretmanagerpb.Replication_Automatic{},
-					},
-				},
+				Replication: replicationGcp(config.ReplicaLocations),
+				Labels:      gcpLabels(metadata),
 			},
 		}
 
@@ -126,64 +317,289 @@ func insertOrUpdateSecretGcp(ctx context.Context, name, value string) (string, C
 		}
 	}
 
+	err = addSecretVersionGcp(ctx, client, secret.Name, value)
+	if err != nil {
+		return "", ch, err
+	}
+
+	pruneVersionsGcp(ctx, client, secret.Name, config.KeepVersions)
+
+	return secret.Name, ch, nil
+}
+
+// addSecretVersionGcp makes value the latest version of secret
+func addSecretVersionGcp(ctx context.Context, client *sapi.Client, secret, value string) error {
+	payload := []byte(value)
+	crc32c := crc32.MakeTable(crc32.Castagnoli)
+	checksum := int64(crc32.Checksum(payload, crc32c))
+
 	addSecretVersionReq := &secretmanagerpb.AddSecretVersionRequest{
-		Parent: secret.Name,
+		Parent: secret,
 		Payload: &secretmanagerpb.SecretPayload{
 			Data:       payload,
 			DataCrc32C: &checksum,
 		},
 	}
 
-	_, err = client.AddSecretVersion(ctx, addSecretVersionReq)
-	if err != nil {
-		return "", ch, err
+	_, err := client.AddSecretVersion(ctx, addSecretVersionReq)
+
+	return err
+}
+
+// pruneVersionsGcp destroys all but the keep newest versions of secret (nothing is destroyed when keep is 0), failures are only logged
+func pruneVersionsGcp(ctx context.Context, client *sapi.Client, secret string, keep int) {
+	if keep <= 0 {
+		return
 	}
 
-	return secret.Name, ch, nil
+	type version struct {
+		name   string
+		number int
+	}
+
+	versions := make([]version, 0)
+	it := client.ListSecretVersions(ctx, &secretmanagerpb.ListSecretVersionsRequest{Parent: secret})
+	for {
+		v, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			glog.Warningf("Could not list versions of %s: %v", secret, err)
+			sentry.CaptureException(err)
+			return
+		}
+		if v.State == secretmanagerpb.SecretVersion_DESTROYED {
+			continue
+		}
+
+		number, err := strconv.Atoi(getLastSegment(v.Name))
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version{name: v.Name, number: number})
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].number > versions[j].number
+	})
+
+	for i := keep; i < len(versions); i++ {
+		_, err := client.DestroySecretVersion(ctx, &secretmanagerpb.DestroySecretVersionRequest{Name: versions[i].name})
+		if err != nil {
+			glog.Warningf("Could not destroy version %s: %v", versions[i].name, err)
+			sentry.CaptureException(err)
+		}
+	}
 }
 
-func deleteSecretGcp(ctx context.Context, name string) (string, error) {
-	project, err := GetGCPProjectID()
+// replicationGcp returns user-managed replication to locations (automatic replication when empty)
+func replicationGcp(locations []string) *secretmanagerpb.Replication {
+	if len(locations) == 0 {
+		return &secretmanagerpb.Replication{
+			Replication: &secretmanagerpb.Replication_Automatic_{
+				Automatic: &secretmanagerpb.Replication_Automatic{},
+			},
+		}
+	}
+
+	replicas := make([]*secretmanagerpb.Replication_UserManaged_Replica, 0, len(locations))
+	for _, location := range locations {
+		replicas = append(replicas, &secretmanagerpb.Replication_UserManaged_Replica{Location: location})
+	}
+
+	return &secretmanagerpb.Replication{
+		Replication: &secretmanagerpb.Replication_UserManaged_{
+			UserManaged: &secretmanagerpb.Replication_UserManaged{Replicas: replicas},
+		},
+	}
+}
+
+// gcpLabel returns value with only characters allowed in labels (lowercase letters, digits, _ and -) and at most 63 of them
+func gcpLabel(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(value))
+
+	if len(value) > 63 {
+		// Pubkeys are longer, the full one is part of the name anyway
+		value = value[:63]
+	}
+
+	return value
+}
+
+// gcpLabels returns metadata as labels (nil when empty)
+func gcpLabels(metadata Metadata) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+
+	ret := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		ret[gcpLabel(k)] = gcpLabel(v)
+	}
+
+	return ret
+}
+
+// labelSecretGcp adds metadata missing from the labels of secret
+func labelSecretGcp(ctx context.Context, client *sapi.Client, secret *secretmanagerpb.Secret, metadata Metadata) {
+	labels := make(map[string]string, len(secret.GetLabels())+len(metadata))
+	for k, v := range secret.GetLabels() {
+		labels[k] = v
+	}
+
+	changed := false
+	for k, v := range gcpLabels(metadata) {
+		if value, ok := labels[k]; !ok || value != v {
+			labels[k] = v
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+
+	req := &secretmanagerpb.UpdateSecretRequest{
+		Secret:     &secretmanagerpb.Secret{Name: secret.Name, Labels: labels},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"labels"}},
+	}
+
+	// The value is stored anyway, so failing to label is not fatal
+	_, err := client.UpdateSecret(ctx, req)
 	if err != nil {
+		glog.Warningf("Could not label secret %s: %v", secret.Name, err)
 		sentry.CaptureException(err)
-		glog.Errorf("unable to load project: %v", err)
+	}
+}
+
+// cancelExpirationGcp removes the expiration of secret
+func cancelExpirationGcp(ctx context.Context, client *sapi.Client, secret string) error {
+	req := &secretmanagerpb.UpdateSecretRequest{
+		Secret:     &secretmanagerpb.Secret{Name: secret},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"expire_time"}},
+	}
+
+	_, err := client.UpdateSecret(ctx, req)
+
+	return err
+}
+
+// invalidateSecretGcp overwrites secret name with a tombstone and destroys its older versions (unless all versions are kept)
+func invalidateSecretGcp(ctx context.Context, client *sapi.Client, project, name string, keep int) (string, error) {
+	secret, err := client.GetSecret(ctx, &secretmanagerpb.GetSecretRequest{Name: fmt.Sprintf("projects/%s/secrets/%s", project, name)})
+	if isNotFoundGcp(err) || (err == nil && secret.GetExpireTime() != nil) {
+		glog.Errorf("Could not invalidate secret that does not exist: %s", name)
+		sentry.CaptureMessage(fmt.Sprintf("Could not invalidate secret that does not exist: %s", name))
+		return "", fmt.Errorf("cannot invalidate secret %s: %w", name, ErrSecretNotFound)
+	}
+	if err != nil {
 		return "", err
 	}
-	client, err := sapi.NewClient(ctx)
+
+	err = addSecretVersionGcp(ctx, client, secret.Name, "{}")
 	if err != nil {
-		sentry.CaptureException(err)
-		glog.Errorf("unable to load sdk: %v", err)
 		return "", err
 	}
 
-	defer client.Close()
+	if keep > 0 {
+		// The deleted secret should not remain retrievable
+		pruneVersionsGcp(ctx, client, secret.Name, 1)
+	}
 
-	req := &secretmanagerpb.DeleteSecretRequest{
-		Name: fmt.Sprintf("projects/%s/secrets/%s", project, name),
+	return secret.Name, nil
+}
+
+// scheduleDeletionGcp invalidates secret name and sets it to expire after recoveryDays (deletes it when recoveryDays is 0)
+func scheduleDeletionGcp(ctx context.Context, client *sapi.Client, project, name string, recoveryDays int) (string, error) {
+	secretName := fmt.Sprintf("projects/%s/secrets/%s", project, name)
+
+	if recoveryDays <= 0 {
+		err := client.DeleteSecret(ctx, &secretmanagerpb.DeleteSecretRequest{Name: secretName})
+		if isNotFoundGcp(err) {
+			return "", fmt.Errorf("cannot delete secret %s: %w", name, ErrSecretNotFound)
+		}
+		if err != nil {
+			return "", err
+		}
+		return secretName, nil
+	}
+
+	_, current, err := getSecretGcp(ctx, client, project, name)
+	if err != nil && !isNotFoundGcp(err) {
+		return "", err
 	}
-	err = client.DeleteSecret(ctx, req)
+	if err != nil || current != "{}" {
+		_, err = invalidateSecretGcp(ctx, client, project, name, 1)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	req := &secretmanagerpb.UpdateSecretRequest{
+		Secret: &secretmanagerpb.Secret{
+			Name:       secretName,
+			Expiration: &secretmanagerpb.Secret_ExpireTime{ExpireTime: timestamppb.New(time.Now().AddDate(0, 0, recoveryDays))},
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"expire_time"}},
+	}
+
+	_, err = client.UpdateSecret(ctx, req)
 	if err != nil {
 		return "", err
 	}
-	return name, nil
+
+	return secretName, nil
 }
 
-func listSecretsGcp(ctx context.Context, prefix string) []string {
-	ret := make([]string, 0)
-	project, err := GetGCPProjectID()
+// listTombstonesGcp returns tombstones starting with prefix that have not changed since before
+func listTombstonesGcp(ctx context.Context, client *sapi.Client, project, prefix string, before time.Time, concurrency int) ([]Tombstone, error) {
+	names, err := listSecretsGcp(ctx, client, project, prefix)
 	if err != nil {
-		sentry.CaptureException(err)
-		glog.Errorf("unable to load project: %v", err)
-		return ret
+		return nil, err
 	}
-	client, err := sapi.NewClient(ctx)
-	if err != nil {
-		sentry.CaptureException(err)
-		glog.Errorf("unable to load sdk: %v", err)
-		return ret
+
+	var mutex sync.Mutex
+	changed := make(map[string]time.Time)
+
+	secrets, errs := fetchConcurrently(ctx, names, concurrency, isThrottledGcp, func(ctx context.Context, name string) (string, string, error) {
+		version, err := client.GetSecretVersion(ctx, &secretmanagerpb.GetSecretVersionRequest{Name: fmt.Sprintf("projects/%s/secrets/%s/versions/latest", project, name)})
+		if err != nil {
+			return "", "", err
+		}
+
+		changedAt := version.CreateTime.AsTime()
+		if !changedAt.Before(before) {
+			return name, "", nil
+		}
+
+		mutex.Lock()
+		changed[name] = changedAt
+		mutex.Unlock()
+
+		return getSecretGcp(ctx, client, project, name)
+	})
+
+	ret := make([]Tombstone, 0)
+	for name, value := range secrets {
+		if changedAt, ok := changed[name]; ok && value == "{}" {
+			ret = append(ret, Tombstone{Name: name, ChangedAt: changedAt})
+		}
 	}
 
-	defer client.Close()
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+
+	return ret, (&LoadError{Secrets: errs}).OrNil()
+}
+
+func listSecretsGcp(ctx context.Context, client *sapi.Client, project, prefix string) ([]string, error) {
+	ret := make([]string, 0)
 
 	var result *sapi.SecretIterator = nil
 
@@ -202,12 +618,18 @@ func listSecretsGcp(ctx context.Context, prefix string) []string {
 		result = client.ListSecrets(ctx, input)
 		for {
 			data, err := result.Next()
-			if data == nil || err == iterator.Done {
+			if err == iterator.Done {
 				break
 			}
+			if err != nil {
+				sentry.CaptureException(err)
+				glog.Errorf("Could not list secrets: %v", err)
+				return ret, err
+			}
 
 			name := getLastSegment(data.Name)
-			if strings.HasPrefix(name, prefix) {
+			// Secrets scheduled for deletion are gone (like on AWS)
+			if strings.HasPrefix(name, prefix) && data.GetExpireTime() == nil {
 				ret = append(ret, name)
 			}
 		}
@@ -217,33 +639,16 @@ func listSecretsGcp(ctx context.Context, prefix string) []string {
 		}
 	}
 
-	return ret
+	return ret, nil
 }
 
-func getSecretGcp(ctx context.Context, name string) (string, string, error) {
-	project, err := GetGCPProjectID()
-	if err != nil {
-		sentry.CaptureException(err)
-		glog.Errorf("unable to load project: %v", err)
-		return "", "", err
-	}
-	client, err := sapi.NewClient(ctx)
-	if err != nil {
-		sentry.CaptureException(err)
-		glog.Errorf("unable to load sdk: %v", err)
-		return "", "", err
-	}
-
-	defer client.Close()
-
+func getSecretGcp(ctx context.Context, client *sapi.Client, project, name string) (string, string, error) {
 	req := &secretmanagerpb.AccessSecretVersionRequest{
 		Name: fmt.Sprintf("projects/%s/secrets/%s/versions/latest", project, name),
 	}
 
 	result, err := client.AccessSecretVersion(ctx, req)
 	if err != nil {
-		sentry.CaptureException(err)
-		glog.Errorf("unable to load sdk: %v", err)
 		return "", "", err
 	}
 
@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	utils "github.com/bolt-observer/go_common/utils"
+	backoff "github.com/cenkalti/backoff/v4"
+	"github.com/getsentry/sentry-go"
+	"github.com/golang/glog"
+)
+
+// DefaultLoadConcurrency is how many secrets are fetched at the same time (LOAD_CONCURRENCY)
+const DefaultLoadConcurrency = 16
+
+// fetchFn fetches secret id and returns its name and value
+type fetchFn func(ctx context.Context, id string) (string, string, error)
+
+// loadConcurrency returns how many secrets should be fetched at the same time
+func loadConcurrency() int {
+	concurrency, err := strconv.Atoi(utils.GetEnvWithDefault("LOAD_CONCURRENCY", strconv.Itoa(DefaultLoadConcurrency)))
+	if err != nil || concurrency < 1 {
+		glog.Warningf("Invalid LOAD_CONCURRENCY, using %d", DefaultLoadConcurrency)
+		return DefaultLoadConcurrency
+	}
+
+	return concurrency
+}
+
+// newLoadBackOff returns the backoff used when the backend throttles us
+func newLoadBackOff(ctx context.Context) backoff.BackOff {
+	back := backoff.NewExponentialBackOff()
+	back.MaxElapsedTime = MaxRetryTime
+
+	return backoff.WithContext(back, ctx)
+}
+
+// withRetry calls fn until it succeeds, fails with an error that is not retryable or retrying takes too long
+func withRetry[T any](ctx context.Context, what string, retryable func(error) bool, fn func() (T, error)) (T, error) {
+	return backoff.RetryNotifyWithData(func() (T, error) {
+		ret, err := fn()
+		if err != nil && !retryable(err) {
+			return ret, backoff.Permanent(err)
+		}
+		return ret, err
+	}, newLoadBackOff(ctx), func(err error, d time.Duration) {
+		glog.Warningf("Throttled while %s, retrying in %v: %v", what, d, err)
+	})
+}
+
+// fetchConcurrently fetches secrets ids with at most concurrency calls in flight
+func fetchConcurrently(ctx context.Context, ids []string, concurrency int, retryable func(error) bool, fetch fetchFn) (map[string]string, []SecretError) {
+	type secret struct {
+		id    string
+		name  string
+		value string
+		err   error
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	jobs := make(chan string)
+	results := make(chan secret)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for id := range jobs {
+				s, err := withRetry(ctx, "fetching "+id, retryable, func() (secret, error) {
+					name, value, err := fetch(ctx, id)
+					return secret{name: name, value: value}, err
+				})
+				s.id = id
+				s.err = err
+				results <- s
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for _, id := range ids {
+			jobs <- id
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	ret := make(map[string]string, len(ids))
+	errs := make([]SecretError, 0)
+	for s := range results {
+		if s.err != nil {
+			glog.Errorf("Could not get secret %s: %v", s.id, s.err)
+			sentry.CaptureException(s.err)
+			errs = append(errs, SecretError{Name: s.id, Err: s.err})
+			continue
+		}
+		ret[s.name] = s.value
+	}
+
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Name < errs[j].Name
+	})
+
+	return ret, errs
+}
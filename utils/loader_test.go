@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSecretsAws(t *testing.T) {
+	for _, batch := range []bool{false, true} {
+		backend := newFakeAwsBackend(250, time.Millisecond, batch)
+		backend.secrets["other_"] = "x"
+		backend.throttle = 1
+
+		secrets, err := loadSecretsAws(context.Background(), backend, "macaroon_", 8)
+		require.NoError(t, err)
+		require.Len(t, secrets, 250)
+		require.Equal(t, "42", secrets["macaroon_00042_"])
+		require.LessOrEqual(t, backend.maxInFlight, int32(8))
+	}
+}
+
+func TestListTombstonesAws(t *testing.T) {
+	now := time.Now()
+
+	backend := newFakeAwsBackend(4, 0, false)
+	backend.secrets["macaroon_00000_"] = "{}"
+	backend.secrets["macaroon_00001_"] = "{}"
+	backend.changed["macaroon_00000_"] = now.Add(-48 * time.Hour)
+	backend.changed["macaroon_00001_"] = now
+	backend.changed["macaroon_00002_"] = now.Add(-48 * time.Hour)
+
+	tombstones, err := listTombstonesAws(context.Background(), backend, "macaroon_", now.Add(-24*time.Hour), 2)
+	require.NoError(t, err)
+	require.Equal(t, []Tombstone{{Name: "macaroon_00000_", ChangedAt: now.Add(-48 * time.Hour)}}, tombstones)
+}
+
+func TestFetchConcurrently(t *testing.T) {
+	ids := []string{"a", "b", "c", "d"}
+	retryable := func(err error) bool { return err.Error() == "throttled" }
+
+	throttled := int32(1)
+	secrets, errs := fetchConcurrently(context.Background(), ids, 2, retryable, func(ctx context.Context, id string) (string, string, error) {
+		switch {
+		case id == "b" && atomic.AddInt32(&throttled, -1) >= 0:
+			return "", "", errors.New("throttled")
+		case id == "d":
+			return "", "", errors.New("access denied")
+		}
+		return id + "_", strings.ToUpper(id), nil
+	})
+
+	require.Equal(t, map[string]string{"a_": "A", "b_": "B", "c_": "C"}, secrets)
+	require.Len(t, errs, 1)
+	require.Equal(t, "d", errs[0].Name)
+}
+
+func BenchmarkLoadSecretsAws(b *testing.B) {
+	for _, bench := range []struct {
+		name        string
+		concurrency int
+		batch       bool
+	}{
+		{"sequential", 1, false},
+		{"concurrent", DefaultLoadConcurrency, false},
+		{"batch", DefaultLoadConcurrency, true},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			backend := newFakeAwsBackend(500, 200*time.Microsecond, bench.batch)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				secrets, err := loadSecretsAws(context.Background(), backend, "macaroon_", bench.concurrency)
+				if err != nil || len(secrets) != 500 {
+					b.Fatalf("loading failed: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// HashAlgorithm enum
+type HashAlgorithm string
+
+// HashAlgorithm values
+const (
+	Argon2id HashAlgorithm = "argon2id"
+	Scrypt   HashAlgorithm = "scrypt"
+	Bcrypt   HashAlgorithm = "bcrypt"
+)
+
+const (
+	// Argon2id parameters (OWASP recommendation)
+	argon2Memory  = 19 * 1024
+	argon2Time    = 2
+	argon2Threads = 1
+	argon2KeyLen  = 32
+
+	// Scrypt parameters (N = 2^scryptLogN)
+	scryptLogN   = 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+
+	saltLen = 16
+
+	// Upper bounds of parameters taken from stored hashes (so a configured hash cannot exhaust memory or CPU)
+	maxArgon2Memory = 256 * 1024
+	maxArgon2Time   = 10
+	maxParallelism  = 16
+	maxScryptMemory = 256 * 1024 * 1024
+	maxKeyLen       = 64
+)
+
+// IsPasswordHash returns true when value looks like a password hash rather than a plaintext password
+func IsPasswordHash(value string) bool {
+	return strings.HasPrefix(value, "$")
+}
+
+// HashPassword hashes password with the chosen algorithm, result is in PHC string format (or modular crypt format for bcrypt)
+func HashPassword(algorithm HashAlgorithm, password string) (string, error) {
+	switch algorithm {
+	case Bcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	case Argon2id:
+		salt, err := randomSalt()
+		if err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads, b64(salt), b64(key)), nil
+	case Scrypt:
+		salt, err := randomSalt()
+		if err != nil {
+			return "", err
+		}
+		key, err := scrypt.Key([]byte(password), salt, 1<<scryptLogN, scryptR, scryptP, scryptKeyLen)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", scryptLogN, scryptR, scryptP, b64(salt), b64(key)), nil
+	}
+
+	return "", fmt.Errorf("unsupported algorithm %s", algorithm)
+}
+
+// VerifyPassword checks password against stored value (a hash or plaintext password)
+func VerifyPassword(stored, password string) bool {
+	if !IsPasswordHash(stored) {
+		// Plaintext password
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	}
+
+	switch {
+	case strings.HasPrefix(stored, "$argon2id$"):
+		return verifyArgon2id(stored, password)
+	case strings.HasPrefix(stored, "$scrypt$"):
+		return verifyScrypt(stored, password)
+	case strings.HasPrefix(stored, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+
+	return false
+}
+
+func verifyArgon2id(stored, password string) bool {
+	var (
+		version            int
+		memory, iterations uint32
+		threads            uint8
+	)
+
+	// $argon2id$v=19$m=...,t=...,p=...$salt$hash
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 {
+		return false
+	}
+
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false
+	}
+	if memory > maxArgon2Memory || iterations == 0 || iterations > maxArgon2Time || threads == 0 || threads > maxParallelism {
+		return false
+	}
+
+	salt, err := unb64(parts[4])
+	if err != nil {
+		return false
+	}
+	expected, err := unb64(parts[5])
+	if err != nil || len(expected) == 0 || len(expected) > maxKeyLen {
+		return false
+	}
+
+	key := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(expected)))
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+func verifyScrypt(stored, password string) bool {
+	var logN, r, p int
+
+	// $scrypt$ln=...,r=...,p=...$salt$hash
+	parts := strings.Split(stored, "$")
+	if len(parts) != 5 {
+		return false
+	}
+
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &logN, &r, &p); err != nil || logN <= 0 || logN > 30 {
+		return false
+	}
+	// Memory is 128 * r * N bytes, p is how many times it is done
+	if r <= 0 || p <= 0 || p > maxParallelism || 128*r > maxScryptMemory>>logN {
+		return false
+	}
+
+	salt, err := unb64(parts[3])
+	if err != nil {
+		return false
+	}
+	expected, err := unb64(parts[4])
+	if err != nil || len(expected) == 0 || len(expected) > maxKeyLen {
+		return false
+	}
+
+	key, err := scrypt.Key([]byte(password), salt, 1<<logN, r, p, len(expected))
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+func randomSalt() ([]byte, error) {
+	salt := make([]byte, saltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return salt, nil
+}
+
+func b64(data []byte) string {
+	return base64.RawStdEncoding.EncodeToString(data)
+}
+
+func unb64(data string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(data)
+}
@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashPassword(t *testing.T) {
+	for _, algorithm := range []HashAlgorithm{Argon2id, Scrypt, Bcrypt} {
+		hash, err := HashPassword(algorithm, "secret")
+		require.NoError(t, err)
+		assert.True(t, IsPasswordHash(hash))
+		assert.False(t, strings.Contains(hash, "|"))
+
+		assert.True(t, VerifyPassword(hash, "secret"), "%s should verify", algorithm)
+		assert.False(t, VerifyPassword(hash, "wrong"), "%s should not verify", algorithm)
+
+		hash2, err := HashPassword(algorithm, "secret")
+		require.NoError(t, err)
+		assert.NotEqual(t, hash, hash2, "salt should be random")
+	}
+
+	_, err := HashPassword(HashAlgorithm("md5"), "secret")
+	assert.Error(t, err)
+}
+
+func TestVerifyPassword(t *testing.T) {
+	assert.True(t, VerifyPassword("pass1", "pass1"))
+	assert.False(t, VerifyPassword("pass1", "pass2"))
+	assert.False(t, VerifyPassword("pass1", ""))
+
+	assert.True(t, VerifyPassword("$2a$10$m.Wdkic9j5eOO0L9w49Zo.1HrSDglSc6M1QcaZO5egLs2teohd9Wi", "pass2"))
+
+	// Placeholder for IAM authentication must never match
+	assert.False(t, VerifyPassword(IAMAuthFlag, IAMAuthFlag))
+	assert.False(t, VerifyPassword(IAMAuthFlag, ""))
+
+	// Malformed hashes
+	assert.False(t, VerifyPassword("$argon2id$v=19$m=19456,t=2,p=1$", ""))
+	assert.False(t, VerifyPassword("$argon2id$v=19$m=19456,t=2,p=1$c2FsdA$", ""))
+	assert.False(t, VerifyPassword("$scrypt$ln=99,r=8,p=1$c2FsdA$aGFzaA", "secret"))
+
+	// Parameters that would exhaust memory or CPU
+	assert.False(t, VerifyPassword("$argon2id$v=19$m=4194304,t=2,p=1$c2FsdA$aGFzaA", "secret"))
+	assert.False(t, VerifyPassword("$argon2id$v=19$m=19456,t=1000000,p=1$c2FsdA$aGFzaA", "secret"))
+	assert.False(t, VerifyPassword("$argon2id$v=19$m=19456,t=2,p=0$c2FsdA$aGFzaA", "secret"))
+	assert.False(t, VerifyPassword("$scrypt$ln=20,r=8,p=1$c2FsdA$aGFzaA", "secret"))
+	assert.False(t, VerifyPassword("$scrypt$ln=15,r=8,p=1000$c2FsdA$aGFzaA", "secret"))
+}
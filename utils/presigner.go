@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -53,6 +54,10 @@ const (
 	HTTPRetryTime = 3 * time.Second
 )
 
+var (
+	regionRegex = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]$`)
+)
+
 var (
 	region   string
 	service  string
@@ -83,20 +88,100 @@ func init() {
 //   - ARN of the identity when successful
 //   - error else
 func VerifyGetCallerIdentity(query string, timeout time.Duration) (string, error) {
+	result, err := VerifyGetCallerIdentityResult(query, timeout)
+	if err != nil {
+		return "", err
+	}
+
+	return result.Arn, nil
+}
+
+// AllowedRegions returns the regions whose STS endpoints we accept presigned requests for
+// (STS_ALLOWED_REGIONS, defaults to AWS_DEFAULT_REGION)
+func AllowedRegions() []string {
+	return splitList(utils.GetEnvWithDefault("STS_ALLOWED_REGIONS", region))
+}
+
+// AllowedAccounts returns the AWS account ids identities can belong to (STS_ALLOWED_ACCOUNTS, empty means any)
+func AllowedAccounts() []string {
+	return splitList(utils.GetEnvWithDefault("STS_ALLOWED_ACCOUNTS", ""))
+}
+
+func splitList(value string) []string {
+	ret := make([]string, 0)
+	for _, one := range strings.Split(value, Delimiter) {
+		one = strings.TrimSpace(one)
+		if one != "" {
+			ret = append(ret, one)
+		}
+	}
+
+	return ret
+}
+
+func contains(list []string, value string) bool {
+	for _, one := range list {
+		if one == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stsEndpointForQuery determines the regional STS endpoint from the credential scope of the presigned query,
+// the region needs to be allowed and the endpoint is constructed by us (hostname is never taken from the client)
+func stsEndpointForQuery(query string) (string, error) {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return "", fmt.Errorf("invalid query string")
+	}
+
+	// AKID/date/region/service/aws4_request
+	scope := strings.Split(values.Get("X-Amz-Credential"), "/")
+	if len(scope) != 5 || scope[3] != service || scope[4] != "aws4_request" {
+		return "", fmt.Errorf("invalid credential scope")
+	}
+
+	r := scope[2]
+	if !regionRegex.MatchString(r) {
+		return "", fmt.Errorf("invalid region")
+	}
+
+	if !contains(AllowedRegions(), r) {
+		return "", fmt.Errorf("region %s is not allowed", r)
+	}
+
+	return fmt.Sprintf("https://%s.%s.amazonaws.com/", service, r), nil
+}
+
+// VerifyGetCallerIdentityResult will verify that query string received is actually a presigned URL
+// to sts/GetCallerIdentity of an allowed region.
+// Returns:
+//   - the identity (ARN, UserId and Account) when successful
+//   - error else
+func VerifyGetCallerIdentityResult(query string, timeout time.Duration) (*GetCallerIdentityResult, error) {
 	var identity GetCallerIdentityResponse
 
 	val, cached := tokenCache.Get(query)
 	if cached {
-		return val.(string), nil
+		result := val.(GetCallerIdentityResult)
+		return &result, nil
 	}
 
 	if strings.ContainsAny(query, "@?/") || strings.HasPrefix(query, "http") {
-		return "", fmt.Errorf("invalid query string")
+		// Credential scope is URL encoded so there are no slashes
+		return nil, fmt.Errorf("invalid query string")
 	}
 
-	req, err := http.NewRequest(http.MethodPost, endpoint, nil)
+	stsEndpoint, err := stsEndpointForQuery(query)
 	if err != nil {
-		return "", fmt.Errorf("unable to create request, %v", err)
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, stsEndpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create request, %v", err)
 	}
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
@@ -105,7 +190,7 @@ func VerifyGetCallerIdentity(query string, timeout time.Duration) (string, error
 	for key := range req.URL.Query() {
 		lowKey := strings.ToLower(key)
 		if lowKey == "action" || lowKey == "redirect" || lowKey == "version" {
-			return "", fmt.Errorf("action trickery detected")
+			return nil, fmt.Errorf("action trickery detected")
 		}
 	}
 
@@ -120,7 +205,7 @@ func VerifyGetCallerIdentity(query string, timeout time.Duration) (string, error
 	}
 
 	if !strings.HasSuffix(req.URL.Hostname(), ".amazonaws.com") {
-		return "", fmt.Errorf("hostname trickery detected, %s", req.URL.Hostname())
+		return nil, fmt.Errorf("hostname trickery detected, %s", req.URL.Hostname())
 	}
 
 	back := backoff.NewExponentialBackOff()
@@ -132,31 +217,43 @@ func VerifyGetCallerIdentity(query string, timeout time.Duration) (string, error
 		glog.Warningf("Error calling VerifyGetCallerIdentity")
 	})
 	if err != nil {
-		return "", fmt.Errorf("unable to make request, %v", err)
+		return nil, fmt.Errorf("unable to make request, %v", err)
 	}
 
 	if resp.StatusCode == 401 || resp.StatusCode == 403 {
-		return "", fmt.Errorf("got unauthorized, %v", resp.StatusCode)
+		return nil, fmt.Errorf("got unauthorized, %v", resp.StatusCode)
 	}
 
 	defer resp.Body.Close()
 
 	b, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("unable to read response body: %v", err)
+		return nil, fmt.Errorf("unable to read response body: %v", err)
 	}
 
 	err = xml.Unmarshal(b, &identity)
 	if err != nil {
-		return "", fmt.Errorf("unable to deserialize response, %v", err)
+		return nil, fmt.Errorf("unable to deserialize response, %v", err)
+	}
+
+	result := identity.GetCallerIdentityResult
+	if result.Arn == "" {
+		return nil, fmt.Errorf("empty result")
+	}
+
+	accounts := AllowedAccounts()
+	if len(accounts) > 0 && !contains(accounts, result.Account) {
+		return nil, fmt.Errorf("account %s is not allowed", result.Account)
 	}
 
-	if identity.GetCallerIdentityResult.Arn == "" {
-		return "", fmt.Errorf("empty result")
+	// ARN needs to belong to the same account
+	arnParts := strings.Split(result.Arn, ":")
+	if len(arnParts) < 5 || arnParts[4] != result.Account {
+		return nil, fmt.Errorf("account mismatch")
 	}
 
-	tokenCache.Set(query, identity.GetCallerIdentityResult.Arn)
-	return identity.GetCallerIdentityResult.Arn, nil
+	tokenCache.Set(query, result)
+	return &result, nil
 }
 
 // PresignGetCallerIdentity will sign a query string
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"context"
+	"errors"
 	"math/rand"
 	"testing"
 
@@ -29,7 +30,8 @@ func TestPlatformSecretsManager(t *testing.T) {
 	ctx := context.Background()
 	s := GetPlatformSecretsManager()
 
-	all := s.LoadSecrets(ctx, Prefix)
+	all, err := s.LoadSecrets(ctx, Prefix)
+	require.NoError(t, err)
 	require.NotNil(t, all)
 	if len(all) != 0 {
 		for k := range all {
@@ -41,11 +43,12 @@ func TestPlatformSecretsManager(t *testing.T) {
 
 	t.Log("Trying first secret")
 	name := Prefix + RandSeq(10)
-	_, ch, err := s.InsertOrUpdateSecret(ctx, name, "secret1")
+	_, ch, err := s.InsertOrUpdateSecret(ctx, name, "secret1", nil)
 	require.NoError(t, err)
 	require.Equal(t, Inserted, ch)
 
-	all = s.LoadSecrets(ctx, Prefix)
+	all, err = s.LoadSecrets(ctx, Prefix)
+	require.NoError(t, err)
 	require.NotNil(t, all)
 	val, ok := all[name]
 	require.Equal(t, true, ok)
@@ -54,11 +57,12 @@ func TestPlatformSecretsManager(t *testing.T) {
 	require.Equal(t, false, ok)
 
 	t.Log("Trying second secret")
-	_, ch, err = s.InsertOrUpdateSecret(ctx, name, "secret2")
+	_, ch, err = s.InsertOrUpdateSecret(ctx, name, "secret2", nil)
 	require.NoError(t, err)
 	require.Equal(t, Updated, ch)
 
-	all = s.LoadSecrets(ctx, Prefix)
+	all, err = s.LoadSecrets(ctx, Prefix)
+	require.NoError(t, err)
 	require.NotNil(t, all)
 	val, ok = all[name]
 	require.Equal(t, true, ok)
@@ -72,8 +76,34 @@ func TestPlatformSecretsManager(t *testing.T) {
 	_, err = s.DeleteSecret(ctx, name)
 	require.NoError(t, err)
 
-	all = s.LoadSecrets(ctx, Prefix)
+	all, err = s.LoadSecrets(ctx, Prefix)
+	require.NoError(t, err)
 	require.NotNil(t, all)
 	_, ok = all[name]
 	require.Equal(t, false, ok)
 }
+
+func TestLoadError(t *testing.T) {
+	loadErr := &LoadError{}
+	require.NoError(t, loadErr.OrNil())
+
+	loadErr.Add("secret1", errors.New("access denied"))
+	err := loadErr.OrNil()
+	require.Error(t, err)
+	require.Equal(t, "could not load secrets: secret1: access denied", err.Error())
+
+	var target *LoadError
+	require.True(t, errors.As(err, &target))
+	require.Equal(t, "secret1", target.Secrets[0].Name)
+
+	loadErr = &LoadError{ListErr: errors.New("throttled")}
+	require.Equal(t, "could not load secrets: listing failed: throttled", loadErr.OrNil().Error())
+}
+
+func TestGcpInsecureWithoutEndpoint(t *testing.T) {
+	s := NewGcpSecretsManagerWithConfig(SecretsManagerConfig{Insecure: true})
+
+	_, _, err := s.getClient(context.Background())
+	require.ErrorIs(t, err, ErrInsecureWithoutEndpoint)
+	require.True(t, isPermanentGcp(err))
+}
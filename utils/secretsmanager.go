@@ -2,8 +2,70 @@ package utils
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	utils "github.com/bolt-observer/go_common/utils"
+	"github.com/golang/glog"
 )
 
+// DefaultSecretsTimeout is the timeout of a single call to the cloud secrets manager
+const DefaultSecretsTimeout = 10 * time.Second
+
+// DefaultKeepVersions is how many versions of a GCP secret are kept, older ones are destroyed
+const DefaultKeepVersions = 2
+
+// SecretsManagerConfig configures the clients of cloud secrets managers
+type SecretsManagerConfig struct {
+	// Endpoint overrides the endpoint of the service (e.g., a local stand-in for tests)
+	Endpoint string
+	// Insecure uses a plaintext connection without authentication to Endpoint (GCP only and only with Endpoint, AWS uses the scheme of Endpoint)
+	Insecure bool
+	// Timeout of a single call
+	Timeout time.Duration
+	// KeepVersions is how many versions of a secret are kept (GCP only, 0 keeps all)
+	KeepVersions int
+	// KmsKeyID encrypts created secrets with a customer managed key (AWS only, empty uses the AWS managed key)
+	KmsKeyID string
+	// ReplicaLocations replicates created secrets only to these locations (GCP only, empty uses automatic replication)
+	ReplicaLocations []string
+}
+
+// secretsManagerConfigFromEnv returns the configuration from environment variables (endpoint is read from endpointVar)
+func secretsManagerConfigFromEnv(endpointVar string) SecretsManagerConfig {
+	timeout, err := time.ParseDuration(utils.GetEnvWithDefault("SECRETS_TIMEOUT", DefaultSecretsTimeout.String()))
+	if err != nil {
+		glog.Warningf("Invalid SECRETS_TIMEOUT, using %v", DefaultSecretsTimeout)
+		timeout = DefaultSecretsTimeout
+	}
+
+	insecure, err := strconv.ParseBool(utils.GetEnvWithDefault("SECRETS_ENDPOINT_INSECURE", "false"))
+	if err != nil {
+		insecure = false
+	}
+
+	keep, err := strconv.Atoi(utils.GetEnvWithDefault("GCP_KEEP_VERSIONS", strconv.Itoa(DefaultKeepVersions)))
+	if err != nil || keep < 0 {
+		glog.Warningf("Invalid GCP_KEEP_VERSIONS, using %d", DefaultKeepVersions)
+		keep = DefaultKeepVersions
+	}
+
+	return SecretsManagerConfig{
+		Endpoint:         utils.GetEnvWithDefault(endpointVar, ""),
+		Insecure:         insecure,
+		Timeout:          timeout,
+		KeepVersions:     keep,
+		KmsKeyID:         utils.GetEnvWithDefault("AWS_KMS_KEY_ID", ""),
+		ReplicaLocations: splitList(utils.GetEnvWithDefault("GCP_REPLICATION_LOCATIONS", "")),
+	}
+}
+
+// ErrSecretNotFound is returned when deleting a secret that does not exist (or is already scheduled for deletion)
+var ErrSecretNotFound = errors.New("secret does not exist")
+
 // Change enum
 type Change int
 
@@ -14,11 +76,96 @@ const (
 	Updated
 )
 
+// Metadata is applied to stored secrets as AWS tags or GCP labels
+type Metadata map[string]string
+
+// Metadata keys
+const (
+	MetadataPubKey    = "pubkey"
+	MetadataUniqueID  = "unique-id"
+	MetadataEnv       = "env"
+	MetadataAPIType   = "api-type"
+	MetadataManagedBy = "managed-by"
+)
+
+// ManagedBy is the value of MetadataManagedBy
+const ManagedBy = "lightning-vault"
+
 // SecretsManager interface
 type SecretsManager interface {
-	InsertOrUpdateSecret(ctx context.Context, name, value string) (string, Change, error)
+	// InsertOrUpdateSecret stores value, metadata is added to the existing one (nil keeps it)
+	InsertOrUpdateSecret(ctx context.Context, name, value string, metadata Metadata) (string, Change, error)
 	DeleteSecret(ctx context.Context, name string) (string, error)
-	LoadSecrets(ctx context.Context, prefix string) map[string]string
+	// LoadSecrets returns secrets starting with prefix, when some could not be loaded the error is a *LoadError (and the rest is still returned)
+	LoadSecrets(ctx context.Context, prefix string) (map[string]string, error)
+}
+
+// SecretError is a secret that could not be loaded
+type SecretError struct {
+	Name string
+	Err  error
+}
+
+func (e SecretError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Name, e.Err)
+}
+
+func (e SecretError) Unwrap() error {
+	return e.Err
+}
+
+// LoadError describes what LoadSecrets could not load
+type LoadError struct {
+	// ListErr is set when listing failed (so not even all names are known)
+	ListErr error
+	// Secrets that were listed but could not be fetched
+	Secrets []SecretError
+}
+
+func (e *LoadError) Error() string {
+	reasons := make([]string, 0, len(e.Secrets)+1)
+	if e.ListErr != nil {
+		reasons = append(reasons, fmt.Sprintf("listing failed: %v", e.ListErr))
+	}
+	for _, secret := range e.Secrets {
+		reasons = append(reasons, secret.Error())
+	}
+
+	return fmt.Sprintf("could not load secrets: %s", strings.Join(reasons, "; "))
+}
+
+// Add records that secret name could not be fetched
+func (e *LoadError) Add(name string, err error) {
+	e.Secrets = append(e.Secrets, SecretError{Name: name, Err: err})
+}
+
+// OrNil returns e when something failed and nil otherwise
+func (e *LoadError) OrNil() error {
+	if e.ListErr == nil && len(e.Secrets) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+// Pinger is implemented by secrets managers that can check whether the backend is reachable
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Tombstone is a secret that was deleted by overwriting it with "{}"
+type Tombstone struct {
+	Name string
+	// ChangedAt is when the secret was last changed (roughly when it was deleted)
+	ChangedAt time.Time
+}
+
+// Purger is implemented by secrets managers that can remove secrets for good
+type Purger interface {
+	// ScheduleDeletion deletes secret name after recoveryDays (immediately when 0)
+	ScheduleDeletion(ctx context.Context, name string, recoveryDays int) (string, error)
+	// ListTombstones returns tombstones starting with prefix that have not changed since before
+	ListTombstones(ctx context.Context, prefix string, before time.Time) ([]Tombstone, error)
 }
 
 // GetPlatformSecretsManager - gets the implementation for the current platform
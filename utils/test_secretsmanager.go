@@ -2,22 +2,35 @@ package utils
 
 import (
 	"context"
+	"time"
 )
 
 // InsertOrUpdateSecretFn method
-type InsertOrUpdateSecretFn func(ctx context.Context, name, value string) (string, Change, error)
+type InsertOrUpdateSecretFn func(ctx context.Context, name, value string, metadata Metadata) (string, Change, error)
 
 // DeleteSecretFn method
 type DeleteSecretFn func(ctx context.Context, name string) (string, error)
 
 // LoadSecretsFn method
-type LoadSecretsFn func(ctx context.Context, prefix string) map[string]string
+type LoadSecretsFn func(ctx context.Context, prefix string) (map[string]string, error)
+
+// PingFn method
+type PingFn func(ctx context.Context) error
+
+// ScheduleDeletionFn method
+type ScheduleDeletionFn func(ctx context.Context, name string, recoveryDays int) (string, error)
+
+// ListTombstonesFn method
+type ListTombstonesFn func(ctx context.Context, prefix string, before time.Time) ([]Tombstone, error)
 
 // TestSecretsManager struct.
 type TestSecretsManager struct {
 	InsertOrUpdateSecretFn InsertOrUpdateSecretFn
 	DeleteSecretFn         DeleteSecretFn
 	LoadSecretsFn          LoadSecretsFn
+	PingFn                 PingFn
+	ScheduleDeletionFn     ScheduleDeletionFn
+	ListTombstonesFn       ListTombstonesFn
 	Dummy                  DummySecretsManager
 }
 
@@ -27,17 +40,20 @@ func NewTestSecretsManager() *TestSecretsManager {
 		InsertOrUpdateSecretFn: nil,
 		DeleteSecretFn:         nil,
 		LoadSecretsFn:          nil,
+		PingFn:                 nil,
+		ScheduleDeletionFn:     nil,
+		ListTombstonesFn:       nil,
 		Dummy:                  *NewDummySecretsManager(),
 	}
 }
 
 // InsertOrUpdateSecret - inserts or updates secret
-func (s *TestSecretsManager) InsertOrUpdateSecret(ctx context.Context, name, value string) (string, Change, error) {
+func (s *TestSecretsManager) InsertOrUpdateSecret(ctx context.Context, name, value string, metadata Metadata) (string, Change, error) {
 	if s.InsertOrUpdateSecretFn != nil {
-		return s.InsertOrUpdateSecretFn(ctx, name, value)
+		return s.InsertOrUpdateSecretFn(ctx, name, value, metadata)
 	}
 
-	return s.Dummy.InsertOrUpdateSecret(ctx, name, value)
+	return s.Dummy.InsertOrUpdateSecret(ctx, name, value, metadata)
 }
 
 // DeleteSecret - deletes a secret
@@ -50,10 +66,37 @@ func (s *TestSecretsManager) DeleteSecret(ctx context.Context, name string) (str
 }
 
 // LoadSecrets - loads secrets
-func (s *TestSecretsManager) LoadSecrets(ctx context.Context, prefix string) map[string]string {
+func (s *TestSecretsManager) LoadSecrets(ctx context.Context, prefix string) (map[string]string, error) {
 	if s.LoadSecretsFn != nil {
 		return s.LoadSecretsFn(ctx, prefix)
 	}
 
 	return s.Dummy.LoadSecrets(ctx, prefix)
 }
+
+// Ping - checks whether the backend is reachable
+func (s *TestSecretsManager) Ping(ctx context.Context) error {
+	if s.PingFn != nil {
+		return s.PingFn(ctx)
+	}
+
+	return s.Dummy.Ping(ctx)
+}
+
+// ScheduleDeletion - deletes a secret after the recovery window
+func (s *TestSecretsManager) ScheduleDeletion(ctx context.Context, name string, recoveryDays int) (string, error) {
+	if s.ScheduleDeletionFn != nil {
+		return s.ScheduleDeletionFn(ctx, name, recoveryDays)
+	}
+
+	return s.Dummy.ScheduleDeletion(ctx, name, recoveryDays)
+}
+
+// ListTombstones - lists tombstones
+func (s *TestSecretsManager) ListTombstones(ctx context.Context, prefix string, before time.Time) ([]Tombstone, error) {
+	if s.ListTombstonesFn != nil {
+		return s.ListTombstonesFn(ctx, prefix, before)
+	}
+
+	return s.Dummy.ListTombstones(ctx, prefix, before)
+}
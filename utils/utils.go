@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"strings"
 	"time"
 
 	api "github.com/bolt-observer/agent/lightning"
@@ -10,14 +11,30 @@ import (
 const (
 	// Delimiter between entries
 	Delimiter = ","
+	// EntryEscape before Delimiter makes it part of the entry
+	EntryEscape = "\\"
 	// UserPassSeparator separates username from password (cannot use :)
 	UserPassSeparator = "|"
 	// IAMAuthFlag defines that IAM authentication should be used
 	IAMAuthFlag = "$iam" // starts with $ so it's an invalid crypted password
 )
 
+// CredentialInfo describes a constrained credential
+type CredentialInfo struct {
+	ExpiresAt         time.Time `json:"expires_at"`
+	Caveats           []string  `json:"caveats"`
+	AuthenticatorType string    `json:"authenticator_type"`
+	IssuanceID        string    `json:"issuance_id,omitempty"`
+}
+
 // GetConstrained returns a constrained version of d (macaroon will be time constrained)
 func GetConstrained(d *entities.Data, duration time.Duration) entities.Data {
+	data, _ := GetConstrainedWithInfo(d, duration)
+	return data
+}
+
+// GetConstrainedWithInfo returns a constrained version of d together with the description of the constraints
+func GetConstrainedWithInfo(d *entities.Data, duration time.Duration) (entities.Data, CredentialInfo) {
 	data := new(entities.Data)
 	data.PubKey = d.PubKey
 	data.CertificateBase64 = d.CertificateBase64
@@ -31,12 +48,45 @@ func GetConstrained(d *entities.Data, duration time.Duration) entities.Data {
 		typ = nil
 	}
 
-	mac, err := Constrain(d.MacaroonHex, duration, typ)
+	// Constrainers use the current time too, truncating makes sure we never report a later expiry
+	info := CredentialInfo{
+		ExpiresAt:         time.Now().Add(duration).UTC().Truncate(time.Second),
+		Caveats:           make([]string, 0),
+		AuthenticatorType: DetectAuthenticatorType(d.MacaroonHex, typ).String(),
+	}
+
+	mac, caveats, err := ConstrainWithCaveats(d.MacaroonHex, duration, typ)
 	if err != nil {
 		// Censor macaroon on error
 		data.MacaroonHex = ""
 	} else {
 		data.MacaroonHex = mac
+		if caveats != nil {
+			info.Caveats = caveats
+		}
 	}
-	return *data
+	return *data, info
+}
+
+// SplitEntries splits a list of user|password entries separated with Delimiter.
+// Delimiter inside an entry (e.g., in the PHC string format $argon2id$v=19$m=19456\,t=2\,p=1$...) has to be escaped with \.
+func SplitEntries(value string) []string {
+	result := make([]string, 0)
+	current := ""
+	for _, fragment := range strings.Split(value, Delimiter) {
+		if strings.HasSuffix(fragment, EntryEscape) {
+			current += strings.TrimSuffix(fragment, EntryEscape) + Delimiter
+			continue
+		}
+
+		result = append(result, current+fragment)
+		current = ""
+	}
+
+	return result
+}
+
+// EscapeEntry escapes Delimiter in a user|password entry so SplitEntries keeps it together
+func EscapeEntry(entry string) string {
+	return strings.ReplaceAll(entry, Delimiter, EntryEscape+Delimiter)
 }
@@ -8,6 +8,7 @@ import (
 
 	entities "github.com/bolt-observer/go_common/entities"
 	"github.com/mitchellh/hashstructure/v2"
+	"github.com/stretchr/testify/assert"
 )
 
 func randomString(n int) string {
@@ -102,3 +103,15 @@ func TestGetConstrained(t *testing.T) {
 		return
 	}
 }
+
+func TestSplitEntries(t *testing.T) {
+	assert.Equal(t, []string{"user1|pass1", "user2|pass2"}, SplitEntries("user1|pass1,user2|pass2"))
+	assert.Equal(t, []string{""}, SplitEntries(""))
+
+	hash := "$argon2id$v=19$m=19456,t=2,p=1$c2FsdHNhbHRzYWx0$aGFzaGhhc2hoYXNoaGFzaGhhc2hoYXNoaGFzaGhhc2g"
+	assert.Equal(t, []string{"user1|" + hash, "user2|pass2", "arn:aws:sts::123456789012:*|$iam"}, SplitEntries(EscapeEntry("user1|"+hash)+",user2|pass2,arn:aws:sts::123456789012:*|$iam"))
+	assert.Equal(t, `user1|$argon2id$v=19$m=19456\,t=2\,p=1$`, EscapeEntry("user1|$argon2id$v=19$m=19456,t=2,p=1$"))
+
+	// Fragments without a separator are not glued to the previous entry (they are invalid on their own)
+	assert.Equal(t, []string{"user1|pass1", "pass2", "user3|pass3"}, SplitEntries("user1|pass1,pass2,user3|pass3"))
+}